@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/fatih/color"
+	"github.com/manifoldco/promptui"
+)
+
+func Devices() {
+	for {
+		devices, err := safepool.Devices()
+		if core.IsErr(err, "cannot read devices: %v") {
+			color.Red("cannot read devices")
+			return
+		}
+
+		items := []string{"Action: Back", "Action: Add Device", "Action: Link To User"}
+		for _, d := range devices {
+			if d.Revoked {
+				items = append(items, fmt.Sprintf("%s (revoked) - %s", d.Device, d.DeviceId))
+			} else {
+				items = append(items, fmt.Sprintf("%s - %s", d.Device, d.DeviceId))
+			}
+		}
+
+		prompt := promptui.Select{
+			Label: "Select a device to revoke",
+			Items: items,
+		}
+		idx, _, _ := prompt.Run()
+		switch idx {
+		case 0:
+			return
+		case 1:
+			addDevice()
+		case 2:
+			linkDevice()
+		default:
+			d := devices[idx-3]
+			if d.Revoked {
+				continue
+			}
+			confirm := promptui.Prompt{
+				Label:     fmt.Sprintf("Revoke %s", d.Device),
+				IsConfirm: true,
+			}
+			if _, err := confirm.Run(); err != nil {
+				continue
+			}
+			err = safepool.RevokeDevice(d.DeviceId)
+			if core.IsErr(err, "cannot revoke device: %v") {
+				color.Red("cannot revoke device: %v", err)
+			}
+		}
+	}
+}
+
+func addDevice() {
+	prompt := promptui.Prompt{
+		Label: "Public id of the device",
+	}
+	deviceId, _ := prompt.Run()
+	if deviceId == "" {
+		return
+	}
+	prompt = promptui.Prompt{
+		Label: "Device name",
+	}
+	name, _ := prompt.Run()
+
+	certificate, err := safepool.DelegateDevice(deviceId, name)
+	if core.IsErr(err, "cannot delegate device: %v") {
+		color.Red("cannot delegate device: %v", err)
+		return
+	}
+	color.Green("Link the device with the following certificate\n%s", certificate)
+}
+
+func linkDevice() {
+	prompt := promptui.Prompt{
+		Label:       "Certificate from your main device",
+		HideEntered: true,
+	}
+	certificate, _ := prompt.Run()
+	if certificate == "" {
+		return
+	}
+
+	err := safepool.LinkDevice(certificate)
+	if core.IsErr(err, "cannot link device: %v") {
+		color.Red("cannot link device: %v", err)
+		return
+	}
+	color.Green("This device acts now on behalf of your user")
+}
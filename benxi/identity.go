@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/fatih/color"
+	"github.com/manifoldco/promptui"
+)
+
+func askPassphrase(confirm bool) string {
+	prompt := promptui.Prompt{
+		Label: "Passphrase",
+		Mask:  '*',
+	}
+	passphrase, _ := prompt.Run()
+	if !confirm {
+		return passphrase
+	}
+
+	prompt.Label = "Repeat the passphrase"
+	again, _ := prompt.Run()
+	if again != passphrase {
+		color.Red("passphrases do not match")
+		return ""
+	}
+	return passphrase
+}
+
+func ExportSelf() {
+	prompt := promptui.Prompt{
+		Label:   "File",
+		Default: "identity.safepool",
+	}
+	name, _ := prompt.Run()
+	if name == "" {
+		return
+	}
+	passphrase := askPassphrase(true)
+	if passphrase == "" {
+		return
+	}
+
+	data, err := safepool.ExportSelf(passphrase)
+	if core.IsErr(err, "cannot export identity: %v") {
+		color.Red("cannot export identity: %v", err)
+		return
+	}
+	err = os.WriteFile(name, data, 0600)
+	if core.IsErr(err, "cannot write file '%s': %v", name) {
+		color.Red("cannot write file '%s': %v", name, err)
+		return
+	}
+	color.Green("Identity saved to %s", name)
+}
+
+func ShowPaperKey() {
+	paper, err := safepool.PaperKey()
+	if core.IsErr(err, "cannot create paper key: %v") {
+		color.Red("cannot create paper key: %v", err)
+		return
+	}
+	color.Yellow("Write down the key and keep it safe. Anyone with the key can act as you")
+	color.Green(paper)
+}
+
+// ImportSelf replaces the identity in a fresh DB with the one exported to the file name
+func ImportSelf(name string) bool {
+	data, err := os.ReadFile(name)
+	if core.IsErr(err, "cannot read file '%s': %v", name) {
+		color.Red("cannot read file '%s': %v", name, err)
+		return false
+	}
+
+	err = safepool.ImportSelf(data, askPassphrase(false))
+	if core.IsErr(err, "cannot import identity: %v") {
+		color.Red("cannot import identity: %v", err)
+		return false
+	}
+	color.Green("Identity %s restored", safepool.Self.Nick)
+	return true
+}
+
+// RestorePaperKey replaces the identity in a fresh DB with the one of a paper key
+func RestorePaperKey() bool {
+	prompt := promptui.Prompt{
+		Label:       "Paper key",
+		HideEntered: true,
+	}
+	paper, _ := prompt.Run()
+	prompt = promptui.Prompt{
+		Label: "Nick",
+	}
+	nick, _ := prompt.Run()
+
+	err := safepool.RestoreSelf(paper, nick)
+	if core.IsErr(err, "cannot restore identity: %v") {
+		color.Red("cannot restore identity: %v", err)
+		return false
+	}
+	color.Green("Identity %s restored", safepool.Self.Nick)
+	return true
+}
+
+func RotateKeys() {
+	confirm := promptui.Prompt{
+		Label:     "Replace your keys. Backups of the current identity will not work anymore",
+		IsConfirm: true,
+	}
+	if _, err := confirm.Run(); err != nil {
+		return
+	}
+
+	err := safepool.RotateIdentity()
+	if core.IsErr(err, "cannot rotate keys: %v") {
+		color.Red("cannot rotate keys: %v", err)
+		return
+	}
+	color.Green("My new Public id: %s", safepool.Self.Id())
+}
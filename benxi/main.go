@@ -9,12 +9,16 @@ import (
 )
 
 var dbName = "safepool.db"
+var importFile string
+var paperKey bool
 
 func parseFlags() {
 	var verbose int
 
 	flag.IntVar(&verbose, "v", 0, "verbose level - 0 to 2")
 	flag.StringVar(&dbName, "d", "", "location of the SQLlite DB")
+	flag.StringVar(&importFile, "i", "", "restore the identity exported to a file into a new DB")
+	flag.BoolVar(&paperKey, "p", false, "restore the identity from a paper key into a new DB")
 	flag.Parse()
 
 	switch verbose {
@@ -32,5 +36,11 @@ func main() {
 
 	dbPath := path.Join(xdg.ConfigHome, dbName)
 	safepool.Start(dbPath)
+	if importFile != "" && !ImportSelf(importFile) {
+		return
+	}
+	if paperKey && !RestorePaperKey() {
+		return
+	}
 	SelectMain()
 }
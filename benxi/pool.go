@@ -70,4 +70,20 @@ func SelectMain() {
 func Settings() {
 	color.Green("My Nick: %s", safepool.Self.Nick)
 	color.Green("My Public id: %s", safepool.Self.Id())
+
+	prompt := promptui.Select{
+		Label: "Choose",
+		Items: []string{"💾 Export Identity", "📝 Show Paper Key", "📱 Devices", "🔑 Rotate Keys", "🔙 Back"},
+	}
+	idx, _, _ := prompt.Run()
+	switch idx {
+	case 0:
+		ExportSelf()
+	case 1:
+		ShowPaperKey()
+	case 2:
+		Devices()
+	case 3:
+		RotateKeys()
+	}
 }
@@ -25,16 +25,17 @@ func Trust() {
 			trustedSet[t.Id()] = true
 		}
 
+		levels, _ := security.TrustLevels()
 		for _, i := range identities {
 			if trustedSet[i.Id()] {
 				items = append(items, fmt.Sprintf("%s (T) %s - %s", i.Nick, i.Email, i.Id()))
 			} else {
-				items = append(items, fmt.Sprintf("%s ( ) %s - %s", i.Nick, i.Email, i.Id()))
+				items = append(items, fmt.Sprintf("%s (%d) %s - %s", i.Nick, levels[i.Id()], i.Email, i.Id()))
 			}
 		}
 
 		prompt := promptui.Select{
-			Label: "Select to trust/untrust a bather",
+			Label: "Select a bather to trust or endorse",
 			Items: items,
 		}
 
@@ -44,8 +45,42 @@ func Trust() {
 		}
 
 		identity := identities[idx-1]
-		security.Trust(identity, !trustedSet[identity.Id()])
-		trustedSet[identity.Id()] = !trustedSet[identity.Id()]
+		action := promptui.Select{
+			Label: identity.Nick,
+			Items: []string{"Back", "Trust/Untrust", "Endorse", "Withdraw Endorsement", "Verify"},
+		}
+		switch a, _, _ := action.Run(); a {
+		case 1:
+			security.Trust(identity, !trustedSet[identity.Id()])
+		case 2, 3:
+			err = safepool.Endorse(identity.Id(), a == 2)
+			if core.IsErr(err, "cannot endorse: %v") {
+				color.Red("cannot endorse %s: %v", identity.Nick, err)
+			}
+		case 4:
+			verify(identity)
+		}
+	}
+
+}
+
+func verify(identity security.Identity) {
+	s, err := safepool.SafetyNumber(identity.Id())
+	if core.IsErr(err, "cannot compute safety number: %v") {
+		color.Red("cannot compute safety number: %v", err)
+		return
 	}
+	fmt.Printf("Compare with %s in person or on a call\n\n%s\n%s\n\n", identity.Nick, s.Numeric, s.Emoji)
 
+	confirm := promptui.Prompt{
+		Label:     "Do the safety numbers match",
+		IsConfirm: true,
+	}
+	if _, err := confirm.Run(); err != nil {
+		return
+	}
+	err = safepool.SetVerified(identity.Id(), true)
+	if !core.IsErr(err, "cannot verify identity: %v") {
+		color.Green("%s is verified", identity.Nick)
+	}
 }
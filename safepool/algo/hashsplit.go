@@ -2,6 +2,7 @@ package algo
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -16,6 +17,15 @@ import (
 
 const windowSize = 32
 
+// HashSplitMaxRatio bounds the size of a block to HashSplitMaxRatio times the average size, so that content
+// without boundaries, e.g. zeroes, is still split
+const HashSplitMaxRatio = 4
+
+// HashSplitMaxBits is the largest splitBits accepted, so that the size of a block fits in a HashBlock
+const HashSplitMaxBits = 29
+
+var ErrInvalidSplitBits = errors.New("split bits out of range")
+
 type HashBlock struct {
 	Hash   []byte
 	Length uint32
@@ -26,20 +36,41 @@ func getHashBlock(hashFun hash.Hash, length uint32, bufs ...[]byte) HashBlock {
 	for _, buf := range bufs {
 		hashFun.Write(buf)
 	}
-	block := HashBlock{
+	return HashBlock{
+		Hash:   hashFun.Sum(nil),
 		Length: length,
 	}
-	copy(block.Hash[:], hashFun.Sum(nil))
-	return block
 }
 
+// HashSplitFunc is called by HashSplitWith for every block. data is only valid during the call
+type HashSplitFunc func(block HashBlock, data []byte) error
+
+// HashSplit splits the content of r in blocks with a content-defined boundary. The average size of a block is
+// 2^splitBits and no block is larger than HashSplitMaxRatio times the average. When hashFun is nil, blocks are
+// hashed with blake2b
 func HashSplit(r io.Reader, splitBits uint, hashFun hash.Hash) (blocks []HashBlock, err error) {
+	err = HashSplitWith(r, splitBits, hashFun, func(block HashBlock, data []byte) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// HashSplitWith is like HashSplit but passes every block and its content to fn instead of collecting them. It
+// stops at the first error returned by fn
+func HashSplitWith(r io.Reader, splitBits uint, hashFun hash.Hash, fn HashSplitFunc) (err error) {
 	var zeroes [windowSize]byte
 
+	if splitBits == 0 || splitBits > HashSplitMaxBits {
+		return ErrInvalidSplitBits
+	}
 	if hashFun == nil {
 		hashFun, err = blake2b.New256(nil)
 		if core.IsErr(err, "cannot create blake2b hash function: %v") {
-			return nil, err
+			return err
 		}
 	}
 
@@ -48,35 +79,34 @@ func HashSplit(r io.Reader, splitBits uint, hashFun hash.Hash) (blocks []HashBlo
 	mask := uint32(0xffffffff)
 	mask = mask >> uint32(32-splitBits)
 
+	maxLen := HashSplitMaxRatio << splitBits
 	buf := make([]byte, 0, mask*2)
 	inp := make([]byte, 1024)
 
 	for {
 		n, err := r.Read(inp)
-		if err == io.EOF {
-			if len(buf) > 0 {
-				blocks = append(blocks, getHashBlock(hashFun, uint32(len(buf)), buf))
-			}
-			break
-		} else if err != nil {
-			return nil, err
-		}
-
-		step := 1
-		for i := 0; i < n; i += step {
-			b := inp[i]
+		for i := 0; i < n; i++ {
 			h.Roll(inp[i])
-			buf = append(buf, b)
+			buf = append(buf, inp[i])
 
-			sum32 := h.Sum32()
-			if sum32&mask == mask {
-				blocks = append(blocks, getHashBlock(hashFun, uint32(len(buf)), buf))
+			if h.Sum32()&mask == mask || len(buf) == maxLen {
+				err := fn(getHashBlock(hashFun, uint32(len(buf)), buf), buf)
+				if err != nil {
+					return err
+				}
 				buf = buf[:0]
 			}
 		}
-	}
 
-	return blocks, err
+		if err == io.EOF {
+			if len(buf) > 0 {
+				return fn(getHashBlock(hashFun, uint32(len(buf)), buf), buf)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
 }
 
 type EditOp int
@@ -150,59 +180,77 @@ func sameBlock(a, b HashBlock) bool {
 	return bytes.Equal(a.Hash[:], b.Hash[:])
 }
 
+// HashDiff returns the edits that transform the content described by source in the content described by dest.
+// Each edit replaces the Slice range of source with the With range of dest; an empty Slice is an insert and an
+// empty With is a delete. Edits are sorted by offset. After a mismatch, the diff resumes at the first block of
+// dest that is found later in source
 func HashDiff(source, dest []HashBlock) []Edit {
+	positions := map[string][]int{}
+	for i, s := range source {
+		k := string(s.Hash)
+		positions[k] = append(positions[k], i)
+	}
+	nextInSource := func(d HashBlock, from int) int {
+		for _, p := range positions[string(d.Hash)] {
+			if p >= from {
+				return p
+			}
+		}
+		return -1
+	}
+
 	var i, j int
 	sLen := len(source)
 	dLen := len(dest)
-	// ln := min(sLen, dLen)
-
-	// for i < ln && bytes.Compare(source[i].Hash[:], dest[i].Hash[:]) == 0 {
-	// 	i++
-	// }
-	// for j < ln && bytes.Compare(source[sLen-j-1].Hash[:], dest[dLen-j-1].Hash[:]) == 0 {
-	// 	j++
-	// }
 
 	var sOffset, dOffset uint32
 	var edits []Edit
 	for i < sLen && j < dLen {
-		s := source[i]
-		d := dest[j]
-		switch {
-		case sameBlock(s, d):
-			i++
-			j++
-			sOffset += s.Length
-			dOffset += d.Length
-		case i+1 < sLen && sameBlock(source[i+1], d):
-			//Delete operation
-			edits = append(edits, Edit{
-				Slice: Range{sOffset, s.Length},
-				With:  Range{dOffset, 0},
-			})
-			j++
-			sOffset += s.Length
-		case j+1 < dLen && sameBlock(s, dest[j+1]):
-			edits = append(edits, Edit{
-				Slice: Range{sOffset, 0},
-				With:  Range{dOffset, d.Length},
-			})
-			i++
-			dOffset += d.Length
-		default:
-			edits = append(edits, Edit{
-				Slice: Range{sOffset, s.Length},
-				With:  Range{dOffset, d.Length},
-			})
+		if sameBlock(source[i], dest[j]) {
+			sOffset += source[i].Length
+			dOffset += dest[j].Length
 			i++
 			j++
-			sOffset += s.Length
-			dOffset += d.Length
+			continue
 		}
+
+		p, k := -1, j
+		for ; k < dLen; k++ {
+			if p = nextInSource(dest[k], i); p != -1 {
+				break
+			}
+		}
+		if p == -1 {
+			break
+		}
+
+		edit := Edit{Slice: Range{sOffset, 0}, With: Range{dOffset, 0}}
+		for ; i < p; i++ {
+			edit.Slice.Length += source[i].Length
+		}
+		for ; j < k; j++ {
+			edit.With.Length += dest[j].Length
+		}
+		sOffset += edit.Slice.Length
+		dOffset += edit.With.Length
+		edits = append(edits, edit)
 	}
 
-	return edits
+	var sTail, dTail uint32
+	for ; i < sLen; i++ {
+		sTail += source[i].Length
+	}
+	for ; j < dLen; j++ {
+		dTail += dest[j].Length
+	}
+	if sTail > 0 || dTail > 0 {
+		edits = append(edits, Edit{
+			Slice: Range{sOffset, sTail},
+			With:  Range{dOffset, dTail},
+		})
+	}
 
+	return edits
 }
 
 const (
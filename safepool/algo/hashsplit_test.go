@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
 )
 
 func Test_Hashsplit(t *testing.T) {
@@ -17,9 +18,9 @@ func Test_Hashsplit(t *testing.T) {
 	assert.Equal(t, len(blocks), 1, "unexpected hashes number")
 
 	hash_str := hex.EncodeToString(blocks[0].Hash[:])
-	assert.Equal(t, "5468697320697320612073696d706c6520737472696e6720746573740e5751c0", hash_str,
+	assert.Equal(t, "a941e1316a2867e3336d33f0190f9904457e486fdfe5c88bf2819546e58819b1", hash_str,
 		"unexpected hash value")
-	assert.Equal(t, uint32(0), blocks[0].Length)
+	assert.Equal(t, uint32(len(s)), blocks[0].Length)
 
 	rn := make([]byte, 40000)
 	rand.Seed(1975)
@@ -36,9 +37,27 @@ func Test_Hashsplit(t *testing.T) {
 	assert.NoErrorf(t, err, "Cannot split hash: %v", err)
 	for idx, block := range blocks2 {
 		fmt.Printf("Block [%d] %d\n", idx, block.Length)
+		assert.LessOrEqual(t, block.Length, uint32(HashSplitMaxRatio<<8))
 	}
-	assert.Equal(t, 18, len(blocks2), "unexpected hashes number")
+	assert.Equal(t, 150, len(blocks2), "unexpected hashes number")
 
+	var joined []byte
+	err = HashSplitWith(bytes.NewBuffer(rn), 8, nil, func(block HashBlock, data []byte) error {
+		assert.Equal(t, blake2b.Sum256(data), *(*[32]byte)(block.Hash))
+		joined = append(joined, data...)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rn, joined, "blocks must cover the whole content")
+
+	blocks, err = HashSplit(bytes.NewReader(bytes.Repeat([]byte{1}, 10000)), 8, nil)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 10, "content without boundaries is split at the maximum size")
+	for _, block := range blocks[0:9] {
+		assert.Equal(t, uint32(HashSplitMaxRatio<<8), block.Length)
+	}
+	_, err = HashSplit(bytes.NewReader(rn), 32, nil)
+	assert.ErrorIs(t, err, ErrInvalidSplitBits)
 }
 
 func Test_HashDiff(t *testing.T) {
@@ -55,11 +74,15 @@ func Test_HashDiff(t *testing.T) {
 		Length: 8,
 	}
 
-	//	diffs := HashDiff([]HashBlock{a}, []HashBlock{b})
-	// assert.Len(t, diffs, 1)
-	// assert.Equal(t, Diff{0, 0, 4, 0, 8}, diffs[0])
+	diffs := HashDiff([]HashBlock{a}, []HashBlock{b})
+	assert.Equal(t, []Edit{{Slice: Range{0, 4}, With: Range{0, 8}}}, diffs)
+
+	diffs = HashDiff([]HashBlock{a, b, c}, []HashBlock{a, c})
+	assert.Equal(t, []Edit{{Slice: Range{4, 8}, With: Range{4, 0}}}, diffs)
+
+	diffs = HashDiff([]HashBlock{a, c}, []HashBlock{a, b, c})
+	assert.Equal(t, []Edit{{Slice: Range{4, 0}, With: Range{4, 8}}}, diffs)
 
-	diffs := HashDiff([]HashBlock{a, b, c}, []HashBlock{a, c})
-	//assert.Len(t, diffs, 1)
-	print(diffs)
+	diffs = HashDiff([]HashBlock{a, b}, []HashBlock{a, b, c})
+	assert.Equal(t, []Edit{{Slice: Range{12, 0}, With: Range{12, 8}}}, diffs)
 }
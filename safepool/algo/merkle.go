@@ -1,16 +1,33 @@
 package algo
 
 import (
+	"bytes"
+	"encoding/binary"
 	"hash"
 	"io"
 	"os"
+
+	"golang.org/x/crypto/blake2b"
 )
 
+// MerkleTree is a hash tree over the blocks of some data. Blocks contains all the rows of the tree, starting
+// from the leaves and ending with the root. Only leaves have a Length. A leaf is the hash of its data computed
+// with MerkleLeaf
 type MerkleTree struct {
-	DataLength uint32
+	DataLength uint64
+	Leaves     int
 	Blocks     []HashBlock
 }
 
+// MerkleProof is the list of sibling hashes from a leaf to the root. Leaves and Length are bound to the hash
+// of the tree, see MerkleTreeHash
+type MerkleProof struct {
+	Leaf     int
+	Leaves   int
+	Length   uint64
+	Siblings [][]byte
+}
+
 var UseSimd bool
 
 func MerkleTreeFromFile(name string, splitBits uint) (MerkleTree, error) {
@@ -24,57 +41,181 @@ func MerkleTreeFromFile(name string, splitBits uint) (MerkleTree, error) {
 }
 
 func MerkleTreeFromReader(r io.Reader, splitBits uint) (MerkleTree, error) {
-	blocks, err := HashSplit(r, splitBits, nil)
+	var leaves []HashBlock
+	err := HashSplitWith(r, splitBits, nil, func(block HashBlock, data []byte) error {
+		leaves = append(leaves, MerkleLeaf(data))
+		return nil
+	})
 	if err != nil {
 		return MerkleTree{}, err
 	}
+	return MerkleTreeFromBlocks(leaves), nil
+}
 
-	start := 0
-	for start < len(blocks)-1 {
-		//		blocks, start = buildMerkleRow(blake, length, blocks, start)
+// MerkleLeaf returns the leaf for a block of data. The data is hashed with the prefix 0, while inner nodes use
+// the prefix 1, so that an inner node can never be taken for a leaf
+func MerkleLeaf(data []byte) HashBlock {
+	blake, _ := blake2b.New256(nil)
+	return getHashBlock(blake, uint32(len(data)), []byte{0}, data)
+}
+
+// MerkleTreeFromBlocks builds the tree over the provided leaves created with MerkleLeaf
+func MerkleTreeFromBlocks(leaves []HashBlock) MerkleTree {
+	blake, _ := blake2b.New256(nil)
+
+	m := MerkleTree{
+		Leaves: len(leaves),
+		Blocks: append([]HashBlock{}, leaves...),
+	}
+	for _, b := range leaves {
+		m.DataLength += uint64(b.Length)
+	}
+	if len(leaves) == 0 {
+		m.Blocks = []HashBlock{getHashBlock(blake, 0)}
+		return m
 	}
 
-	return MerkleTree{
-		Blocks: blocks,
-	}, nil
+	start := 0
+	for len(m.Blocks)-start > 1 {
+		m.Blocks, start = buildMerkleRow(blake, m.Blocks, start)
+	}
+	return m
 }
 
-// buildMerkleRow calculates a new row of a Merkle tree starting from start position until the end of the
-func buildMerkleRow(blake hash.Hash, fileLength uint32, blocks []HashBlock, start int) (blocks2 []HashBlock, start2 int) {
+// buildMerkleRow appends to blocks the parents of the row that starts at start and ends with blocks. It returns
+// the new blocks and the start of the new row. The last node of an odd row is moved up unchanged
+func buildMerkleRow(blake hash.Hash, blocks []HashBlock, start int) (blocks2 []HashBlock, start2 int) {
 	l := len(blocks)
-	if l%2 == 1 {
-		blocks = append(blocks, getHashBlock(blake, fileLength))
-		l++
-	}
-
 	for i := start; i < l; i += 2 {
-		block := getHashBlock(blake, blocks[i].Length, blocks[i].Hash[:], blocks[i+1].Hash[:])
-		blocks = append(blocks, block)
+		if i+1 == l {
+			blocks = append(blocks, HashBlock{Hash: blocks[i].Hash})
+		} else {
+			blocks = append(blocks, merkleParent(blake, blocks[i].Hash, blocks[i+1].Hash))
+		}
 	}
 	return blocks, l
 }
 
+// merkleParent hashes two children with the prefix 1. Leaves use the prefix 0, see MerkleLeaf
+func merkleParent(blake hash.Hash, left, right []byte) HashBlock {
+	return getHashBlock(blake, 0, []byte{1}, left, right)
+}
+
+// merkleRows returns the start of each row in the blocks of a tree with the provided number of leaves
+func merkleRows(leaves int) []int {
+	rows := []int{0}
+	start, size := 0, leaves
+	for size > 1 {
+		start += size
+		size = (size + 1) / 2
+		rows = append(rows, start)
+	}
+	return rows
+}
+
+// MerkleTreeSize returns the number of blocks in a tree with the provided number of leaves
+func MerkleTreeSize(leaves int) int {
+	if leaves == 0 {
+		return 1
+	}
+	rows := merkleRows(leaves)
+	return rows[len(rows)-1] + 1
+}
+
 func MerkleTreeRoot(m MerkleTree) (HashBlock, int) {
 	l := len(m.Blocks) - 1
 	return m.Blocks[l], l
 }
 
+// MerkleTreeHash returns the hash to sign for the tree. It binds the root to the number of leaves and to the
+// length of the data, so that a tree cannot be replaced by a subtree or extended
 func MerkleTreeHash(m MerkleTree) *[]byte {
-	l := len(m.Blocks) - 1
-	return &m.Blocks[l].Hash
+	blake, _ := blake2b.New256(nil)
+	root, _ := MerkleTreeRoot(m)
+	h := merkleTreeHash(blake, root.Hash, m.Leaves, m.DataLength)
+	return &h
 }
 
-func MerkleTreeAt(m MerkleTree, idx int) (block HashBlock, length uint32) {
-	block = m.Blocks[idx]
-	if idx+1 == len(m.Blocks) || m.Blocks[idx+1].Length <= m.Blocks[idx].Length {
-		return block, m.DataLength - block.Length
-	} else {
-		return block, m.Blocks[idx+1].Length - block.Length
+func merkleTreeHash(blake hash.Hash, root []byte, leaves int, length uint64) []byte {
+	var sizes [16]byte
+	binary.BigEndian.PutUint64(sizes[0:8], uint64(leaves))
+	binary.BigEndian.PutUint64(sizes[8:16], length)
+	return getHashBlock(blake, 0, []byte{2}, sizes[:], root).Hash
+}
+
+// MerkleTreeAt returns the leaf idx and its offset in the data
+func MerkleTreeAt(m MerkleTree, idx int) (block HashBlock, offset uint64) {
+	for i := 0; i < idx; i++ {
+		offset += uint64(m.Blocks[i].Length)
 	}
+	return m.Blocks[idx], offset
 }
 
+// MerkleTreeChildren returns the position in Blocks of the children of the node idx. Both are -1 for a leaf;
+// right is -1 for a node moved up from an odd row
 func MerkleTreeChildren(m MerkleTree, idx int) (left int, right int) {
-	return 0, 0
+	rows := merkleRows(m.Leaves)
+	for r := 1; r < len(rows); r++ {
+		end := len(m.Blocks)
+		if r+1 < len(rows) {
+			end = rows[r+1]
+		}
+		if idx < rows[r] || idx >= end {
+			continue
+		}
+
+		left = rows[r-1] + 2*(idx-rows[r])
+		right = left + 1
+		if right >= rows[r] {
+			right = -1
+		}
+		return left, right
+	}
+	return -1, -1
+}
+
+// MerkleTreeProof returns the proof that the leaf idx belongs to the tree
+func MerkleTreeProof(m MerkleTree, leaf int) MerkleProof {
+	p := MerkleProof{Leaf: leaf, Leaves: m.Leaves, Length: m.DataLength}
+	rows := merkleRows(m.Leaves)
+
+	pos, size := leaf, m.Leaves
+	for r := 0; size > 1; r++ {
+		sibling := pos ^ 1
+		if sibling < size {
+			p.Siblings = append(p.Siblings, m.Blocks[rows[r]+sibling].Hash)
+		}
+		pos, size = pos/2, (size+1)/2
+	}
+	return p
+}
+
+// VerifyMerkleProof returns true when a leaf with the provided hash is part of the tree whose MerkleTreeHash is
+// root
+func VerifyMerkleProof(root []byte, leafHash []byte, proof MerkleProof) bool {
+	if proof.Leaf < 0 || proof.Leaf >= proof.Leaves {
+		return false
+	}
+	blake, _ := blake2b.New256(nil)
+
+	h, siblings := leafHash, proof.Siblings
+	pos, size := proof.Leaf, proof.Leaves
+	for size > 1 {
+		sibling := pos ^ 1
+		if sibling < size {
+			if len(siblings) == 0 {
+				return false
+			}
+			if pos%2 == 0 {
+				h = merkleParent(blake, h, siblings[0]).Hash
+			} else {
+				h = merkleParent(blake, siblings[0], h).Hash
+			}
+			siblings = siblings[1:]
+		}
+		pos, size = pos/2, (size+1)/2
+	}
+	return len(siblings) == 0 && bytes.Equal(merkleTreeHash(blake, h, proof.Leaves, proof.Length), root)
 }
 
 func min(a, b int) int {
@@ -17,17 +17,66 @@ func Test_MerkleTree(t *testing.T) {
 	rn[0] = 16
 	m1, err := MerkleTreeFromReader(bytes.NewBuffer(rn), 13)
 	assert.NoErrorf(t, err, "Cannot create tree: %v", err)
-	assert.Equal(t, uint32(len(rn)), m1.DataLength, "unexpected length")
+	assert.Equal(t, uint64(len(rn)), m1.DataLength, "unexpected length")
 
 	rn[0] = 8
 	m2, err := MerkleTreeFromReader(bytes.NewBuffer(rn), 13)
 	assert.NoErrorf(t, err, "Cannot create tree: %v", err)
-	assert.Equal(t, uint32(len(rn)), m2.DataLength, "unexpected length")
+	assert.Equal(t, uint64(len(rn)), m2.DataLength, "unexpected length")
 
 	assert.NotEqualValues(t, m1.Blocks[0].Hash, m2.Blocks[0].Hash, "Unexpected same hash for first block")
 	assert.EqualValues(t, m1.Blocks[1].Hash, m2.Blocks[1].Hash, "Unexpected different hash for second block")
 	assert.NotEqualValues(t, MerkleTreeHash(m1), MerkleTreeHash(m2), "Unexpected same hash")
 
+	root, idx := MerkleTreeRoot(m1)
+	assert.Equal(t, len(m1.Blocks)-1, idx)
+	assert.False(t, VerifyMerkleProof(root.Hash, m1.Blocks[0].Hash, MerkleTreeProof(m1, 0)),
+		"the signed hash binds the root to the size of the tree")
+	rootHash := *MerkleTreeHash(m1)
+	for leaf := 0; leaf < m1.Leaves; leaf++ {
+		block, _ := MerkleTreeAt(m1, leaf)
+		proof := MerkleTreeProof(m1, leaf)
+		assert.Truef(t, VerifyMerkleProof(rootHash, block.Hash, proof), "invalid proof for leaf %d", leaf)
+		assert.False(t, VerifyMerkleProof(*MerkleTreeHash(m2), block.Hash, proof))
+	}
+	block, offset := MerkleTreeAt(m1, 1)
+	assert.Equal(t, uint64(m1.Blocks[0].Length), offset)
+	assert.False(t, VerifyMerkleProof(rootHash, block.Hash, MerkleTreeProof(m1, 0)))
+	proof := MerkleTreeProof(m1, 0)
+	proof.Length++
+	assert.False(t, VerifyMerkleProof(rootHash, m1.Blocks[0].Hash, proof), "the length is part of the hash")
+
+	// an inner node presented as a leaf of a smaller tree
+	inner := MerkleTreeFromBlocks(m1.Blocks[m1.Leaves : m1.Leaves+2])
+	assert.NotEqual(t, *MerkleTreeHash(inner), rootHash)
+
+	left, right := MerkleTreeChildren(m1, idx)
+	assert.Equal(t, len(m1.Blocks)-3, left)
+	assert.Equal(t, len(m1.Blocks)-2, right)
+	l, _ := MerkleTreeChildren(m1, 0)
+	assert.Equal(t, -1, l, "a leaf has no children")
+}
+
+func Test_MerkleTreeOdd(t *testing.T) {
+	for n := 1; n < 12; n++ {
+		var leaves []HashBlock
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, MerkleLeaf(bytes.Repeat([]byte{byte(i)}, 10)))
+		}
+		m := MerkleTreeFromBlocks(leaves)
+		assert.Equal(t, uint64(10*n), m.DataLength)
+		assert.Equal(t, len(m.Blocks), MerkleTreeSize(n))
+
+		_, idx := MerkleTreeRoot(m)
+		for leaf := 0; leaf < n; leaf++ {
+			assert.Truef(t, VerifyMerkleProof(*MerkleTreeHash(m), leaves[leaf].Hash, MerkleTreeProof(m, leaf)),
+				"invalid proof for leaf %d of %d", leaf, n)
+		}
+		if n > 1 {
+			left, _ := MerkleTreeChildren(m, idx)
+			assert.Less(t, left, idx)
+		}
+	}
 }
 
 func Benchmark_Merkle(b *testing.B) {
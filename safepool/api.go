@@ -2,7 +2,7 @@ package api
 
 import (
 	_ "embed"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"math/rand"
 	"time"
@@ -13,7 +13,6 @@ import (
 	"github.com/code-to-go/safe/safepool/security"
 	"github.com/code-to-go/safe/safepool/sql"
 	"github.com/patrickmn/go-cache"
-	"gopkg.in/yaml.v3"
 )
 
 var Apps = []string{
@@ -21,6 +20,8 @@ var Apps = []string{
 	"library",
 }
 
+var ErrNotFresh = errors.New("the identity can be replaced only when no pool is defined")
+
 var pools *cache.Cache
 var Self security.Identity
 
@@ -52,33 +53,83 @@ func Start(dbPath string) error {
 		r := rand.New(rand.NewSource(time.Now().UnixNano()))
 		name := fmt.Sprintf("%s%d", names[r.Intn(len(names))], r.Intn(100))
 		Self, err = security.NewIdentity(name)
-		if err == nil {
-			s, err = Self.Base64()
-			if err == nil {
-				err = sqlSetConfig("", "SELF", s, 0, nil)
-			}
-			if core.IsErr(err, "çannot save identity to db: %v") {
-				panic("cannot save identity in db")
-			}
-
-			err = security.SetIdentity(Self)
-			if core.IsErr(err, "çannot save identity to db: %v") {
-				panic("cannot save identity in db")
-			}
-
-			err = security.Trust(Self, true)
-			if core.IsErr(err, "çannot set trust of '%s' on db: %v", Self.Nick) {
-				panic("cannot trust Self in db")
-			}
-
+		if err == nil && saveSelf(Self) != nil {
+			panic("cannot save identity in db")
 		}
-
 	}
 
 	pools = cache.New(time.Hour, time.Hour)
+	pools.OnEvicted(func(name string, v any) {
+		v.(*pool.Pool).Close()
+	})
 	return err
 }
 
+// saveSelf stores i as the identity of the user
+func saveSelf(i security.Identity) error {
+	s, err := i.Base64()
+	if err == nil {
+		err = sqlSetConfig("", "SELF", s, 0, nil)
+	}
+	if core.IsErr(err, "çannot save identity to db: %v") {
+		return err
+	}
+
+	err = security.SetIdentity(i)
+	if core.IsErr(err, "çannot save identity to db: %v") {
+		return err
+	}
+
+	err = security.Trust(i, true)
+	if core.IsErr(err, "çannot set trust of '%s' on db: %v", i.Nick) {
+		return err
+	}
+	return nil
+}
+
+// ExportSelf returns the identity of the user encrypted with the passphrase, so that it can be moved to another
+// device or kept as a backup
+func ExportSelf(passphrase string) ([]byte, error) {
+	return security.ExportIdentity(Self, passphrase)
+}
+
+// PaperKey returns the private keys of the user in a form that can be written on paper
+func PaperKey() (string, error) {
+	return security.PaperKey(Self)
+}
+
+// ImportSelf replaces the identity of the user with the output of ExportSelf. It is allowed only on a DB without
+// pools, since the pools are bound to the previous identity
+func ImportSelf(data []byte, passphrase string) error {
+	i, err := security.ImportIdentity(data, passphrase)
+	if core.IsErr(err, "cannot import identity: %v") {
+		return err
+	}
+	return restoreSelf(i)
+}
+
+// RestoreSelf replaces the identity of the user with the one of the paper key. Like ImportSelf, it is allowed only
+// on a DB without pools
+func RestoreSelf(paper string, nick string) error {
+	i, err := security.IdentityFromPaperKey(paper, nick)
+	if core.IsErr(err, "cannot restore identity: %v") {
+		return err
+	}
+	return restoreSelf(i)
+}
+
+func restoreSelf(i security.Identity) error {
+	if len(pool.List()) > 0 {
+		return ErrNotFresh
+	}
+	err := saveSelf(i)
+	if err != nil {
+		return err
+	}
+	Self = i
+	return nil
+}
+
 func SetNick(nick string) error {
 	Self.Nick = nick
 	s, err := Self.Base64()
@@ -104,35 +155,188 @@ func CreatePool(c pool.Config, apps []string) error {
 	return nil
 }
 
+// AddPool joins the pool of a token. The signature proves only that the token was issued by its host: the host
+// is checked against the admins of the pool when the access file can be read. Once the pool is open, a token for
+// a specific guest is recorded in the pool, where anyone with the credentials of the exchangers could remove it,
+// and on this device, so that it is not used again. A universal token can be used by several guests until it
+// expires: when the guest is not a member yet, a join request is sent to the admins
 func AddPool(token string) (pool.Config, error) {
-	var c pool.Config
-	bs, err := base64.StdEncoding.DecodeString(token)
-	if core.IsErr(err, "cannot decousterde token: %v") {
-		return c, err
-	}
-	err = yaml.Unmarshal(bs, &c)
-	if core.IsErr(err, "cannot unmarshal config from token: %v") {
-		return c, err
-	}
-
-	if c.Name == "" || (len(c.Public)+len(c.Private)) == 0 {
-		core.IsErr(pool.ErrInvalidToken, "invalid config '%s': %v", string(bs))
-		return c, pool.ErrInvalidToken
-	} else {
-		core.Info("valid token for pool '%s'", c.Name)
+	t, err := pool.DecodeToken(Self, token)
+	if core.IsErr(err, "invalid token: %v") {
+		return pool.Config{}, err
 	}
+	c := t.Config
+	core.Info("valid token for pool '%s'", c.Name)
 
 	err = pool.Define(c)
 	if core.IsErr(err, "cannot define pool '%s': %v", c.Name) {
 		return c, err
 	}
+	err = pool.AcceptToken(Self, t)
+	if core.IsErr(err, "cannot accept token for pool '%s': %v", c.Name) {
+		return c, err
+	}
 	p, err := pool.Open(Self, c.Name)
+	if err == pool.ErrNotAuthorized {
+		p.Close()
+		err = pool.RequestJoin(Self, t)
+		if err == nil {
+			core.Info("join request sent to pool '%s'", c.Name)
+			return c, nil
+		}
+	}
 	if core.IsErr(err, "cannot open pool '%s': %v", c.Name) {
 		return c, err
 	}
 	p.Close()
 
-	return c, nil
+	err = pool.UseToken(Self, t)
+	core.IsErr(err, "cannot use token for pool '%s': %v", c.Name)
+	return c, err
+}
+
+// RotateIdentity replaces the keys of the user with new ones. The current identity signs a succession record that
+// is published in each pool, where admins move the access to the new identity. Content sent with the previous
+// keys is still attributed to the user
+func RotateIdentity() error {
+	next, err := security.NewIdentity(Self.Nick)
+	if core.IsErr(err, "cannot create identity: %v") {
+		return err
+	}
+	next.Email = Self.Email
+	s, err := security.NewSuccession(Self, next)
+	if core.IsErr(err, "cannot create succession: %v") {
+		return err
+	}
+	err = security.SetSuccession(s)
+	if core.IsErr(err, "cannot save succession to db: %v") {
+		return err
+	}
+
+	for _, item := range pools.Items() {
+		item.Object.(*pool.Pool).Close()
+	}
+	pools.Flush()
+	for _, name := range pool.List() {
+		p, err := pool.Open(Self, name)
+		if core.IsErr(err, "cannot publish succession to pool '%s': %v", name) {
+			continue
+		}
+		p.Close()
+	}
+
+	err = saveSelf(next)
+	if err != nil {
+		return err
+	}
+	Self = next
+	return nil
+}
+
+// DelegateDevice returns a certificate that lets the device deviceId act on behalf of the user. The certificate
+// must be linked on the device with LinkDevice, which countersigns and publishes it in the pools
+func DelegateDevice(deviceId string, device string) (string, error) {
+	d, err := security.NewDelegation(Self, deviceId, device)
+	if core.IsErr(err, "cannot delegate device '%s': %v", deviceId) {
+		return "", err
+	}
+	return d.Base64()
+}
+
+// LinkDevice makes this device act on behalf of the user that created the certificate with DelegateDevice
+func LinkDevice(certificate string) error {
+	d, err := security.DelegationFromBase64(certificate)
+	if err != nil {
+		return err
+	}
+	d, err = security.CountersignDelegation(Self, d)
+	if core.IsErr(err, "cannot countersign delegation of user '%s': %v", d.UserId) {
+		return err
+	}
+	err = security.SetDelegation(d)
+	core.IsErr(err, "cannot link device to user '%s': %v", d.UserId)
+	return err
+}
+
+// RevokeDevice excludes the device deviceId from acting on behalf of the user. The revocation reaches each pool
+// on the next sync
+func RevokeDevice(deviceId string) error {
+	d, err := security.RevokeDelegation(Self, deviceId)
+	if core.IsErr(err, "cannot revoke device '%s': %v", deviceId) {
+		return err
+	}
+	return security.SetDelegation(d)
+}
+
+// Devices returns the devices delegated by the user, including the revoked ones
+func Devices() ([]security.Delegation, error) {
+	return security.Delegations(Self.Id())
+}
+
+// Endorse vouches for the identity id in the pools shared with it, or withdraws the endorsement when endorse is
+// false
+func Endorse(id string, endorse bool) error {
+	err := security.Endorse(Self, id, endorse)
+	core.IsErr(err, "cannot endorse identity '%s': %v", id)
+	return err
+}
+
+// TrustLevel returns the trust level of the identity id, which is 0 when the identity is not trusted
+func TrustLevel(id string) int {
+	return security.TrustLevel(id)
+}
+
+func SetTrustPolicy(p security.TrustPolicy) error {
+	return security.SetTrustPolicy(p)
+}
+
+func knownIdentity(id string) (security.Identity, error) {
+	i, ok, err := security.GetIdentity(id)
+	if err == nil && !ok {
+		err = sql.ErrNoRows
+	}
+	core.IsErr(err, "cannot find identity '%s': %v", id)
+	return i, err
+}
+
+// SafetyNumber returns the safety number of the user and the identity id, which both should read the same
+func SafetyNumber(id string) (security.SafetyNumber, error) {
+	i, err := knownIdentity(id)
+	if err != nil {
+		return security.SafetyNumber{}, err
+	}
+	return security.Fingerprint(Self, i), nil
+}
+
+// VerificationCode returns the text, usually shown as a QR code, that the identity id scans to verify the user
+func VerificationCode(id string) (string, error) {
+	i, err := knownIdentity(id)
+	if err != nil {
+		return "", err
+	}
+	return security.VerificationCode(Self, i), nil
+}
+
+// VerifyIdentity marks the identity id as verified when code, scanned from its device, matches the known keys
+func VerifyIdentity(id string, code string) error {
+	i, err := knownIdentity(id)
+	if err != nil {
+		return err
+	}
+	if !security.CheckVerificationCode(Self, i, code) {
+		return security.ErrInvalidVerificationCode
+	}
+	return security.SetVerified(id, true)
+}
+
+// SetVerified marks the identity id as verified after the safety numbers have been compared by the users
+func SetVerified(id string, verified bool) error {
+	return security.SetVerified(id, verified)
+}
+
+// KeyChanges returns the verified identities whose keys changed since they were verified
+func KeyChanges() ([]security.KeyChange, error) {
+	return security.KeyChanges()
 }
 
 func GetPool(name string) (*pool.Pool, error) {
@@ -5,6 +5,7 @@ import (
 	"path"
 	"strings"
 
+	"github.com/code-to-go/safe/safepool/algo"
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/sql"
 )
@@ -191,3 +192,63 @@ func sqlGetFilesHashes(pool string, base string, name string, limit int) ([][]by
 	}
 	return hashes, nil
 }
+
+func sqlGetBlocks(pool, base, name string, hash []byte) ([]algo.HashBlock, bool, error) {
+	var data []byte
+	err := sql.QueryRow("GET_LIBRARY_BLOCKS", sql.Args{"pool": pool, "base": base, "name": name,
+		"hash": sql.EncodeBase64(hash)}, &data)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if core.IsErr(err, "cannot get blocks for %s on db: %v", name) {
+		return nil, false, err
+	}
+
+	var blocks []algo.HashBlock
+	err = json.Unmarshal(data, &blocks)
+	if core.IsErr(err, "corrupted blocks for %s on db: %v", name) {
+		return nil, false, err
+	}
+	return blocks, true, nil
+}
+
+func sqlSetBlocks(pool, base, name string, hash []byte, blocks []algo.HashBlock) error {
+	data, err := json.Marshal(blocks)
+	if core.IsErr(err, "cannot serialize blocks: %v") {
+		return err
+	}
+
+	_, err = sql.Exec("SET_LIBRARY_BLOCKS", sql.Args{"pool": pool, "base": base, "name": name,
+		"hash": sql.EncodeBase64(hash), "blocks": data})
+	core.IsErr(err, "cannot set blocks for %s on db: %v", name)
+	return err
+}
+
+func sqlGetDelta(pool, base string, id uint64) (deltaInfo, bool, error) {
+	var data []byte
+	err := sql.QueryRow("GET_LIBRARY_DELTA", sql.Args{"pool": pool, "base": base, "id": id}, &data)
+	if err == sql.ErrNoRows {
+		return deltaInfo{}, false, nil
+	}
+	if core.IsErr(err, "cannot get delta for %d on db: %v", id) {
+		return deltaInfo{}, false, err
+	}
+
+	var d deltaInfo
+	err = json.Unmarshal(data, &d)
+	if core.IsErr(err, "corrupted delta for %d on db: %v", id) {
+		return deltaInfo{}, false, err
+	}
+	return d, true, nil
+}
+
+func sqlSetDelta(pool, base string, id uint64, d deltaInfo) error {
+	data, err := json.Marshal(d)
+	if core.IsErr(err, "cannot serialize delta: %v") {
+		return err
+	}
+
+	_, err = sql.Exec("SET_LIBRARY_DELTA", sql.Args{"pool": pool, "base": base, "id": id, "delta": data})
+	core.IsErr(err, "cannot set delta for %d on db: %v", id)
+	return err
+}
@@ -0,0 +1,115 @@
+package library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+
+	"github.com/code-to-go/safe/safepool/algo"
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+var ErrInvalidDelta = errors.New("delta does not match its base version")
+
+// DeltaSplitBits sets the average size of the blocks compared when a document is sent as a delta
+var DeltaSplitBits uint = 13
+
+// DeltaMaxRatio is the largest size of a delta compared to the full document. Larger changes are sent in full
+var DeltaMaxRatio = 0.5
+
+// DeltaMaxDepth is the longest chain of deltas before a document is sent in full again, so that a node without
+// the local base does not need to download too many versions
+var DeltaMaxDepth = 8
+
+// DeltaBaseShare is the share of pool.LifeSpan during which changes to a full version are sent as deltas. Later
+// changes are sent in full, so that the last delta of a chain can be rebuilt from the pool for the rest of the
+// LifeSpan, before housekeeping removes the full version
+var DeltaBaseShare = 0.5
+
+// deltaInfo is stored in the feed meta when the content is a delta against a previous version of the document
+type deltaInfo struct {
+	BaseId   uint64 `json:"baseId"`
+	BaseHash []byte `json:"baseHash"`
+	Hash     []byte `json:"hash"`
+	Size     uint64 `json:"size"`
+	Depth    int    `json:"depth"`
+}
+
+func fileBlocks(name string) ([]algo.HashBlock, error) {
+	f, err := os.Open(name)
+	if core.IsErr(err, "cannot open '%s': %v", name) {
+		return nil, err
+	}
+	defer f.Close()
+
+	return algo.HashSplit(f, DeltaSplitBits, nil)
+}
+
+// deltaSize returns the amount of new data in the edits
+func deltaSize(edits []algo.Edit) uint64 {
+	var size uint64
+	for _, e := range edits {
+		size += uint64(e.With.Length)
+	}
+	return size
+}
+
+// deltaReader encodes the edits followed by the new data taken from r. For each edit the header holds the start
+// and length of the replaced range in the base and the length of the new data
+func deltaReader(edits []algo.Edit, r io.ReaderAt) io.Reader {
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint32(len(edits)))
+	for _, e := range edits {
+		binary.Write(&header, binary.BigEndian, []uint32{e.Slice.Start, e.Slice.Length, e.With.Length})
+	}
+
+	readers := []io.Reader{&header}
+	for _, e := range edits {
+		if e.With.Length > 0 {
+			readers = append(readers, io.NewSectionReader(r, int64(e.With.Start), int64(e.With.Length)))
+		}
+	}
+	return io.MultiReader(readers...)
+}
+
+// applyDelta writes to w the content of base modified by the delta encoded with deltaReader. The edits are read
+// one at a time, so that a forged count cannot allocate more memory than the delta holds
+func applyDelta(base io.ReaderAt, delta io.Reader, w io.Writer) error {
+	var count uint32
+	err := binary.Read(delta, binary.BigEndian, &count)
+	if core.IsErr(err, "cannot read delta header: %v") {
+		return err
+	}
+	var edits []algo.Edit
+	for i := uint32(0); i < count; i++ {
+		var e [3]uint32
+		err = binary.Read(delta, binary.BigEndian, &e)
+		if core.IsErr(err, "cannot read delta header: %v") {
+			return err
+		}
+		edits = append(edits, algo.Edit{Slice: algo.Range{Start: e[0], Length: e[1]}, With: algo.Range{Length: e[2]}})
+	}
+
+	var pos int64
+	for _, e := range edits {
+		start := int64(e.Slice.Start)
+		if start < pos {
+			return ErrInvalidDelta
+		}
+		_, err = io.Copy(w, io.NewSectionReader(base, pos, start-pos))
+		if core.IsErr(err, "cannot copy from delta base: %v") {
+			return err
+		}
+		_, err = io.CopyN(w, delta, int64(e.With.Length))
+		if core.IsErr(err, "cannot copy from delta: %v") {
+			return err
+		}
+		pos = start + int64(e.Slice.Length)
+	}
+	_, err = io.Copy(w, io.NewSectionReader(base, pos, math.MaxInt64-pos))
+	core.IsErr(err, "cannot copy from delta base: %v")
+	return err
+}
@@ -0,0 +1,115 @@
+package library
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/code-to-go/safe/safepool/algo"
+	"github.com/code-to-go/safe/safepool/pool"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+// content returns random data large enough that the changes of modify span a small share of its blocks
+func content() []byte {
+	data := make([]byte, 500000)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func modify(data []byte) []byte {
+	data2 := append([]byte{}, data[0:20000]...)
+	data2 = append(data2, "some text inserted in the middle"...)
+	data2 = append(data2, data[20000:50000]...)
+	return append(data2, data[60000:]...)
+}
+
+func TestApplyDelta(t *testing.T) {
+	data := content()
+	data2 := modify(data)
+
+	b1, err := algo.HashSplit(bytes.NewReader(data), DeltaSplitBits, nil)
+	assert.NoError(t, err)
+	b2, err := algo.HashSplit(bytes.NewReader(data2), DeltaSplitBits, nil)
+	assert.NoError(t, err)
+
+	edits := algo.HashDiff(b1, b2)
+	assert.Less(t, deltaSize(edits), uint64(len(data2)/2))
+
+	var out bytes.Buffer
+	err = applyDelta(bytes.NewReader(data), deltaReader(edits, bytes.NewReader(data2)), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, data2, out.Bytes())
+
+	forged := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1}
+	err = applyDelta(bytes.NewReader(data), bytes.NewReader(forged), &out)
+	assert.Error(t, err, "a count larger than the delta is refused")
+}
+
+func TestDeltaSend(t *testing.T) {
+	dir := t.TempDir()
+	sql.LoadSQLFromFile("../../sqlite.sql")
+	err := sql.OpenDB(filepath.Join(dir, "safepool.test.db"))
+	assert.NoErrorf(t, err, "cannot open db")
+	defer sql.CloseDB()
+
+	self, err := security.NewIdentity("test")
+	assert.NoError(t, err)
+	c := pool.Config{
+		Name:   "test.safepool.net/library",
+		Public: []string{"file://" + filepath.Join(dir, "pool")},
+	}
+	assert.NoError(t, pool.Define(c))
+	pool.ForceCreation = true
+	p, err := pool.Create(self, c.Name, nil)
+	assert.NoErrorf(t, err, "cannot create pool: %v", err)
+	defer p.Close()
+	l := Get(p, "library")
+
+	data := content()
+	local := filepath.Join(dir, "doc.bin")
+	assert.NoError(t, os.WriteFile(local, data, 0644))
+	f1, err := l.Send(local, "doc.bin", false)
+	assert.NoError(t, err)
+
+	data2 := modify(data)
+	assert.NoError(t, os.WriteFile(local, data2, 0644))
+	f2, err := l.Send(local, "doc.bin", false)
+	assert.NoError(t, err)
+	assert.Less(t, f2.Size, f1.Size/2, "the second version must be sent as a delta")
+
+	_, err = l.List("")
+	assert.NoError(t, err)
+
+	dest := filepath.Join(dir, "received.bin")
+	_, err = l.Receive(f2.Id, dest)
+	assert.NoError(t, err)
+	received, _ := os.ReadFile(dest)
+	assert.Equal(t, data2, received)
+
+	assert.NoError(t, os.Remove(local))
+	assert.NoError(t, l.Save(f2.Id, local))
+	received, _ = os.ReadFile(local)
+	assert.Equal(t, data2, received, "the base must be downloaded when the local copy is missing")
+
+	share := DeltaBaseShare
+	DeltaBaseShare = 0
+	data3 := modify(data2)
+	assert.NoError(t, os.WriteFile(local, data3, 0644))
+	f3, err := l.Send(local, "doc.bin", false)
+	DeltaBaseShare = share
+	assert.NoError(t, err)
+	assert.Greater(t, f3.Size, f1.Size/2, "a full version older than DeltaBaseShare cannot be a base")
+
+	maxDepth := DeltaMaxDepth
+	DeltaMaxDepth = 0
+	err = l.receive(f2.Id, "doc.bin", dest, 0)
+	DeltaMaxDepth = maxDepth
+	assert.ErrorIs(t, err, ErrInvalidDelta, "chains longer than DeltaMaxDepth are refused")
+}
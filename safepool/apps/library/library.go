@@ -3,6 +3,7 @@ package library
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -10,9 +11,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/code-to-go/safe/safepool/algo"
 	"github.com/code-to-go/safe/safepool/core"
 	pool "github.com/code-to-go/safe/safepool/pool"
 	"github.com/code-to-go/safe/safepool/security"
+	"github.com/godruoyi/go-snowflake"
 	"github.com/wailsapp/mimetype"
 )
 
@@ -91,9 +94,10 @@ type Library struct {
 }
 
 type meta struct {
-	ContentType string   `json:"contentType"`
-	HashChain   [][]byte `json:"history"`
-	Tags        []string `json:"tags"`
+	ContentType string     `json:"contentType"`
+	HashChain   [][]byte   `json:"history"`
+	Tags        []string   `json:"tags"`
+	Delta       *deltaInfo `json:"delta,omitempty"`
 }
 
 // Get returns a library app mounted on the provided path in the pool
@@ -142,7 +146,7 @@ func (l *Library) getDocuments(files []File, locals []Local) ([]Document, error)
 		m[lo.Name] = Document{
 			Name:      lo.Name,
 			LocalPath: lo.Path,
-			AuthorId:  lo.AuthorId,
+			AuthorId:  security.Successor(lo.AuthorId),
 			State:     l.getStateForLocal(lo),
 			Hash:      lo.Hash,
 			HashChain: lo.HashChain,
@@ -161,7 +165,7 @@ func (l *Library) getDocuments(files []File, locals []Local) ([]Document, error)
 			}
 		}
 		v := Version{
-			AuthorId:    f.AuthorId,
+			AuthorId:    security.Successor(f.AuthorId),
 			Size:        f.Size,
 			ModTime:     f.ModTime,
 			ContentType: f.ContentType,
@@ -237,26 +241,122 @@ func (l *Library) List(folder string) (List, error) {
 }
 
 func (l *Library) Save(id uint64, dest string) error {
+	d, _, err := sqlGetDocumentById(l.Pool.Name, l.Channel, id)
+	if core.IsErr(err, "cannot get document with id '%d': %v", id) {
+		return err
+	}
+
+	err = l.receive(id, d.Name, dest, 0)
+	if core.IsErr(err, "cannot get file with id %d: %v", id) {
+		return err
+	}
+	return nil
+}
+
+// receive writes the version id of document name to dest. A delta is applied to the local copy of its base
+// when the copy is unchanged; otherwise the base version is downloaded from the pool first. depth is the number
+// of deltas already followed to reach id
+func (l *Library) receive(id uint64, name string, dest string, depth int) error {
+	delta, isDelta, err := sqlGetDelta(l.Pool.Name, l.Channel, id)
+	if err != nil {
+		return err
+	}
+	if isDelta && depth >= DeltaMaxDepth {
+		core.IsErr(ErrInvalidDelta, "delta chain of %d is longer than %d: %v", id, DeltaMaxDepth)
+		return ErrInvalidDelta
+	}
+
 	f, err := os.Create(dest)
 	if core.IsErr(err, "cannot create '%s': %v", dest) {
 		return err
 	}
 	defer f.Close()
 
-	err = l.Pool.Receive(id, nil, f)
-	if core.IsErr(err, "cannot get file with id %d: %v", id) {
+	if !isDelta {
+		return l.Pool.Receive(id, nil, f)
+	}
+
+	d, err := os.CreateTemp(filepath.Dir(dest), ".delta.*")
+	if core.IsErr(err, "cannot create temporary file for delta: %v") {
 		return err
 	}
+	defer os.Remove(d.Name())
+	defer d.Close()
+
+	err = l.Pool.Receive(id, nil, d)
+	if core.IsErr(err, "cannot get delta with id %d: %v", id) {
+		return err
+	}
+	_, err = d.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	base, err := l.openBase(delta, name, dest, depth+1)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	hw, err := security.NewHashStream(nil, f)
+	if err != nil {
+		return err
+	}
+	err = applyDelta(base, d, hw)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hw.Hash(), delta.Hash) {
+		core.IsErr(ErrInvalidDelta, "cannot apply delta %d: %v", id)
+		return ErrInvalidDelta
+	}
 	return nil
 }
 
-func (l *Library) Receive(id uint64, localPath string) (pool.Feed, error) {
-	os.MkdirAll(filepath.Dir(localPath), 0755)
+// openBase opens the base version of a delta. The local copy of the document is used when it matches the base,
+// otherwise the base is downloaded next to dest
+func (l *Library) openBase(delta deltaInfo, name string, dest string, depth int) (*baseFile, error) {
+	lo, ok, _ := sqlGetLocal(l.Pool.Name, l.Channel, name)
+	if ok && bytes.Equal(lo.Hash, delta.BaseHash) {
+		h, err := security.FileHash(lo.Path)
+		if err == nil && bytes.Equal(h, delta.BaseHash) {
+			f, err := os.Open(lo.Path)
+			if err == nil {
+				return &baseFile{File: f}, nil
+			}
+		}
+	}
 
-	f, err := os.Create(localPath + ".tmp")
-	if core.IsErr(err, "cannot create '%s': %v", localPath) {
-		return pool.Feed{}, err
+	tmp := dest + ".base"
+	err := l.receive(delta.BaseId, name, tmp, depth)
+	if core.IsErr(err, "cannot get base version %d: %v", delta.BaseId) {
+		os.Remove(tmp)
+		return nil, err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
 	}
+	return &baseFile{File: f, temp: true}, nil
+}
+
+// baseFile is the base of a delta. A base downloaded from the pool is removed when closed
+type baseFile struct {
+	*os.File
+	temp bool
+}
+
+func (b *baseFile) Close() error {
+	err := b.File.Close()
+	if b.temp {
+		os.Remove(b.Name())
+	}
+	return err
+}
+
+func (l *Library) Receive(id uint64, localPath string) (pool.Feed, error) {
+	os.MkdirAll(filepath.Dir(localPath), 0755)
 
 	d, ok, err := sqlGetDocumentById(l.Pool.Name, l.Channel, id)
 	if core.IsErr(err, "cannot get document with id '%d': %v", id) {
@@ -266,8 +366,7 @@ func (l *Library) Receive(id uint64, localPath string) (pool.Feed, error) {
 		return pool.Feed{}, core.ErrInvalidId
 	}
 
-	err = l.Pool.Receive(id, nil, f)
-	f.Close()
+	err = l.receive(id, d.Name, localPath+".tmp", 0)
 	if core.IsErr(err, "cannot get file with id %d: %v", id) {
 		os.Remove(localPath + ".tmp")
 		return pool.Feed{}, err
@@ -293,6 +392,11 @@ func (l *Library) Receive(id uint64, localPath string) (pool.Feed, error) {
 	if core.IsErr(err, "cannot update document for id %d: %v", id) {
 		return pool.Feed{}, err
 	}
+
+	blocks, err := fileBlocks(localPath)
+	if !core.IsErr(err, "cannot split %s in blocks: %v", localPath) {
+		sqlSetBlocks(l.Pool.Name, l.Channel, d.Name, d.Hash, blocks)
+	}
 	return pool.Feed{}, nil
 }
 
@@ -341,12 +445,12 @@ func (l *Library) Send(localPath string, name string, solveConflicts bool, tags
 		}
 	}
 
-	m, err := json.Marshal(meta{
-		ContentType: mime.String(),
-		Tags:        tags,
-		HashChain:   hashChain,
-	})
-	if core.IsErr(err, "cannot marshal metadata to json: %v") {
+	hash, err := security.FileHash(localPath)
+	if core.IsErr(err, "cannot hash '%s': %v", localPath) {
+		return pool.Feed{}, err
+	}
+	blocks, err := fileBlocks(localPath)
+	if core.IsErr(err, "cannot split '%s' in blocks: %v", localPath) {
 		return pool.Feed{}, err
 	}
 
@@ -356,10 +460,32 @@ func (l *Library) Send(localPath string, name string, solveConflicts bool, tags
 	}
 	defer f.Close()
 
-	h, err := l.Pool.Send(path.Join(l.Channel, name), f, m)
+	var r io.Reader = f
+	var delta *deltaInfo
+	if ok && !solveConflicts {
+		var edits []algo.Edit
+		delta, edits = l.prepareDelta(lo, blocks, uint64(stat.Size()))
+		if delta != nil {
+			delta.Hash = hash
+			r = deltaReader(edits, f)
+		}
+	}
+
+	m, err := json.Marshal(meta{
+		ContentType: mime.String(),
+		Tags:        tags,
+		HashChain:   hashChain,
+		Delta:       delta,
+	})
+	if core.IsErr(err, "cannot marshal metadata to json: %v") {
+		return pool.Feed{}, err
+	}
+
+	h, err := l.Pool.Send(path.Join(l.Channel, name), r, m)
 	if core.IsErr(err, "cannot post content to pool '%s': %v", l.Pool.Name) {
 		return pool.Feed{}, err
 	}
+	sqlSetBlocks(l.Pool.Name, l.Channel, name, hash, blocks)
 
 	l.Pool.Sync()
 	lo = Local{
@@ -369,13 +495,50 @@ func (l *Library) Send(localPath string, name string, solveConflicts bool, tags
 		ModTime:   stat.ModTime(),
 		Size:      uint64(stat.Size()),
 		AuthorId:  h.AuthorId,
-		Hash:      h.Hash,
+		Hash:      hash,
 		HashChain: hashChain,
 	}
 	err = sqlSetLocal(l.Pool.Name, l.Channel, lo)
 	return h, err
 }
 
+// prepareDelta returns the edits from the last version of the document synchronized with the pool to the
+// provided blocks. It returns nil when the blocks of that version are unknown, the delta chain is too long, the
+// full version at the start of the chain is too old or the delta is not small enough
+func (l *Library) prepareDelta(lo Local, blocks []algo.HashBlock, size uint64) (*deltaInfo, []algo.Edit) {
+	base, ok, err := sqlGetBlocks(l.Pool.Name, l.Channel, lo.Name, lo.Hash)
+	if err != nil || !ok {
+		return nil, nil
+	}
+
+	depth, fullId := 1, lo.Id
+	for ; depth <= DeltaMaxDepth; depth++ {
+		d, ok, _ := sqlGetDelta(l.Pool.Name, l.Channel, fullId)
+		if !ok {
+			break
+		}
+		fullId = d.BaseId
+	}
+	if depth > DeltaMaxDepth {
+		return nil, nil
+	}
+	sid := snowflake.ParseID(fullId)
+	if core.Since(sid.GenerateTime()) > time.Duration(DeltaBaseShare*float64(pool.LifeSpan)) {
+		return nil, nil
+	}
+
+	edits := algo.HashDiff(base, blocks)
+	if float64(deltaSize(edits)) > DeltaMaxRatio*float64(size) {
+		return nil, nil
+	}
+	return &deltaInfo{
+		BaseId:   lo.Id,
+		BaseHash: lo.Hash,
+		Size:     size,
+		Depth:    depth,
+	}, edits
+}
+
 func (l *Library) accept(feed pool.Feed) {
 	if !strings.HasPrefix(feed.Name, l.Channel+"/") {
 		return
@@ -388,15 +551,24 @@ func (l *Library) accept(feed pool.Feed) {
 	}
 	name := feed.Name[len(l.Channel)+1:]
 
+	hash, size := feed.Hash, uint64(feed.Size)
+	if m.Delta != nil {
+		hash, size = m.Delta.Hash, m.Delta.Size
+		err = sqlSetDelta(l.Pool.Name, l.Channel, feed.Id, *m.Delta)
+		if err != nil {
+			return
+		}
+	}
+
 	f := File{
 		Id:          feed.Id,
 		Name:        name,
 		ModTime:     feed.ModTime,
-		Size:        uint64(feed.Size),
+		Size:        size,
 		AuthorId:    feed.AuthorId,
 		ContentType: m.ContentType,
 		Offset:      feed.Offset,
-		Hash:        feed.Hash,
+		Hash:        hash,
 		HashChain:   m.HashChain,
 	}
 
@@ -16,6 +16,7 @@ var ErrInvalidFilePath = fmt.Errorf("a file is not in a valid Safepool folder")
 var ErrNoExchange = fmt.Errorf("no exchange reachable for the domain")
 var ErrNotAuthorized = fmt.Errorf("user is not authorized in the domain")
 var ErrInvalidId = fmt.Errorf("the id is invalid")
+var ErrPreconditionFailed = fmt.Errorf("the file has been modified or created concurrently")
 
 func IsErr(err error, msg string, args ...interface{}) bool {
 
@@ -19,6 +19,7 @@ import (
 
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/pool"
+	"github.com/code-to-go/safe/safepool/security"
 )
 
 func cResult(v any, err error) C.Result {
@@ -120,3 +121,98 @@ func postMessage(poolName *C.char, contentType *C.char, text *C.char, binary *C.
 	}
 	return cResult(id, nil)
 }
+
+//export exportSelf
+func exportSelf(passphrase *C.char) C.Result {
+	data, err := safepool.ExportSelf(C.GoString(passphrase))
+	return cResult(data, err)
+}
+
+//export importSelf
+func importSelf(data *C.char, passphrase *C.char) C.Result {
+	bs, err := base64.StdEncoding.DecodeString(C.GoString(data))
+	if core.IsErr(err, "invalid identity backup: %v") {
+		return cResult(nil, err)
+	}
+	return cResult(nil, safepool.ImportSelf(bs, C.GoString(passphrase)))
+}
+
+//export getPaperKey
+func getPaperKey() C.Result {
+	return cResult(safepool.PaperKey())
+}
+
+//export restoreSelf
+func restoreSelf(paper *C.char, nick *C.char) C.Result {
+	return cResult(nil, safepool.RestoreSelf(C.GoString(paper), C.GoString(nick)))
+}
+
+//export delegateDevice
+func delegateDevice(deviceId *C.char, device *C.char) C.Result {
+	return cResult(safepool.DelegateDevice(C.GoString(deviceId), C.GoString(device)))
+}
+
+//export linkDevice
+func linkDevice(certificate *C.char) C.Result {
+	return cResult(nil, safepool.LinkDevice(C.GoString(certificate)))
+}
+
+//export revokeDevice
+func revokeDevice(deviceId *C.char) C.Result {
+	return cResult(nil, safepool.RevokeDevice(C.GoString(deviceId)))
+}
+
+//export getDevices
+func getDevices() C.Result {
+	return cResult(safepool.Devices())
+}
+
+//export rotateIdentity
+func rotateIdentity() C.Result {
+	return cResult(nil, safepool.RotateIdentity())
+}
+
+//export endorse
+func endorse(id *C.char, endorse C.int) C.Result {
+	return cResult(nil, safepool.Endorse(C.GoString(id), endorse != 0))
+}
+
+//export getTrustLevel
+func getTrustLevel(id *C.char) C.Result {
+	return cResult(safepool.TrustLevel(C.GoString(id)), nil)
+}
+
+//export setTrustPolicy
+func setTrustPolicy(policy *C.char) C.Result {
+	var p security.TrustPolicy
+	err := cInput(nil, policy, &p)
+	if err != nil {
+		return cResult(nil, err)
+	}
+	return cResult(nil, safepool.SetTrustPolicy(p))
+}
+
+//export getSafetyNumber
+func getSafetyNumber(id *C.char) C.Result {
+	return cResult(safepool.SafetyNumber(C.GoString(id)))
+}
+
+//export getVerificationCode
+func getVerificationCode(id *C.char) C.Result {
+	return cResult(safepool.VerificationCode(C.GoString(id)))
+}
+
+//export verifyIdentity
+func verifyIdentity(id *C.char, code *C.char) C.Result {
+	return cResult(nil, safepool.VerifyIdentity(C.GoString(id), C.GoString(code)))
+}
+
+//export setVerified
+func setVerified(id *C.char, verified C.int) C.Result {
+	return cResult(nil, safepool.SetVerified(C.GoString(id), verified != 0))
+}
+
+//export getKeyChanges
+func getKeyChanges() C.Result {
+	return cResult(safepool.KeyChanges())
+}
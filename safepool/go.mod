@@ -19,6 +19,7 @@ require (
 	github.com/wailsapp/mimetype v1.4.1
 	github.com/zenazn/pkcs7pad v0.0.0-20170308005700-253a5b1f0e03
 	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.5.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -29,6 +30,5 @@ require (
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/kr/fs v0.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/net v0.5.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 )
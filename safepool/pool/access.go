@@ -5,6 +5,7 @@ import (
 	"hash"
 	"math/rand"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/code-to-go/safe/safepool/core"
@@ -20,10 +21,24 @@ const (
 	Active
 )
 
+// Role defines what a member can do in a pool. A higher role includes the lower ones, and an access without a role
+// is a Reader
+type Role int
+
+const (
+	// Reader can only receive feeds
+	Reader Role = iota
+	// Writer can send and receive feeds
+	Writer
+	// Admin can change the accesses of the pool
+	Admin
+)
+
 type Access struct {
 	Id      string
 	State   State
 	ModTime time.Time
+	Role    Role
 }
 
 type AccessKey struct {
@@ -31,6 +46,17 @@ type AccessKey struct {
 	Key    []byte
 }
 
+// DeviceKey is the master key encrypted for a device that acts on behalf of a member
+type DeviceKey struct {
+	UserId   string
+	DeviceId string
+	Key      []byte
+}
+
+// AccessFileVersion is the version of the access files written by this release. Version 2 seals the keystore
+// with AES-256-GCM; older access files are read and upgraded on the next export
+const AccessFileVersion = 2.0
+
 type AccessFile struct {
 	Version     float32
 	AccessKeys  []AccessKey
@@ -38,6 +64,7 @@ type AccessFile struct {
 	MasterKeyId uint64
 	Keystore    []byte
 	Apps        []string
+	DeviceKeys  []DeviceKey `json:",omitempty"`
 }
 
 const IdentityFolder = "identities"
@@ -81,58 +108,154 @@ func (p *Pool) importIdentities() error {
 	selfId := p.Self.Id()
 	for _, l := range ls {
 		n := l.Name()
-		if n == selfId {
+		if n == selfId || strings.HasSuffix(n, SuccessionExt) {
 			continue
 		}
 
 		identity, ok := m[n]
-		if !ok || identity.Nick == "❓ Incognito..." || rand.Intn(100) > 95 {
+		verified := security.IsVerified(n)
+		if !ok || identity.Nick == "❓ Incognito..." || verified || rand.Intn(100) > 95 {
 			name := path.Join(p.Name, IdentityFolder, n)
 			i, err := p.readIdentity(name)
-			if !core.IsErr(err, "cannot read identity from '%s': %v", name) {
-				security.SetIdentity(i)
+			if core.IsErr(err, "cannot read identity from '%s': %v", name) {
+				continue
 			}
+			if i.Id() != n {
+				core.IsErr(ErrInvalidSignature, "identity file '%s' holds different keys: %v", name)
+				if added, _ := security.WarnKeyChange(n, i.Id()); added {
+					p.publish(Event{Kind: KeyChanged, Id: n})
+				}
+				continue
+			}
+			security.SetIdentity(i)
 		}
 	}
 	return nil
 }
 
 func (p *Pool) sync(e transport.Exchanger) (hash.Hash, error) {
-	l, err := p.lockAccessFile(e)
-	if core.IsErr(err, "cannot lock access on %s: %v", p.e) {
+	p.syncDelegations(e)
+	p.syncSuccessions(e)
+	p.syncEndorsements(e)
+	h, requireExport, err := p.importAccessFile(e)
+	if err != nil {
 		return nil, err
 	}
-	defer p.unlockAccessFile(e, l)
+
+	err = p.migrateSuccessors()
+	if err != nil {
+		return nil, err
+	}
+
+	changed, revokedId := p.checkDevices()
+	if revokedId != "" && p.hasRole(p.Self.Id(), Admin) {
+		err = p.rotateMasterKey(revokedId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	requireExport = requireExport || changed
+
+	if requireExport && p.hasRole(p.Self.Id(), Admin) {
+		err = p.exportAccessFile()
+		return h, err
+	}
+	return h, nil
+}
+
+// hasRole returns true when the identity id is active in the pool with the role or a higher one
+func (p *Pool) hasRole(id string, role Role) bool {
+	a, ok, _ := p.sqlGetAccess(id)
+	return ok && a.State == Active && a.Role >= role
+}
+
+// migrateRoles assigns the roles in an access file written before roles were introduced, i.e. where no access is
+// an admin. Only the members that signed the file become admins; the other active members become writers
+func migrateRoles(a *AccessFile, sh security.SignedHash, hash []byte) {
+	for _, ak := range a.AccessKeys {
+		if ak.Access.Role == Admin {
+			return
+		}
+	}
+	for idx := range a.AccessKeys {
+		access := &a.AccessKeys[idx].Access
+		if access.State != Active {
+			continue
+		}
+		access.Role = Writer
+		i, err := security.IdentityFromId(access.Id)
+		if err == nil && security.VerifySignedHash(sh, []security.Identity{i}, hash) {
+			access.Role = Admin
+		}
+	}
+}
+
+// admins returns the active admins among the accesses
+func admins(accesses []Access) []security.Identity {
+	var identities []security.Identity
+	for _, a := range accesses {
+		if a.State != Active || a.Role != Admin {
+			continue
+		}
+		i, err := security.IdentityFromId(a.Id)
+		if !core.IsErr(err, "invalid admin id '%s': %v", a.Id) {
+			identities = append(identities, i)
+		}
+	}
+	return identities
+}
+
+func (p *Pool) importAccessFile(e transport.Exchanger) (h hash.Hash, requireExport bool, err error) {
+	lease, err := p.lockAccessFile(e)
+	if core.IsErr(err, "cannot lock access on %s: %v", p.e) {
+		return nil, false, err
+	}
+	defer p.unlockAccessFile(lease)
 
 	a, h, err := p.readAccessFile(e)
 	if core.IsErr(err, "cannot read access file:%v") {
-		return nil, err
+		return nil, false, err
 	}
 	p.Apps = a.Apps
+	p.deviceKeys = a.DeviceKeys
 
 	if bytes.Equal(h.Sum(nil), p.accessHash) {
-		return h, nil
+		return h, false, nil
 	}
 
-	requireExport, err := p.syncAccesses(a)
+	log, err := p.syncAccessLog(e)
+	if core.IsErr(err, "cannot sync access log: %v") {
+		return nil, false, err
+	}
+
+	requireExport, err = p.syncAccesses(a, log)
 	if core.IsErr(err, "cannot sync accesss: %v") {
-		return nil, err
+		return nil, false, err
 	}
 
-	_, err = p.decodeKeystore(a.Keystore, a.Nonce)
+	_, err = p.decodeKeystore(a)
 	if core.IsErr(err, "cannot import keystore: %v") {
-		return nil, err
+		return nil, false, err
 	}
 
-	p.accessHash = h.Sum(nil)
-	if requireExport {
-		err = p.exportAccessFile()
-		return h, err
+	// the first import on open is not a change
+	if p.accessHash != nil {
+		p.publish(Event{Kind: AccessChanged})
 	}
-	return h, nil
+	p.accessHash = h.Sum(nil)
+	return h, requireExport, nil
 }
 
 func (p *Pool) exportAccessFile() error {
+	if !p.hasRole(p.Self.Id(), Admin) {
+		return ErrNotAdmin
+	}
+	lease, err := p.lockAccessFile(p.e)
+	if err != nil {
+		return err
+	}
+	defer p.unlockAccessFile(lease)
+
 	identities, accesses, err := p.sqlGetAccesses(false)
 	if core.IsErr(err, "cannot read identities from db for '%s': %v", p.Name) {
 		return err
@@ -154,29 +277,55 @@ func (p *Pool) exportAccessFile() error {
 		})
 	}
 
+	var deviceKeys []DeviceKey
+	for _, access := range accesses {
+		if access.State != Active {
+			continue
+		}
+		delegations, _ := security.Delegations(access.Id)
+		for _, d := range delegations {
+			device, err := security.IdentityFromId(d.DeviceId)
+			if d.Revoked || err != nil {
+				continue
+			}
+			k, err := security.EcEncrypt(device, p.masterKey)
+			if !core.IsErr(err, "cannot encrypt master key for device '%s' in '%s': %v", d.Device, p.Name) {
+				deviceKeys = append(deviceKeys, DeviceKey{UserId: access.Id, DeviceId: d.DeviceId, Key: k})
+			}
+		}
+	}
+
 	keystore, nonce, err := p.encodeKeystore()
 	if core.IsErr(err, "cannot encode keystore for export of pool '%s': %v", p.Name) {
 		return err
 	}
 
 	a := AccessFile{
-		Version:     1.0,
+		Version:     AccessFileVersion,
 		AccessKeys:  accessKeys,
 		Nonce:       nonce,
 		MasterKeyId: p.masterKeyId,
 		Keystore:    keystore,
 		Apps:        p.Apps,
+		DeviceKeys:  deviceKeys,
 	}
-	_, err = p.writeAccessFile(p.e, a)
+	h, err := p.writeAccessFile(p.e, a, lease)
 	if core.IsErr(err, "cannot write access file: %v") {
 		return err
 	}
+	// the accesses in the file are already in the DB
+	p.accessHash = h.Sum(nil)
+	p.deviceKeys = deviceKeys
 	return nil
 }
 
-func (p *Pool) syncAccesses(a AccessFile) (requireExport bool, err error) {
+// syncAccesses updates the accesses in the DB with the access file. The accesses in the log are taken from the
+// log, so the access file only adds those from before the log was started
+func (p *Pool) syncAccesses(a AccessFile, log *accessLog) (requireExport bool, err error) {
 	var needNewMasterKey bool
-	identities, accesses, err := p.sqlGetAccesses(false)
+	var disabledId string
+	lastKeyId := p.masterKeyId
+	_, accesses, err := p.sqlGetAccesses(false)
 	if core.IsErr(err, "cannot read identities during grant import: %v", err) {
 		return false, err
 	}
@@ -184,62 +333,122 @@ func (p *Pool) syncAccesses(a AccessFile) (requireExport bool, err error) {
 	for _, access := range accesses {
 		amap[access.Id] = access
 	}
-	imap := map[string]security.Identity{}
-	for _, identity := range identities {
-		imap[identity.Id()] = identity
+
+	for id, access := range log.accesses {
+		current, ok := amap[id]
+		if ok && current.State == access.State && current.Role == access.Role {
+			continue
+		}
+		err = p.ensureIdentity(id)
+		if err == nil {
+			err = p.sqlSetAccess(access)
+		}
+		if core.IsErr(err, "cannot set access for identity '%s' on pool '%s': %v", id, p.Name) {
+			return false, err
+		}
+		amap[id] = access
 	}
 
 	selfId := p.Self.Id()
+	for _, deviceKey := range a.DeviceKeys {
+		if deviceKey.DeviceId == selfId && security.IsDelegated(selfId, deviceKey.UserId) {
+			err = p.useMasterKey(a.MasterKeyId, deviceKey.Key)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
 	for _, accessKey := range a.AccessKeys {
 		if accessKey.Access.Id == selfId {
-			masterKey, err := security.EcDecrypt(p.Self, accessKey.Key)
-			if core.IsErr(err, "cannot derive master key for pool '%s'", p.Name) {
-				return false, err
+			if accessKey.Key == nil {
+				return false, ErrNotAuthorized
 			}
-			p.masterKey = masterKey
-			p.masterKeyId = a.MasterKeyId
-			err = p.sqlSetKey(a.MasterKeyId, masterKey)
-			if core.IsErr(err, "cannot save master key: %v") {
+			err = p.useMasterKey(a.MasterKeyId, accessKey.Key)
+			if err != nil {
 				return false, err
 			}
 		}
 
-		if accessKey.Key == nil {
+		if accessKey.Key == nil && accessKey.Access.State == Active {
 			requireExport = true
 		}
 
-		access, isInDb := amap[accessKey.Access.Id]
-		if !isInDb {
+		access := amap[accessKey.Access.Id]
+		if logged, ok := log.accesses[accessKey.Access.Id]; ok {
+			// the access file is a snapshot of the log that may be outdated
+			if accessKey.Access.State != logged.State || accessKey.Access.Role != logged.Role {
+				requireExport = true
+			}
+			if logged.State == Disabled && accessKey.Key != nil {
+				needNewMasterKey = true
+				disabledId = logged.Id
+			}
+		} else if log.last != nil {
+			// once the log exists, it alone decides the members
+			requireExport = true
+		} else {
+			// a pool without a log is bootstrapped from the access file
 			switch {
-			case accessKey.Access.ModTime.After(access.ModTime):
+			case accessKey.Access.ModTime.After(access.ModTime),
+				accessKey.Access.ModTime.Equal(access.ModTime) && accessKey.Access.Role != access.Role:
 				err = p.sqlSetAccess(accessKey.Access)
-				core.IsErr(err, "cannot set access for identity '%s' on pool '%s': %v", access.Id, p.Name)
+				core.IsErr(err, "cannot set access for identity '%s' on pool '%s': %v", accessKey.Access.Id, p.Name)
 			case accessKey.Access.ModTime.Before(access.ModTime):
 				requireExport = true
-				needNewMasterKey = needNewMasterKey || accessKey.Access.State != access.State && access.State == Disabled
+				if accessKey.Access.State != access.State && access.State == Disabled {
+					needNewMasterKey = true
+					disabledId = access.Id
+				}
 			}
 		}
-		delete(amap, access.Id)
+		delete(amap, accessKey.Access.Id)
 	}
 
-	requireExport = requireExport || len(amap) > 0
+	requireExport = requireExport || len(amap) > 0 || a.Version < AccessFileVersion
 	if p.masterKeyId == 0 {
 		return false, ErrNotAuthorized
 	}
 
-	if needNewMasterKey {
-		err = p.updateMasterKey()
-		if core.IsErr(err, "cannot update master encryption key for pool '%s': %v", p.Name) {
-			return false, err
-		}
+	if needNewMasterKey && p.hasRole(selfId, Admin) {
+		return true, p.rotateMasterKey(disabledId)
+	}
+	if lastKeyId != 0 && p.masterKeyId != lastKeyId {
+		p.publish(Event{Kind: KeyRotated, KeyId: p.masterKeyId})
 	}
 
 	return requireExport, nil
 }
 
+// useMasterKey decrypts the master key with the local identity and makes it the current one
+func (p *Pool) useMasterKey(id uint64, encrypted []byte) error {
+	masterKey, err := security.EcDecrypt(p.Self, encrypted)
+	if core.IsErr(err, "cannot derive master key for pool '%s'", p.Name) {
+		return err
+	}
+	p.setMasterKey(id, masterKey)
+	err = p.sqlSetKey(id, masterKey)
+	core.IsErr(err, "cannot save master key: %v")
+	return err
+}
+
+// rotateMasterKey replaces the master key after the identity id has been disabled. Previous keys stay in the
+// keystore, so that content encrypted with them can still be read. The new key is distributed to the active
+// identities on the next export
+func (p *Pool) rotateMasterKey(id string) error {
+	err := p.updateMasterKey()
+	if core.IsErr(err, "cannot update master encryption key for pool '%s': %v", p.Name) {
+		return err
+	}
+	err = p.appendAccessLog(AccessEntry{Change: KeyRotation, KeyId: p.masterKeyId})
+	if err != nil {
+		return err
+	}
+	p.publish(Event{Kind: KeyRotated, KeyId: p.masterKeyId, Id: id})
+	return nil
+}
+
 func (p *Pool) updateMasterKey() error {
-	p.masterKeyId = snowflake.ID()
-	p.masterKey = security.GenerateBytesKey(32)
+	p.setMasterKey(snowflake.ID(), security.GenerateBytesKey(32))
 	err := p.sqlSetKey(p.masterKeyId, p.masterKey)
 	if core.IsErr(err, "çannot store master encryption key to db: %v") {
 		return err
@@ -0,0 +1,294 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
+)
+
+const AccessLogFolder = "accesslog"
+
+var ErrInvalidAccessEntry = errors.New("access log entry is not valid")
+
+// AccessChange is the kind of an entry in the access log
+type AccessChange int
+
+const (
+	// Grant enables an identity with a role
+	Grant AccessChange = iota
+	// Revoke disables an identity
+	Revoke
+	// RoleChange changes the role of an identity
+	RoleChange
+	// KeyRotation records a new master key
+	KeyRotation
+)
+
+// AccessEntry is a change in the accesses of a pool. An entry is signed by its author, who must be an admin when
+// the entry is added, and holds the hash of the previous entry, so that the log cannot be reverted or rewritten.
+// The access file is a snapshot of the log
+type AccessEntry struct {
+	Seq       uint64
+	PrevHash  []byte
+	Change    AccessChange
+	Id        string `json:",omitempty"`
+	Role      Role
+	KeyId     uint64 `json:",omitempty"`
+	AuthorId  string
+	Time      time.Time
+	Signature []byte `json:",omitempty"`
+}
+
+func (e AccessEntry) hash() []byte {
+	e.Signature = nil
+	data, _ := json.Marshal(e)
+	h := security.NewHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// accessLog is the state of the accesses after a sequence of entries
+type accessLog struct {
+	last     *AccessEntry
+	accesses map[string]Access
+	// invalidTag is the tag of an invalid entry found in place of the next one. The entry is considered absent
+	// and the next append overwrites it
+	invalidTag string
+}
+
+func (l *accessLog) nextSeq() uint64 {
+	if l.last == nil {
+		return 1
+	}
+	return l.last.Seq + 1
+}
+
+func (l *accessLog) hasAdmin() bool {
+	for _, a := range l.accesses {
+		if a.State == Active && a.Role == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// apply checks that e can follow the entries in the log and updates the accesses. The first admin is an identity
+// that grants the role to itself when firstAdmin accepts it
+func (l *accessLog) apply(e AccessEntry, firstAdmin func(id string) bool) error {
+	var seq uint64
+	var prevHash []byte
+	if l.last != nil {
+		seq, prevHash = l.last.Seq, l.last.hash()
+	}
+	if e.Seq != seq+1 || !bytes.Equal(e.PrevHash, prevHash) {
+		return ErrInvalidAccessEntry
+	}
+	if !security.Verify(e.AuthorId, e.hash(), e.Signature) {
+		return ErrInvalidSignature
+	}
+
+	author := l.accesses[e.AuthorId]
+	isAdmin := author.State == Active && author.Role == Admin
+	bootstrap := !l.hasAdmin() && e.Change == Grant && e.Id == e.AuthorId && e.Role == Admin &&
+		firstAdmin(e.AuthorId)
+	if !isAdmin && !bootstrap {
+		return ErrNotAdmin
+	}
+
+	a := l.accesses[e.Id]
+	a.Id, a.ModTime = e.Id, e.Time
+	switch e.Change {
+	case Grant:
+		a.State, a.Role = Active, e.Role
+	case Revoke:
+		a.State = Disabled
+	case RoleChange:
+		a.Role = e.Role
+	case KeyRotation:
+	default:
+		return ErrInvalidAccessEntry
+	}
+	if e.Change != KeyRotation {
+		l.accesses[e.Id] = a
+	}
+	l.last = &e
+	return nil
+}
+
+func (p *Pool) accessEntryName(seq uint64) string {
+	return path.Join(p.Name, AccessLogFolder, fmt.Sprintf("%020d.entry", seq))
+}
+
+// loadAccessLog returns the log stored in the DB
+func (p *Pool) loadAccessLog() (*accessLog, error) {
+	entries, err := p.sqlGetAccessLog()
+	if err != nil {
+		return nil, err
+	}
+	l := &accessLog{accesses: map[string]Access{}}
+	for _, e := range entries {
+		err = l.apply(e, func(string) bool { return true })
+		if core.IsErr(err, "invalid entry %d in the access log of pool '%s': %v", e.Seq, p.Name) {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// syncAccessLog adds to the DB the entries of the log on e that follow the local ones. Reading stops at the first
+// entry that is not valid, which is considered absent so that a forged entry cannot block the log
+func (p *Pool) syncAccessLog(e transport.Exchanger) (*accessLog, error) {
+	l, err := p.loadAccessLog()
+	if err != nil {
+		return nil, err
+	}
+
+	ls, err := e.ReadDir(path.Join(p.Name, AccessLogFolder), 0)
+	if err != nil {
+		return l, nil
+	}
+	var seqs []uint64
+	for _, f := range ls {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".entry"), 10, 64)
+		if err == nil && (l.last == nil || seq > l.last.Seq) {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	// the first admin of a pool must be known locally, unless the pool has no admin yet
+	_, accesses, err := p.sqlGetAccesses(false)
+	if err != nil {
+		return nil, err
+	}
+	known := admins(accesses)
+	firstAdmin := func(id string) bool {
+		for _, i := range known {
+			if i.Id() == id {
+				return true
+			}
+		}
+		return len(known) == 0
+	}
+
+	for _, seq := range seqs {
+		var entry AccessEntry
+		name := p.accessEntryName(seq)
+		var buf bytes.Buffer
+		err = e.Read(name, nil, &buf)
+		if core.IsErr(err, "cannot read access entry '%s': %v", name) {
+			break
+		}
+		err = json.Unmarshal(buf.Bytes(), &entry)
+		if err == nil {
+			err = l.apply(entry, firstAdmin)
+		}
+		if core.IsErr(err, "access entry '%s' is rejected: %v", name) {
+			if seq == l.nextSeq() {
+				l.invalidTag, _ = transport.ETag(e, name)
+			}
+			break
+		}
+		err = p.sqlAddAccessEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// appendAccessLog signs the changes and appends them to the log. A log is started with a grant of the admin role
+// to the local identity followed by the current accesses
+func (p *Pool) appendAccessLog(changes ...AccessEntry) error {
+	l, err := p.syncAccessLog(p.e)
+	if err != nil {
+		return err
+	}
+
+	selfId := p.Self.Id()
+	if l.last == nil {
+		_, accesses, err := p.sqlGetAccesses(false)
+		if err != nil {
+			return err
+		}
+		initial := []AccessEntry{{Change: Grant, Id: selfId, Role: Admin}}
+		for _, a := range accesses {
+			if a.Id == selfId {
+				continue
+			}
+			initial = append(initial, AccessEntry{Change: Grant, Id: a.Id, Role: a.Role})
+			if a.State == Disabled {
+				initial = append(initial, AccessEntry{Change: Revoke, Id: a.Id})
+			}
+		}
+		changes = append(initial, changes...)
+	}
+
+	for _, e := range changes {
+		e.AuthorId = selfId
+		e.Time = core.Now()
+		e.Seq, e.PrevHash = l.nextSeq(), nil
+		if l.last != nil {
+			e.PrevHash = l.last.hash()
+		}
+		e.Signature, err = security.Sign(p.Self, e.hash())
+		if core.IsErr(err, "cannot sign access entry: %v") {
+			return err
+		}
+		err = l.apply(e, func(string) bool { return true })
+		if core.IsErr(err, "cannot add entry to the access log of pool '%s': %v", p.Name) {
+			return err
+		}
+
+		data, err := json.Marshal(e)
+		if core.IsErr(err, "cannot marshal access entry: %v") {
+			return err
+		}
+		err = transport.WriteIfMatch(p.e, p.accessEntryName(e.Seq), l.invalidTag, bytes.NewReader(data))
+		l.invalidTag = ""
+		if errors.Is(err, core.ErrPreconditionFailed) {
+			core.IsErr(ErrAccessConflict, "cannot append to the access log of pool '%s': %v", p.Name)
+			return ErrAccessConflict
+		}
+		if core.IsErr(err, "cannot write access entry %d of pool '%s': %v", e.Seq, p.Name) {
+			return err
+		}
+		err = p.sqlAddAccessEntry(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAccessLog removes the log of a pool that is created again
+func (p *Pool) deleteAccessLog() {
+	ls, _ := p.e.ReadDir(path.Join(p.Name, AccessLogFolder), 0)
+	for _, l := range ls {
+		name := path.Join(p.Name, AccessLogFolder, l.Name())
+		core.IsErr(p.e.Delete(name), "cannot delete access entry '%s': %v", name)
+	}
+	p.sqlDelAccessLog()
+}
+
+// AccessHistory returns the changes in the accesses of the pool, starting from the oldest
+func (p *Pool) AccessHistory() ([]AccessEntry, error) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	_, err := p.syncAccessLog(p.e)
+	if err != nil {
+		return nil, err
+	}
+	return p.sqlGetAccessLog()
+}
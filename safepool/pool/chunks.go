@@ -0,0 +1,115 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/code-to-go/safe/safepool/algo"
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
+	"golang.org/x/crypto/blake2b"
+)
+
+const ChunksFolder = "chunks"
+
+// ChunkFeeds enables the chunked feed format: the body of a feed is split in content-defined chunks stored once
+// in the pool and listed in the head. Unchanged chunks are not uploaded again
+var ChunkFeeds = false
+
+// ChunkSplitBits sets the average size of a chunk to 2^ChunkSplitBits bytes
+var ChunkSplitBits uint = 20
+
+func (p *Pool) chunkName(hash []byte) string {
+	h := hex.EncodeToString(hash)
+	return path.Join(p.Name, ChunksFolder, h[0:2], h)
+}
+
+// writeChunks splits the content of r and uploads the chunks missing in the pool. Chunks are named after their
+// hash keyed with the master key, so the storage cannot match them against known content. A chunk older than
+// LifeSpan is uploaded again so that housekeeping does not remove it while it is still referenced
+func (p *Pool) writeChunks(r io.Reader) (hr *security.HashStream, chunks []algo.HashBlock, leaves []algo.HashBlock,
+	err error) {
+	hr, err = security.NewHashStream(r, nil)
+	if core.IsErr(err, "cannot create hash reader: %v") {
+		return nil, nil, nil, err
+	}
+	masterKeyId, masterKey := p.currentKey()
+	keyed, err := blake2b.New256(masterKey)
+	if core.IsErr(err, "cannot create chunk hash: %v") {
+		return nil, nil, nil, err
+	}
+
+	err = algo.HashSplitWith(hr, ChunkSplitBits, keyed, func(block algo.HashBlock, data []byte) error {
+		chunks = append(chunks, block)
+		leaves = append(leaves, algo.MerkleLeaf(data))
+
+		name := p.chunkName(block.Hash)
+		stat, err := p.e.Stat(name)
+		if err == nil && core.Since(stat.ModTime()) < LifeSpan {
+			return nil
+		}
+
+		er, err := security.EncryptingReader(masterKeyId, p.keyFunc, bytes.NewReader(data))
+		if core.IsErr(err, "cannot create encrypting reader: %v") {
+			return err
+		}
+		err = p.e.Write(name, er)
+		core.IsErr(err, "cannot write chunk %s: %v", name)
+		return err
+	})
+	return hr, chunks, leaves, err
+}
+
+// readChunks writes to w the content of a chunked feed. When rang is not nil, only the chunks that overlap the
+// range are downloaded
+func (p *Pool) readChunks(f Feed, rang *transport.Range, w io.Writer) (*security.HashStream, error) {
+	hw, err := security.NewHashStream(nil, w)
+	if core.IsErr(err, "cannot create hash stream: %v") {
+		return nil, err
+	}
+
+	var offset int64
+	for _, c := range f.Chunks {
+		from, to := offset, offset+int64(c.Length)
+		offset = to
+
+		var dest io.Writer = hw
+		if rang != nil {
+			if to <= rang.From || from >= rang.To {
+				continue
+			}
+			dest = &rangeWriter{w: hw, rang: transport.Range{From: rang.From - from, To: rang.To - from}}
+		}
+
+		ew, err := security.DecryptingWriter(p.keyFunc, dest)
+		if core.IsErr(err, "cannot create decrypting writer: %v") {
+			return nil, err
+		}
+		name := p.chunkName(c.Hash)
+		err = readEncrypted(p.e, name, nil, ew)
+		if core.IsErr(err, "cannot read chunk %s: %v", name) {
+			return nil, err
+		}
+	}
+	return hw, nil
+}
+
+// deleteChunks removes from e the chunks older than twice LifeSpan. A chunk is refreshed when a feed reuses it
+// after LifeSpan, so no live feed can reference it
+func (p *Pool) deleteChunks(e transport.Exchanger) {
+	err := transport.Walk(e, path.Join(p.Name, ChunksFolder), func(name string, info fs.FileInfo) error {
+		if core.Since(info.ModTime()) > 2*LifeSpan {
+			err := e.Delete(name)
+			core.IsErr(err, "cannot delete chunk %s: %v", name)
+		}
+		return nil
+	})
+	if !errors.Is(err, fs.ErrNotExist) {
+		core.IsErr(err, "cannot read chunks in pool %s/%s: %v", e, p.Name)
+	}
+}
@@ -2,6 +2,7 @@ package pool
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/security"
@@ -46,11 +47,44 @@ func sqlGetFeed(pool string, id uint64) (Feed, error) {
 	f.Hash = sql.DecodeBase64(hash)
 	f.ModTime = sql.DecodeTime(modTime)
 	f.Meta = sql.DecodeBase64(meta)
+
+	var chunks []byte
+	err = sql.QueryRow("GET_FEED_CHUNKS", sql.Args{"pool": pool, "id": id}, &chunks)
+	switch err {
+	case nil:
+		err = json.Unmarshal(chunks, &f.Chunks)
+		if core.IsErr(err, "corrupted chunks for feed '%d' in pool '%s': %v", id, pool) {
+			return Feed{}, err
+		}
+	case sql.ErrNoRows:
+	default:
+		core.IsErr(err, "cannot get chunks of feed '%d' in pool '%s': %v", id, pool)
+		return Feed{}, err
+	}
+
+	var root string
+	err = sql.QueryRow("GET_FEED_ROOT", sql.Args{"pool": pool, "id": id}, &root)
+	switch err {
+	case nil:
+		f.MerkleRoot = sql.DecodeBase64(root)
+	case sql.ErrNoRows:
+	default:
+		core.IsErr(err, "cannot get merkle root of feed '%d' in pool '%s': %v", id, pool)
+		return Feed{}, err
+	}
 	return f, nil
 }
 
 func sqlDelFeedBefore(pool string, id int64) error {
 	_, err := sql.Exec("DEL_FEED_BEFORE", sql.Args{"pool": pool, "beforeId": id})
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("DEL_FEED_CHUNKS_BEFORE", sql.Args{"pool": pool, "beforeId": id})
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("DEL_FEED_ROOTS_BEFORE", sql.Args{"pool": pool, "beforeId": id})
 	return err
 }
 
@@ -66,6 +100,25 @@ func sqlAddFeed(pool string, f Feed) error {
 		"meta":     sql.EncodeBase64(f.Meta),
 		"slot":     f.Slot,
 	})
+	if err != nil {
+		return err
+	}
+
+	if len(f.MerkleRoot) > 0 {
+		_, err = sql.Exec("SET_FEED_ROOT", sql.Args{"pool": pool, "id": f.Id, "root": sql.EncodeBase64(f.MerkleRoot)})
+		if err != nil {
+			return err
+		}
+	}
+	if len(f.Chunks) == 0 {
+		return nil
+	}
+
+	chunks, err := json.Marshal(f.Chunks)
+	if core.IsErr(err, "cannot marshal chunks of feed '%d': %v", f.Id) {
+		return err
+	}
+	_, err = sql.Exec("SET_FEED_CHUNKS", sql.Args{"pool": pool, "id": f.Id, "chunks": chunks})
 	return err
 }
 
@@ -130,7 +183,8 @@ func (p *Pool) sqlGetAccesses(onlyTrusted bool) (identities []security.Identity,
 		var state State
 		var modTime int64
 		var ts int64
-		err = rows.Scan(&id, &i64, &state, &modTime, &ts)
+		var role Role
+		err = rows.Scan(&id, &i64, &state, &modTime, &ts, &role)
 		if core.IsErr(err, "cannot read identity from db: %v") {
 			continue
 		}
@@ -145,11 +199,28 @@ func (p *Pool) sqlGetAccesses(onlyTrusted bool) (identities []security.Identity,
 			Id:      id,
 			ModTime: sql.DecodeTime(modTime),
 			State:   state,
+			Role:    role,
 		})
 	}
 	return identities, accesses, nil
 }
 
+func (p *Pool) sqlGetAccess(id string) (a Access, ok bool, err error) {
+	var modTime, ts int64
+	err = sql.QueryRow("GET_ACCESS", sql.Args{"pool": p.Name, "id": id}, &a.State, &modTime, &ts, &a.Role)
+	switch err {
+	case nil:
+		a.Id = id
+		a.ModTime = sql.DecodeTime(modTime)
+		return a, true, nil
+	case sql.ErrNoRows:
+		return Access{}, false, nil
+	default:
+		core.IsErr(err, "cannot get access of '%s' in pool '%s': %v", id, p.Name)
+		return Access{}, false, err
+	}
+}
+
 func (p *Pool) sqlSetAccess(a Access) error {
 	_, err := sql.Exec("SET_ACCESS", sql.Args{
 		"id":      a.Id,
@@ -158,6 +229,50 @@ func (p *Pool) sqlSetAccess(a Access) error {
 		"state":   a.State,
 		"ts":      sql.EncodeTime(core.Now()),
 	})
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("SET_ACCESS_ROLE", sql.Args{"id": a.Id, "pool": p.Name, "role": a.Role})
+	return err
+}
+
+func (p *Pool) sqlGetAccessLog() ([]AccessEntry, error) {
+	rows, err := sql.Query("GET_ACCESS_LOG", sql.Args{"pool": p.Name})
+	if core.IsErr(err, "cannot read access log of pool '%s': %v", p.Name) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AccessEntry
+	for rows.Next() {
+		var data []byte
+		var e AccessEntry
+		err = rows.Scan(&data)
+		if core.IsErr(err, "cannot read access entry from db: %v") {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &e)
+		if core.IsErr(err, "corrupted access entry in pool '%s': %v", p.Name) {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (p *Pool) sqlAddAccessEntry(e AccessEntry) error {
+	data, err := json.Marshal(e)
+	if core.IsErr(err, "cannot marshal access entry: %v") {
+		return err
+	}
+	_, err = sql.Exec("SET_ACCESS_LOG", sql.Args{"pool": p.Name, "seq": e.Seq, "entry": data})
+	core.IsErr(err, "cannot save access entry %d of pool '%s': %v", e.Seq, p.Name)
+	return err
+}
+
+func (p *Pool) sqlDelAccessLog() error {
+	_, err := sql.Exec("DEL_ACCESS_LOG", sql.Args{"pool": p.Name})
+	core.IsErr(err, "cannot delete access log of pool '%s' from db: %v", p.Name)
 	return err
 }
 
@@ -186,6 +301,84 @@ func sqlGetPool(name string) (Config, error) {
 	return c, err
 }
 
+func sqlIsTokenUsed(nonce []byte) (bool, error) {
+	var used int64
+	err := sql.QueryRow("GET_TOKEN", sql.Args{"nonce": sql.EncodeBase64(nonce)}, &used)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		core.IsErr(err, "cannot read token from db: %v")
+		return false, err
+	}
+}
+
+func sqlSetTokenUsed(pool string, nonce []byte) error {
+	_, err := sql.Exec("SET_TOKEN", sql.Args{"nonce": sql.EncodeBase64(nonce), "pool": pool,
+		"used": sql.EncodeTime(core.Now())})
+	core.IsErr(err, "cannot save token use for pool '%s': %v", pool)
+	return err
+}
+
+// sqlGetKeystoreVersion returns the highest version of the access file seen for the pool, 0 when none
+func sqlGetKeystoreVersion(pool string) float32 {
+	var s, b64 string
+	var i int
+	err := sql.QueryRow("GET_CONFIG", sql.Args{"pool": pool, "key": "KEYSTORE_VERSION"}, &s, &i, &b64)
+	if err != sql.ErrNoRows && core.IsErr(err, "cannot read keystore version of pool '%s' from db: %v", pool) {
+		return 0
+	}
+	v, _ := strconv.ParseFloat(s, 32)
+	return float32(v)
+}
+
+func sqlSetKeystoreVersion(pool string, version float32) error {
+	s := strconv.FormatFloat(float64(version), 'f', -1, 32)
+	_, err := sql.Exec("SET_CONFIG", sql.Args{"pool": pool, "key": "KEYSTORE_VERSION", "s": s, "i": 0, "b": ""})
+	core.IsErr(err, "cannot save keystore version of pool '%s' to db: %v", pool)
+	return err
+}
+
+// sqlGetTokenHost returns the host of the token used to join the pool, if any
+func sqlGetTokenHost(pool string) (hostId string, ok bool) {
+	var i int
+	var b64 string
+	err := sql.QueryRow("GET_CONFIG", sql.Args{"pool": pool, "key": "TOKEN_HOST"}, &hostId, &i, &b64)
+	if err != sql.ErrNoRows && core.IsErr(err, "cannot read token host of pool '%s' from db: %v", pool) {
+		return "", false
+	}
+	return hostId, err == nil
+}
+
+func sqlSetTokenHost(pool string, hostId string) error {
+	_, err := sql.Exec("SET_CONFIG", sql.Args{"pool": pool, "key": "TOKEN_HOST", "s": hostId, "i": 0, "b": ""})
+	core.IsErr(err, "cannot save token host of pool '%s' to db: %v", pool)
+	return err
+}
+
+func sqlGetJoin(pool string) (nonce []byte, hostId string, ok bool) {
+	var nonce64 string
+	err := sql.QueryRow("GET_JOIN", sql.Args{"pool": pool}, &nonce64, &hostId)
+	if err != sql.ErrNoRows && core.IsErr(err, "cannot read join request of pool '%s' from db: %v", pool) {
+		return nil, "", false
+	}
+	return sql.DecodeBase64(nonce64), hostId, err == nil
+}
+
+func sqlSetJoin(pool string, nonce []byte, hostId string) error {
+	_, err := sql.Exec("SET_JOIN", sql.Args{"pool": pool, "nonce": sql.EncodeBase64(nonce), "host": hostId})
+	core.IsErr(err, "cannot save join request of pool '%s' to db: %v", pool)
+	return err
+}
+
+func sqlDelJoin(pool string) error {
+	_, err := sql.Exec("DEL_JOIN", sql.Args{"pool": pool})
+	core.IsErr(err, "cannot delete join request of pool '%s' from db: %v", pool)
+	return err
+}
+
 func sqlSetSlot(pool, exchange, slot string) error {
 	_, err := sql.Exec("SET_SLOT", sql.Args{"pool": pool, "exchange": exchange, "slot": slot})
 	core.IsErr(err, "cannot save slot %s: %v", slot)
@@ -218,3 +411,90 @@ func sqlListPool() ([]string, error) {
 	}
 	return names, err
 }
+
+func (p *Pool) sqlAddSend(u Upload) error {
+	_, err := sql.Exec("SET_SEND", sql.Args{
+		"pool":    p.Name,
+		"id":      u.Id,
+		"name":    u.Name,
+		"slot":    u.slot,
+		"keyId":   u.keyId,
+		"iv":      sql.EncodeBase64(u.iv),
+		"meta":    sql.EncodeBase64(u.Meta),
+		"modTime": sql.EncodeTime(u.ModTime),
+	})
+	core.IsErr(err, "cannot save upload %d in pool %s: %v", u.Id, p.Name)
+	return err
+}
+
+func scanSend(scan func(dest ...any) error) (Upload, error) {
+	var u Upload
+	var iv, meta string
+	var modTime int64
+	err := scan(&u.Id, &u.Name, &u.slot, &u.keyId, &iv, &meta, &modTime)
+	if err != nil {
+		return Upload{}, err
+	}
+	u.iv = sql.DecodeBase64(iv)
+	u.Meta = sql.DecodeBase64(meta)
+	u.ModTime = sql.DecodeTime(modTime)
+	return u, nil
+}
+
+func (p *Pool) sqlGetSends() ([]Upload, error) {
+	rows, err := sql.Query("GET_SENDS", sql.Args{"pool": p.Name})
+	if core.IsErr(err, "cannot get uploads in pool %s: %v", p.Name) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []Upload
+	for rows.Next() {
+		u, err := scanSend(rows.Scan)
+		if !core.IsErr(err, "cannot read upload from db: %v") {
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads, nil
+}
+
+func (p *Pool) sqlGetSend(id uint64) (Upload, error) {
+	u, err := scanSend(func(dest ...any) error {
+		return sql.QueryRow("GET_SEND", sql.Args{"pool": p.Name, "id": id}, dest...)
+	})
+	core.IsErr(err, "cannot get upload %d in pool %s: %v", id, p.Name)
+	return u, err
+}
+
+func (p *Pool) sqlDelSend(id uint64) error {
+	_, err := sql.Exec("DEL_SEND", sql.Args{"pool": p.Name, "id": id})
+	if core.IsErr(err, "cannot delete upload %d in pool %s: %v", id, p.Name) {
+		return err
+	}
+	_, err = sql.Exec("DEL_SEND_CHECKPOINT", sql.Args{"pool": p.Name, "id": id})
+	core.IsErr(err, "cannot delete checkpoint of upload %d in pool %s: %v", id, p.Name)
+	return err
+}
+
+// sqlGetSendCheckpoint returns the amount of content read by an upload and its hash. The offset is 0 when
+// nothing was read
+func (p *Pool) sqlGetSendCheckpoint(id uint64) (offset int64, hash []byte, err error) {
+	var hash64 string
+	err = sql.QueryRow("GET_SEND_CHECKPOINT", sql.Args{"pool": p.Name, "id": id}, &offset, &hash64)
+	switch err {
+	case nil:
+		return offset, sql.DecodeBase64(hash64), nil
+	case sql.ErrNoRows:
+		return 0, nil, nil
+	default:
+		core.IsErr(err, "cannot get checkpoint of upload %d in pool %s: %v", id, p.Name)
+		return 0, nil, err
+	}
+}
+
+func (p *Pool) sqlSetSendCheckpoint(id uint64, offset int64, hash []byte) error {
+	_, err := sql.Exec("SET_SEND_CHECKPOINT", sql.Args{"pool": p.Name, "id": id, "offset": offset,
+		"hash": sql.EncodeBase64(hash)})
+	core.IsErr(err, "cannot save checkpoint of upload %d in pool %s: %v", id, p.Name)
+	return err
+}
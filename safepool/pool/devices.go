@@ -0,0 +1,79 @@
+package pool
+
+import (
+	"path"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
+)
+
+const DelegationsFolder = "delegations"
+
+// syncDelegations imports the delegations published in the pool and publishes those of the local user, so that
+// members and admins know the devices of each user. A delegation is published by its user or by its device
+func (p *Pool) syncDelegations(e transport.Exchanger) {
+	folder := path.Join(p.Name, DelegationsFolder)
+	published := map[string]bool{}
+	ls, _ := e.ReadDir(folder, 0)
+	for _, l := range ls {
+		var d security.Delegation
+		name := path.Join(folder, l.Name())
+		err := transport.ReadJSON(e, name, &d, nil)
+		if core.IsErr(err, "cannot read delegation '%s': %v", name) || d.DeviceId != l.Name() {
+			continue
+		}
+		// a member of the pool cannot be the device of another member
+		if _, ok, _ := p.sqlGetAccess(d.DeviceId); ok && !d.Revoked {
+			core.IsErr(security.ErrInvalidDelegation, "delegation '%s' names a member as device: %v", name)
+			continue
+		}
+		err = security.SetDelegation(d)
+		if !core.IsErr(err, "invalid delegation '%s': %v", name) {
+			published[d.DeviceId] = d.Revoked
+		}
+	}
+
+	selfId := p.Self.Id()
+	delegations, _ := security.Delegations(security.UserOf(selfId))
+	for _, d := range delegations {
+		if revoked, ok := published[d.DeviceId]; ok && revoked == d.Revoked {
+			continue
+		}
+		if d.UserId != selfId && d.DeviceId != selfId {
+			continue
+		}
+		name := path.Join(folder, d.DeviceId)
+		err := transport.WriteJSON(e, name, d, nil)
+		core.IsErr(err, "cannot publish delegation '%s': %v", name)
+	}
+}
+
+// checkDevices compares the devices in the access file with the delegations of the active members. It returns
+// true when the access file must be exported again and the id of a revoked device that still has the master key
+func (p *Pool) checkDevices() (changed bool, revokedId string) {
+	holders := map[string]bool{}
+	for _, dk := range p.deviceKeys {
+		holders[dk.DeviceId] = true
+		if !security.IsDelegated(dk.DeviceId, dk.UserId) || !p.hasRole(dk.UserId, Reader) {
+			revokedId = dk.DeviceId
+		}
+	}
+
+	_, accesses, err := p.sqlGetAccesses(false)
+	if err != nil {
+		return false, revokedId
+	}
+	for _, a := range accesses {
+		if a.State != Active {
+			continue
+		}
+		delegations, _ := security.Delegations(a.Id)
+		for _, d := range delegations {
+			if !d.Revoked && !holders[d.DeviceId] {
+				changed = true
+			}
+		}
+	}
+	return changed || revokedId != "", revokedId
+}
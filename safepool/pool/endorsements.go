@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"path"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
+)
+
+const EndorsementsFolder = "endorsements"
+
+// syncEndorsements imports the endorsements published in the pool and publishes those of the local identity for
+// the members of the pool. Each identity publishes its endorsements in a file named after its id
+func (p *Pool) syncEndorsements(e transport.Exchanger) {
+	folder := path.Join(p.Name, EndorsementsFolder)
+	selfId := p.Self.Id()
+	published := map[string]security.Endorsement{}
+	ls, _ := e.ReadDir(folder, 0)
+	for _, l := range ls {
+		var endorsements []security.Endorsement
+		name := path.Join(folder, l.Name())
+		err := transport.ReadJSON(e, name, &endorsements, nil)
+		if core.IsErr(err, "cannot read endorsements '%s': %v", name) {
+			continue
+		}
+		for _, en := range endorsements {
+			if en.EndorserId != l.Name() {
+				continue
+			}
+			err = security.SetEndorsement(en)
+			if !core.IsErr(err, "invalid endorsement in '%s': %v", name) && en.EndorserId == selfId {
+				published[en.EndorseeId] = en
+			}
+		}
+	}
+
+	_, accesses, err := p.sqlGetAccesses(false)
+	if core.IsErr(err, "cannot read accesses of pool '%s': %v", p.Name) {
+		return
+	}
+	members := map[string]bool{}
+	for _, a := range accesses {
+		members[a.Id] = true
+	}
+	endorsements, _ := security.EndorsementsBy(selfId)
+	var own []security.Endorsement
+	changed := false
+	for _, en := range endorsements {
+		if !members[en.EndorseeId] {
+			continue
+		}
+		own = append(own, en)
+		if pe, ok := published[en.EndorseeId]; !ok || !pe.Time.Equal(en.Time) {
+			changed = true
+		}
+	}
+	if changed {
+		name := path.Join(folder, selfId)
+		err = transport.WriteJSON(e, name, own, nil)
+		core.IsErr(err, "cannot publish endorsements '%s': %v", name)
+	}
+}
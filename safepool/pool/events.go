@@ -0,0 +1,121 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/sirupsen/logrus"
+)
+
+type EventKind int
+
+const (
+	// KeyRotated is published when the master key of the pool changes. KeyId is the new key
+	KeyRotated EventKind = iota
+	// KeyChanged is published when the keys of a verified identity change. Id is the verified identity
+	KeyChanged
+	// NewFeed is published when a feed from another member is imported. FeedId is the feed and Id its author
+	NewFeed
+	// AccessChanged is published when the accesses of the pool are updated from the access file
+	AccessChanged
+	// ExchangerDown is published when the background sync cannot reach the primary exchanger
+	ExchangerDown
+	// ExchangerUp is published when the primary exchanger is reachable again
+	ExchangerUp
+)
+
+type Event struct {
+	Kind   EventKind
+	Pool   string
+	Time   time.Time
+	KeyId  uint64
+	FeedId uint64
+	// Id is the identity that caused the event, if any
+	Id        string
+	Exchanger string
+}
+
+// EventBuffer is the number of events kept for a subscriber that does not read them. Later events are dropped
+var EventBuffer = 64
+
+type subscribers struct {
+	sync.Mutex
+	chans  map[chan Event]struct{}
+	closed chan struct{}
+}
+
+// init prepares the subscribers of a new pool. The caller holds the lock
+func (s *subscribers) init() {
+	if s.chans == nil {
+		s.chans = map[chan Event]struct{}{}
+		s.closed = make(chan struct{})
+	}
+}
+
+// Subscribe returns a channel that receives the events of the pool until ctx is done or the pool is closed
+func (p *Pool) Subscribe(ctx context.Context) <-chan Event {
+	c := make(chan Event, EventBuffer)
+
+	p.subscribers.Lock()
+	p.subscribers.init()
+	closed := p.subscribers.closed
+	select {
+	case <-closed:
+		close(c)
+		p.subscribers.Unlock()
+		return c
+	default:
+	}
+	p.subscribers.chans[c] = struct{}{}
+	p.subscribers.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-closed:
+		}
+		p.subscribers.Lock()
+		if _, ok := p.subscribers.chans[c]; ok {
+			delete(p.subscribers.chans, c)
+			close(c)
+		}
+		p.subscribers.Unlock()
+	}()
+	return c
+}
+
+// closeSubscribers closes the channels of all the subscribers. It is called when the pool is closed
+func (p *Pool) closeSubscribers() {
+	p.subscribers.Lock()
+	defer p.subscribers.Unlock()
+	p.subscribers.init()
+	select {
+	case <-p.subscribers.closed:
+		return
+	default:
+	}
+	close(p.subscribers.closed)
+	for c := range p.subscribers.chans {
+		delete(p.subscribers.chans, c)
+		close(c)
+	}
+}
+
+func (p *Pool) publish(e Event) {
+	e.Pool = p.Name
+	if e.Time.IsZero() {
+		e.Time = core.Now()
+	}
+
+	p.subscribers.Lock()
+	defer p.subscribers.Unlock()
+	for c := range p.subscribers.chans {
+		select {
+		case c <- e:
+		default:
+			logrus.Warnf("event %d dropped for a slow subscriber of pool %s", e.Kind, p.Name)
+		}
+	}
+}
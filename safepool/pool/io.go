@@ -2,10 +2,12 @@ package pool
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"hash"
 	"io"
 	"path"
-	"time"
 
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/security"
@@ -19,7 +21,8 @@ func (p *Pool) writeFile(name string, r io.Reader) (*security.HashStream, error)
 		return nil, err
 	}
 
-	er, err := security.EncryptingReader(p.masterKeyId, p.keyFunc, hr)
+	masterKeyId, _ := p.currentKey()
+	er, err := security.EncryptingReader(masterKeyId, p.keyFunc, hr)
 	if core.IsErr(err, "cannot create encrypting reader: %v") {
 		return nil, err
 	}
@@ -28,40 +31,216 @@ func (p *Pool) writeFile(name string, r io.Reader) (*security.HashStream, error)
 	return hr, err
 }
 
+// writeFileResumable is like writeFile with a given key and initial value, so that an interrupted write produces
+// the same encrypted content when it is resumed
+func (p *Pool) writeFileResumable(name string, keyId uint64, iv []byte, r io.Reader) (*security.HashStream, error) {
+	hr, err := security.NewHashStream(r, nil)
+	if core.IsErr(err, "cannot create hash reader: %v") {
+		return nil, err
+	}
+
+	er, err := security.EncryptingReaderWithIV(keyId, p.keyFunc, iv, hr)
+	if core.IsErr(err, "cannot create encrypting reader: %v") {
+		return nil, err
+	}
+
+	err = transport.WriteResumable(p.e, name, er)
+	return hr, err
+}
+
 func (p *Pool) readFile(name string, rang *transport.Range, w io.Writer) (*security.HashStream, error) {
 	hw, err := security.NewHashStream(nil, w)
 	if core.IsErr(err, "cannot create hash stream: %v") {
 		return nil, err
 	}
 
-	ew, err := security.DecryptingWriter(p.keyFunc, hw)
+	if rang == nil {
+		ew, err := security.DecryptingWriter(p.keyFunc, hw)
+		if core.IsErr(err, "cannot create decrypting writer: %v") {
+			return nil, err
+		}
+		return hw, readEncrypted(p.e, name, nil, ew)
+	}
+
+	if !transport.HasCapability(p.e, transport.RangeRead) {
+		ew, err := security.DecryptingWriter(p.keyFunc, &rangeWriter{w: hw, rang: *rang})
+		if core.IsErr(err, "cannot create decrypting writer: %v") {
+			return nil, err
+		}
+		return hw, readEncrypted(p.e, name, nil, ew)
+	}
+
+	// the header of the encrypted stream holds the key and the salt required to decrypt the range
+	var header bytes.Buffer
+	err = p.e.Read(name, &transport.Range{From: 0, To: security.MaxEncryptionHeaderSize}, &header)
+	if core.IsErr(err, "cannot read encryption header of %s: %v", name) {
+		return nil, err
+	}
+	from, to, err := security.EncryptedRange(header.Bytes(), rang.From, rang.To)
+	if core.IsErr(err, "invalid encryption header in %s: %v", name) {
+		return nil, err
+	}
+	ew, err := security.DecryptingWriterAt(p.keyFunc, header.Bytes(), rang.From,
+		&rangeWriter{w: hw, rang: transport.Range{From: 0, To: rang.To - rang.From}})
 	if core.IsErr(err, "cannot create decrypting writer: %v") {
 		return nil, err
 	}
-	err = p.e.Read(name, rang, ew)
-	return hw, err
+	return hw, readEncrypted(p.e, name, &transport.Range{From: from, To: to}, ew)
 }
 
-func (p *Pool) readAccessFile(e transport.Exchanger) (AccessFile, hash.Hash, error) {
+// readEncrypted reads name into the decrypting writer ew and completes the decryption
+func readEncrypted(e transport.Exchanger, name string, rang *transport.Range, ew *security.StreamWriter) error {
+	err := e.Read(name, rang, ew)
+	if err != nil {
+		return err
+	}
+	err = ew.Close()
+	core.IsErr(err, "cannot decrypt %s: %v", name)
+	return err
+}
+
+// rangeWriter forwards to w only the bytes included in rang. It is used when the exchanger cannot read a range
+type rangeWriter struct {
+	w    io.Writer
+	rang transport.Range
+	pos  int64
+}
+
+func (r *rangeWriter) Write(p []byte) (n int, err error) {
+	from, to := r.rang.From-r.pos, r.rang.To-r.pos
+	r.pos += int64(len(p))
+
+	if from < 0 {
+		from = 0
+	}
+	if to > int64(len(p)) {
+		to = int64(len(p))
+	}
+	if from < to {
+		_, err = r.w.Write(p[from:to])
+	}
+	return len(p), err
+}
+
+// signedAccessFile is the access file as stored in the pool. The content and its signatures are in the same object,
+// so that a reader never pairs the content of a version with the signatures of another
+type signedAccessFile struct {
+	Access    json.RawMessage
+	Signature security.SignedHash
+}
+
+// readSignedAccessFile returns the access file of the pool, its hash and its signatures. An access file written
+// before the signatures were embedded has them in .access.sign
+func readSignedAccessFile(e transport.Exchanger, pool string) (AccessFile, hash.Hash, signedAccessFile, error) {
 	var a AccessFile
-	var sh security.SignedHash
-	signatureFile := path.Join(p.Name, ".access.sign")
+	var sa signedAccessFile
+	accessFile := path.Join(pool, ".access")
+
+	data, err := transport.ReadFile(e, accessFile)
+	if err != nil {
+		return AccessFile{}, nil, sa, err
+	}
+	err = json.Unmarshal(data, &sa)
+	if core.IsErr(err, "cannot read access file of pool '%s': %v", pool) {
+		return AccessFile{}, nil, sa, err
+	}
+	if sa.Access == nil {
+		signatureFile := path.Join(pool, ".access.sign")
+		sa.Access = data
+		err = transport.ReadJSON(e, signatureFile, &sa.Signature, nil)
+		if core.IsErr(err, "cannot read signature file '%s': %v", signatureFile) {
+			return AccessFile{}, nil, sa, err
+		}
+	}
+
+	err = json.Unmarshal(sa.Access, &a)
+	if core.IsErr(err, "cannot read access file of pool '%s': %v", pool) {
+		return AccessFile{}, nil, sa, err
+	}
+	h := security.NewHash()
+	h.Write(sa.Access)
+	return a, h, sa, nil
+}
+
+// putAccessFile writes sa when the access file has not changed since the last read and keeps the new tag
+func (p *Pool) putAccessFile(e transport.Exchanger, sa signedAccessFile) error {
 	accessFile := path.Join(p.Name, ".access")
+	data, err := json.Marshal(sa)
+	if core.IsErr(err, "cannot marshal access file on %s: %v", p.Name) {
+		return err
+	}
+
+	err = transport.WriteIfMatch(e, accessFile, p.getAccessTag(e), bytes.NewReader(data))
+	if errors.Is(err, core.ErrPreconditionFailed) {
+		core.IsErr(ErrAccessConflict, "cannot write access file on %s: %v", p.Name)
+		return ErrAccessConflict
+	}
+	if core.IsErr(err, "cannot write access file on %s: %v", p.Name) {
+		return err
+	}
+
+	tag, err := transport.ETag(e, accessFile)
+	if !core.IsErr(err, "cannot read tag of access file on %s: %v", p.Name) {
+		p.setAccessTag(e, tag)
+	}
+	return nil
+}
 
-	err := transport.ReadJSON(e, signatureFile, &sh, nil)
-	if core.IsErr(err, "cannot read signature file '%s': %v", signatureFile, err) {
+func (p *Pool) readAccessFile(e transport.Exchanger) (AccessFile, hash.Hash, error) {
+	accessFile := path.Join(p.Name, ".access")
+	tag, err := transport.ETag(e, accessFile)
+	if core.IsErr(err, "cannot read tag of access file: %v") {
 		return AccessFile{}, nil, err
 	}
 
-	h := security.NewHash()
-	err = transport.ReadJSON(e, accessFile, &a, h)
+	a, h, sa, err := readSignedAccessFile(e, p.Name)
 	if core.IsErr(err, "cannot read access file: %s", err) {
 		return AccessFile{}, nil, err
 	}
+	sh := sa.Signature
+	p.setAccessTag(e, tag)
+	migrateRoles(&a, sh, h.Sum(nil))
+
+	// the admins known locally decide who can change the accesses. A pool seen for the first time trusts the
+	// host of the token used to join, when it is an admin in the access file, or else the admins in the file
+	_, accesses, err := p.sqlGetAccesses(false)
+	if core.IsErr(err, "cannot read accesses of pool '%s': %v", p.Name) {
+		return AccessFile{}, nil, err
+	}
+	signers := admins(accesses)
+	if len(signers) == 0 {
+		var listed []Access
+		for _, ak := range a.AccessKeys {
+			listed = append(listed, ak.Access)
+		}
+		signers = admins(listed)
+		if hostId, ok := sqlGetTokenHost(p.Name); ok {
+			var host []security.Identity
+			for _, i := range signers {
+				if i.Id() == hostId {
+					host = append(host, i)
+				}
+			}
+			signers = host
+		}
+	}
+	if !security.VerifySignedHash(sh, signers, h.Sum(nil)) {
+		core.IsErr(ErrNotAdmin, "access file of pool '%s' is not signed by an admin: %v", p.Name)
+		return AccessFile{}, nil, ErrNotAdmin
+	}
 
-	trusted, err := security.Trusted()
-	if core.IsErr(err, "cannot get trusted identities: %v") {
-		return AccessFile{}, nil, nil
+	// the signers are trusted according to the trust policy, which includes the identities endorsed by others
+	levels, err := security.TrustLevels()
+	if core.IsErr(err, "cannot get trust levels: %v") {
+		return AccessFile{}, nil, err
+	}
+	var trusted []security.Identity
+	for id := range sh.Signatures {
+		if levels[id] > 0 {
+			if i, err := security.IdentityFromId(id); err == nil {
+				trusted = append(trusted, i)
+			}
+		}
 	}
 
 	if security.VerifySignedHash(sh, []security.Identity{p.Self}, h.Sum(nil)) {
@@ -70,12 +249,9 @@ func (p *Pool) readAccessFile(e transport.Exchanger) (AccessFile, hash.Hash, err
 	}
 
 	if security.VerifySignedHash(sh, trusted, h.Sum(nil)) {
-		_ = security.AppendToSignedHash(sh, p.Self)
-		if !core.IsErr(err, "cannot lock access on %s: %v", p.Name, err) {
-			if security.AppendToSignedHash(sh, p.Self) == nil {
-				err = transport.WriteJSON(e, signatureFile, sh, nil)
-				core.IsErr(err, "cannot write signature file on %s: %v", p.Name, err)
-			}
+		if security.AppendToSignedHash(sh, p.Self) == nil {
+			err = p.putAccessFile(e, sa)
+			core.IsErr(err, "cannot sign access file on %s: %v", p.Name)
 		}
 		p.Trusted = true
 	}
@@ -83,35 +259,53 @@ func (p *Pool) readAccessFile(e transport.Exchanger) (AccessFile, hash.Hash, err
 	return a, h, nil
 }
 
-func (p *Pool) writeAccessFile(e transport.Exchanger, a AccessFile) (hash.Hash, error) {
-	lockFile := path.Join(p.Name, ".access.lock")
-	signatureFile := path.Join(p.Name, ".access.sign")
-	accessFile := path.Join(p.Name, ".access")
-
-	lockId, err := transport.LockFile(e, lockFile, time.Minute)
-	if core.IsErr(err, "cannot lock access on %s: %v", p.Name, err) {
+// writeAccessFile writes the access file only when it has not changed since the last read, so that a concurrent
+// update is never overwritten. lease is the access lock held by the caller
+func (p *Pool) writeAccessFile(e transport.Exchanger, a AccessFile, lease *transport.Lease) (hash.Hash, error) {
+	err := lease.Err()
+	if core.IsErr(err, "lost access lock on %s: %v", p.Name) {
 		return nil, err
 	}
-	defer transport.UnlockFile(e, lockFile, lockId)
 
-	h := security.NewHash()
-	err = transport.WriteJSON(e, accessFile, a, h)
-	if core.IsErr(err, "cannot write access file on %s: %v", p.Name, err) {
+	data, err := json.Marshal(a)
+	if core.IsErr(err, "cannot marshal access file on %s: %v", p.Name, err) {
 		return nil, err
 	}
+	h := security.NewHash()
+	h.Write(data)
 
 	sh, err := security.NewSignedHash(h.Sum(nil), p.Self)
 	if core.IsErr(err, "cannot generate signature hash on %s: %v", p.Name, err) {
 		return nil, err
 	}
-	err = transport.WriteJSON(e, signatureFile, sh, nil)
-	if core.IsErr(err, "cannot write signature file on %s: %v", p.Name, err) {
+	err = p.putAccessFile(e, signedAccessFile{Access: data, Signature: sh})
+	if err != nil {
 		return nil, err
 	}
 
+	// the signatures of a legacy access file are now in the access file
+	signatureFile := path.Join(p.Name, ".access.sign")
+	if _, err := e.Stat(signatureFile); err == nil {
+		core.IsErr(e.Delete(signatureFile), "cannot delete signature file on %s: %v", p.Name)
+	}
 	return h, nil
 }
 
+func (p *Pool) getAccessTag(e transport.Exchanger) string {
+	p.accessTagsLock.Lock()
+	defer p.accessTagsLock.Unlock()
+	return p.accessTags[e.String()]
+}
+
+func (p *Pool) setAccessTag(e transport.Exchanger, tag string) {
+	p.accessTagsLock.Lock()
+	defer p.accessTagsLock.Unlock()
+	if p.accessTags == nil {
+		p.accessTags = map[string]string{}
+	}
+	p.accessTags[e.String()] = tag
+}
+
 func (p *Pool) writeIdentity(name string, identity security.Identity) error {
 	data, err := yaml.Marshal(p.Self.Public())
 	if core.IsErr(err, "cannot marshal identity: %v") {
@@ -139,7 +333,7 @@ func (p *Pool) readIdentity(name string) (security.Identity, error) {
 		return identity, err
 	}
 
-	parts := bytes.Split(buf.Bytes(), []byte{0})
+	parts := bytes.SplitN(buf.Bytes(), []byte{0}, 2)
 	if len(parts) != 2 {
 		core.IsErr(ErrInvalidSignature, "identity file '%s' has no null separator: %v", name)
 		return identity, ErrInvalidSignature
@@ -157,14 +351,17 @@ func (p *Pool) readIdentity(name string) (security.Identity, error) {
 	return identity, nil
 }
 
-func (p *Pool) lockAccessFile(e transport.Exchanger) (uint64, error) {
+func (p *Pool) lockAccessFile(e transport.Exchanger) (*transport.Lease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), AccessLockTimeout)
+	defer cancel()
+
 	lockFile := path.Join(p.Name, ".access.lock")
-	lockId, err := transport.LockFile(e, lockFile, time.Minute)
+	lease, err := transport.AcquireLease(ctx, e, lockFile, p.Self.Id(), AccessLeaseSpan)
 	core.IsErr(err, "cannot lock access on %s: %v", p.Name, err)
-	return lockId, err
+	return lease, err
 }
 
-func (p *Pool) unlockAccessFile(e transport.Exchanger, lockId uint64) {
-	lockFile := path.Join(p.Name, ".access.lock")
-	transport.UnlockFile(e, lockFile, lockId)
+func (p *Pool) unlockAccessFile(lease *transport.Lease) {
+	err := lease.Release()
+	core.IsErr(err, "cannot unlock access on %s: %v", p.Name)
 }
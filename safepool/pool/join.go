@@ -0,0 +1,310 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
+)
+
+const JoinsFolder = "joins"
+
+var ErrJoinPending = errors.New("the join request has not been approved yet")
+var ErrJoinRejected = errors.New("the join request has been rejected")
+var ErrNoJoin = errors.New("no pending join request")
+
+// JoinRequest is the request of a guest to join the pool with a universal token
+type JoinRequest struct {
+	Guest security.Identity
+	Token Token
+	Time  time.Time
+}
+
+// joinFile is a join request as stored in the pool, encrypted for each admin, see joinEnvelope
+type joinFile struct {
+	Guest     security.Identity
+	Token     string
+	Time      time.Time
+	Signature []byte
+}
+
+func (j joinFile) data() []byte {
+	return append([]byte(j.Token), []byte(j.Time.UTC().Format(time.RFC3339Nano))...)
+}
+
+// joinEnvelope holds a join request encrypted for each admin of the pool, indexed by the id of the admin. The host
+// of the token is always included, so the request can be answered by any admin at the time of the request
+type joinEnvelope map[string][]byte
+
+// joinAnswer is the decision of an admin on a join request
+type joinAnswer struct {
+	GuestId   string
+	Approved  bool
+	AuthorId  string
+	Time      time.Time
+	Signature []byte
+}
+
+func (a joinAnswer) data(nonce []byte) []byte {
+	data := append(append([]byte{}, nonce...), []byte(a.GuestId)...)
+	if a.Approved {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// joinName returns the name of the join request of a guest, or of its answer. A universal token is used by several
+// guests, so the name includes the guest
+func joinName(pool string, nonce []byte, guestId string, ext string) string {
+	return path.Join(pool, JoinsFolder, hex.EncodeToString(nonce)+"."+guestId+ext)
+}
+
+// connectToken returns a pool connected to the exchanges of the token, which the guest can use before being
+// a member
+func connectToken(guest security.Identity, t Token) (*Pool, error) {
+	p := &Pool{Name: t.Config.Name, Self: guest, config: t.Config}
+	err := p.connectSafe(t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RequestJoin asks the admins of the pool to let guest in. The token must be universal and accepted with
+// AcceptToken. The outcome is reported by Open
+func RequestJoin(guest security.Identity, t Token) error {
+	if !t.universal() {
+		core.IsErr(ErrInvalidToken, "a join request requires a universal token: %v")
+		return ErrInvalidToken
+	}
+	p, err := connectToken(guest, t)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	j := joinFile{Guest: guest.Public(), Token: t.raw, Time: core.Now()}
+	j.Signature, err = security.Sign(guest, j.data())
+	if core.IsErr(err, "cannot sign join request: %v") {
+		return err
+	}
+	data, err := json.Marshal(j)
+	if core.IsErr(err, "cannot marshal join request: %v") {
+		return err
+	}
+	identities, err := p.tokenAdmins(t.Host.Id())
+	if err != nil {
+		return err
+	}
+	envelope := joinEnvelope{}
+	for _, i := range append(identities, t.Host) {
+		envelope[i.Id()], err = security.EcEncrypt(i, data)
+		if core.IsErr(err, "cannot encrypt join request for admin '%s': %v", i.Id()) {
+			return err
+		}
+	}
+	data, err = json.Marshal(envelope)
+	if core.IsErr(err, "cannot marshal join request: %v") {
+		return err
+	}
+
+	// a request that is already there is a retry of the same guest
+	err = transport.WriteIfMatch(p.e, joinName(p.Name, t.Nonce, guest.Id(), ".join"), "", bytes.NewReader(data))
+	if !errors.Is(err, core.ErrPreconditionFailed) && core.IsErr(err, "cannot write join request to pool '%s': %v", p.Name) {
+		return err
+	}
+	return sqlSetJoin(p.Name, t.Nonce, t.Host.Id())
+}
+
+// checkJoin returns the outcome of the join request of the local identity, if any. syncErr is the result of the
+// sync on Open
+func (p *Pool) checkJoin(syncErr error) error {
+	nonce, hostId, ok := sqlGetJoin(p.Name)
+	switch {
+	case !ok:
+		return syncErr
+	case syncErr == nil:
+		_ = sqlDelJoin(p.Name)
+		return nil
+	case syncErr != ErrNotAuthorized:
+		return syncErr
+	}
+
+	var a joinAnswer
+	err := transport.ReadJSON(p.e, joinName(p.Name, nonce, p.Self.Id(), ".answer"), &a, nil)
+	if err != nil {
+		return ErrJoinPending
+	}
+	if a.GuestId != p.Self.Id() || !security.Verify(a.AuthorId, a.data(nonce), a.Signature) ||
+		!p.isTokenAdmin(hostId, a.AuthorId) {
+		core.IsErr(ErrInvalidSignature, "invalid answer to join request on pool '%s': %v", p.Name)
+		return ErrJoinPending
+	}
+	if a.Approved {
+		// the access file is exported before the answer is written, so the answer is just arrived
+		return ErrJoinPending
+	}
+	return ErrJoinRejected
+}
+
+// isTokenAdmin returns true when id is the host of the token or one of the admins seen by the guest
+func (p *Pool) isTokenAdmin(hostId string, id string) bool {
+	if id == hostId {
+		return true
+	}
+	identities, err := p.tokenAdmins(hostId)
+	if err != nil {
+		return false
+	}
+	for _, i := range identities {
+		if i.Id() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// readJoin returns the join request stored in name after checking the guest signature and the token
+func (p *Pool) readJoin(name string) (JoinRequest, error) {
+	var envelope joinEnvelope
+	err := transport.ReadJSON(p.e, name, &envelope, nil)
+	if core.IsErr(err, "corrupted join request '%s': %v", name) {
+		return JoinRequest{}, err
+	}
+	data, ok := envelope[p.Self.Id()]
+	if !ok {
+		// the admin was added after the request
+		return JoinRequest{}, ErrNoJoin
+	}
+	data, err = security.EcDecrypt(p.Self, data)
+	if core.IsErr(err, "cannot decrypt join request '%s': %v", name) {
+		return JoinRequest{}, err
+	}
+
+	var j joinFile
+	err = json.Unmarshal(data, &j)
+	if core.IsErr(err, "corrupted join request '%s': %v", name) {
+		return JoinRequest{}, err
+	}
+	if !security.Verify(j.Guest.Id(), j.data(), j.Signature) {
+		core.IsErr(ErrInvalidSignature, "join request '%s': %v", name)
+		return JoinRequest{}, ErrInvalidSignature
+	}
+	t, err := parseToken(p.Self, j.Token)
+	if err != nil {
+		return JoinRequest{}, err
+	}
+	if t.Config.Name != p.Name || joinName(p.Name, t.Nonce, j.Guest.Id(), ".join") != name ||
+		!p.hasRole(t.Host.Id(), Admin) || !j.Time.Before(t.Expires) {
+		core.IsErr(ErrInvalidToken, "join request '%s': %v", name)
+		return JoinRequest{}, ErrInvalidToken
+	}
+
+	return JoinRequest{Guest: j.Guest, Token: t, Time: j.Time}, nil
+}
+
+// PendingJoins returns the join requests that the local identity can approve
+func (p *Pool) PendingJoins() ([]JoinRequest, error) {
+	if !p.hasRole(p.Self.Id(), Admin) {
+		return nil, ErrNotAdmin
+	}
+
+	ls, err := p.e.ReadDir(path.Join(p.Name, JoinsFolder), 0)
+	if err != nil {
+		return nil, nil
+	}
+	answered := map[string]bool{}
+	for _, l := range ls {
+		if strings.HasSuffix(l.Name(), ".answer") {
+			answered[strings.TrimSuffix(l.Name(), ".answer")] = true
+		}
+	}
+
+	var joins []JoinRequest
+	for _, l := range ls {
+		id := strings.TrimSuffix(l.Name(), ".join")
+		if id == l.Name() || answered[id] {
+			continue
+		}
+		j, err := p.readJoin(path.Join(p.Name, JoinsFolder, l.Name()))
+		if err == nil {
+			joins = append(joins, j)
+		}
+	}
+	return joins, nil
+}
+
+// Approve grants the access to the guest of a pending join request with the role offered by the token, or
+// the Writer role when the token has none
+func (p *Pool) Approve(guestId string) error {
+	j, err := p.pendingJoin(guestId)
+	if err != nil {
+		return err
+	}
+
+	role := Writer
+	if j.Token.Role != nil {
+		role = *j.Token.Role
+	}
+	err = security.SetIdentity(j.Guest)
+	if core.IsErr(err, "cannot save identity '%s' to db: %v", guestId) {
+		return err
+	}
+	access := Access{Id: guestId, State: Active, Role: role}
+	p.stateLock.Lock()
+	err = p.setAccess(access, AccessEntry{Change: Grant, Id: guestId, Role: role})
+	p.stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return p.answerJoin(j, true)
+}
+
+// Reject refuses a pending join request
+func (p *Pool) Reject(guestId string) error {
+	j, err := p.pendingJoin(guestId)
+	if err != nil {
+		return err
+	}
+	return p.answerJoin(j, false)
+}
+
+func (p *Pool) pendingJoin(guestId string) (JoinRequest, error) {
+	joins, err := p.PendingJoins()
+	if err != nil {
+		return JoinRequest{}, err
+	}
+	for _, j := range joins {
+		if j.Guest.Id() == guestId {
+			return j, nil
+		}
+	}
+	return JoinRequest{}, ErrNoJoin
+}
+
+func (p *Pool) answerJoin(j JoinRequest, approved bool) error {
+	a := joinAnswer{GuestId: j.Guest.Id(), Approved: approved, AuthorId: p.Self.Id(), Time: core.Now()}
+	var err error
+	a.Signature, err = security.Sign(p.Self, a.data(j.Token.Nonce))
+	if core.IsErr(err, "cannot sign join answer: %v") {
+		return err
+	}
+	data, err := json.Marshal(a)
+	if core.IsErr(err, "cannot marshal join answer: %v") {
+		return err
+	}
+	err = transport.WriteIfMatch(p.e, joinName(p.Name, j.Token.Nonce, j.Guest.Id(), ".answer"), "", bytes.NewReader(data))
+	if errors.Is(err, core.ErrPreconditionFailed) {
+		core.IsErr(ErrNoJoin, "join request already answered: %v")
+		return ErrNoJoin
+	}
+	core.IsErr(err, "cannot write join answer to pool '%s': %v", p.Name)
+	return err
+}
@@ -2,7 +2,9 @@ package pool
 
 import (
 	"crypto/aes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -14,16 +16,39 @@ import (
 
 type Keystore map[uint64][]byte
 
+var ErrKeystoreDowngrade = errors.New("access file is older than the version already seen for the pool")
+
 var cachedEncKeys = cache.New(time.Hour, 10*time.Hour)
 
-func (p *Pool) decodeKeystore(keystore []byte, nonce []byte) (Keystore, error) {
-	masterKey := p.keyFunc(p.masterKeyId)
+// decodeKeystore decrypts the keystore in the access file and stores its keys in the DB. Access files before
+// AccessFileVersion hold a keystore encrypted with AES-CBC; they are refused once a later version has been seen
+// for the pool, so that the keystore cannot be downgraded
+func (p *Pool) decodeKeystore(a AccessFile) (Keystore, error) {
+	masterKey := p.keyFunc(a.MasterKeyId)
 	if masterKey == nil {
-		core.IsErr(ErrNotAuthorized, "No encryption key for id '%d': %v", p.masterKeyId)
+		core.IsErr(ErrNotAuthorized, "No encryption key for id '%d': %v", a.MasterKeyId)
 		return nil, ErrNotAuthorized
 	}
 
-	ks, err := p.unmarshalKeystore(masterKey, nonce, keystore)
+	var data []byte
+	var err error
+	seen := sqlGetKeystoreVersion(p.Name)
+	switch {
+	case a.Version > AccessFileVersion:
+		err = core.ErrInvalidVersion
+	case a.Version < seen:
+		err = ErrKeystoreDowngrade
+	case a.Version < AccessFileVersion:
+		data, err = security.DecryptBlock(masterKey, a.Nonce, a.Keystore)
+	default:
+		data, err = security.OpenBlock(masterKey, a.Nonce, a.Keystore, p.keystoreAD(a.MasterKeyId))
+	}
+	if core.IsErr(err, "invalid key or corrupted keystore in pool '%s': %v", p.Name) {
+		return nil, err
+	}
+
+	var ks Keystore
+	err = json.Unmarshal(data, &ks)
 	if core.IsErr(err, "cannot unmarshal keystore for pool '%s': %v", p.Name) {
 		return nil, err
 	}
@@ -34,6 +59,12 @@ func (p *Pool) decodeKeystore(keystore []byte, nonce []byte) (Keystore, error) {
 			return nil, err
 		}
 	}
+	if a.Version > seen {
+		err = sqlSetKeystoreVersion(p.Name, a.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return ks, nil
 }
 
@@ -43,36 +74,49 @@ func (p *Pool) encodeKeystore() (keystore []byte, noonce []byte, err error) {
 		return nil, nil, err
 	}
 
+	data, err := json.Marshal(ks)
+	if core.IsErr(err, "cannot marshal keystore: %v") {
+		return nil, nil, err
+	}
+
 	noonce = security.GenerateBytesKey(aes.BlockSize)
-	keystore, err = p.marshalKeystore(p.masterKey, noonce, ks)
-	if core.IsErr(err, "cannot marshal keystore for pool '%s': %v", p.Name) {
+	keystore, err = security.SealBlock(p.masterKey, noonce, data, p.keystoreAD(p.masterKeyId))
+	if core.IsErr(err, "cannot encrypt keystore for pool '%s': %v", p.Name) {
 		return nil, nil, err
 	}
+	if sqlGetKeystoreVersion(p.Name) < AccessFileVersion {
+		err = sqlSetKeystoreVersion(p.Name, AccessFileVersion)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	return keystore, noonce, nil
 }
 
-func (p *Pool) marshalKeystore(masterKey []byte, nonce []byte, ks Keystore) ([]byte, error) {
-	data, err := json.Marshal(ks)
-	if core.IsErr(err, "cannot marshal keystore: %v") {
-		return nil, err
-	}
-	return security.EncryptBlock(masterKey, nonce, data)
+// keystoreAD binds the keystore to the pool and to the master key, so that it cannot be replaced with the
+// keystore of another pool or of a previous master key
+func (p *Pool) keystoreAD(masterKeyId uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(p.Name), masterKeyId)
 }
 
-func (p *Pool) unmarshalKeystore(masterKey []byte, nonce []byte, cipherdata []byte) (Keystore, error) {
-	data, err := security.DecryptBlock(masterKey, nonce, cipherdata)
-	if core.IsErr(err, "invalid key or corrupted keystore: %v") {
-		return nil, err
-	}
+// setMasterKey changes the current master key. The caller must hold stateLock, so that the access state can
+// read the key without keyLock
+func (p *Pool) setMasterKey(id uint64, key []byte) {
+	p.keyLock.Lock()
+	defer p.keyLock.Unlock()
+	p.masterKeyId, p.masterKey = id, key
+}
 
-	var ks Keystore
-	err = json.Unmarshal(data, &ks)
-	return ks, err
+// currentKey returns the id and the value of the current master key. Use it outside stateLock, e.g. when sending
+func (p *Pool) currentKey() (uint64, []byte) {
+	p.keyLock.RLock()
+	defer p.keyLock.RUnlock()
+	return p.masterKeyId, p.masterKey
 }
 
 func (p *Pool) keyFunc(id uint64) []byte {
-	if id == p.masterKeyId {
-		return p.masterKey
+	if masterKeyId, masterKey := p.currentKey(); id == masterKeyId {
+		return masterKey
 	}
 
 	k := fmt.Sprintf("%s-%d", p.Name, id)
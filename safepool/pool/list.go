@@ -29,7 +29,14 @@ func (p *Pool) readHead(name string) (Feed, error) {
 		return Feed{}, err
 	}
 
-	if !security.Verify(h.AuthorId, h.Hash, h.Signature) {
+	signer := h.AuthorId
+	if h.DeviceId != "" {
+		if !security.IsDelegated(h.DeviceId, h.AuthorId) {
+			return Feed{}, ErrNotAuthorized
+		}
+		signer = h.DeviceId
+	}
+	if !security.Verify(signer, feedSignedData(h), h.Signature) {
 		return Feed{}, ErrNoExchange
 	}
 
@@ -0,0 +1,198 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/code-to-go/safe/safepool/algo"
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/transport"
+)
+
+// MerkleSplitBits sets the average size of the blocks verified by a range read to 2^MerkleSplitBits bytes
+var MerkleSplitBits uint = 16
+
+// merkleSplitter computes the leaves of the Merkle tree of the data written to it
+type merkleSplitter struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	blocks []algo.HashBlock
+	err    error
+}
+
+func newMerkleSplitter() *merkleSplitter {
+	pr, pw := io.Pipe()
+	m := &merkleSplitter{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(m.done)
+		m.err = algo.HashSplitWith(pr, MerkleSplitBits, nil, func(block algo.HashBlock, data []byte) error {
+			m.blocks = append(m.blocks, algo.MerkleLeaf(data))
+			return nil
+		})
+		pr.CloseWithError(m.err)
+	}()
+	return m
+}
+
+func (m *merkleSplitter) Write(p []byte) (int, error) {
+	return m.pw.Write(p)
+}
+
+// leaves ends the split and returns the leaves
+func (m *merkleSplitter) leaves() ([]algo.HashBlock, error) {
+	m.pw.Close()
+	<-m.done
+	return m.blocks, m.err
+}
+
+func (p *Pool) treeName(id uint64, slot string) string {
+	return path.Join(p.Name, FeedsFolder, slot, fmt.Sprintf("%d.tree", id))
+}
+
+// feedSignedData returns the content signed by the author of a feed
+func feedSignedData(f Feed) []byte {
+	if len(f.MerkleRoot) == 0 {
+		return f.Hash
+	}
+	return append(append([]byte{}, f.Hash...), f.MerkleRoot...)
+}
+
+func (p *Pool) writeTree(name string, tree algo.MerkleTree) error {
+	data, err := json.Marshal(tree)
+	if core.IsErr(err, "cannot marshal merkle tree: %v") {
+		return err
+	}
+	_, err = p.writeFile(name, bytes.NewReader(data))
+	core.IsErr(err, "cannot write merkle tree %s: %v", name)
+	return err
+}
+
+func (p *Pool) readTree(name string) (algo.MerkleTree, error) {
+	var b bytes.Buffer
+	_, err := p.readFile(name, nil, &b)
+	if core.IsErr(err, "cannot read merkle tree %s: %v", name) {
+		return algo.MerkleTree{}, err
+	}
+
+	var tree algo.MerkleTree
+	err = json.Unmarshal(b.Bytes(), &tree)
+	if core.IsErr(err, "corrupted merkle tree %s: %v", name) {
+		return algo.MerkleTree{}, err
+	}
+	return tree, nil
+}
+
+// receiveRange writes to w the range of the feed. Only the blocks that overlap the range are downloaded and each
+// of them is verified against the Merkle root signed by the author. Feeds without a root are downloaded in full
+// and verified with their hash
+func (p *Pool) receiveRange(f Feed, rang *transport.Range, w io.Writer) error {
+	if len(f.MerkleRoot) == 0 {
+		hr, err := p.readBody(f, nil, &rangeWriter{w: w, rang: *rang})
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hr.Hash(), f.Hash) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	tree, err := p.readTree(p.treeName(f.Id, f.Slot))
+	if err != nil {
+		return err
+	}
+	if len(tree.Blocks) != algo.MerkleTreeSize(tree.Leaves) {
+		core.IsErr(ErrInvalidSignature, "invalid merkle tree for feed %d: %v", f.Id)
+		return ErrInvalidSignature
+	}
+
+	first, last := -1, -1
+	var start, end, offset int64
+	for i := 0; i < tree.Leaves; i++ {
+		from, to := offset, offset+int64(tree.Blocks[i].Length)
+		offset = to
+		if to <= rang.From || from >= rang.To {
+			continue
+		}
+		if first == -1 {
+			first, start = i, from
+		}
+		last, end = i, to
+	}
+	if first == -1 {
+		return nil
+	}
+
+	mw := &merkleWriter{
+		tree: tree,
+		root: f.MerkleRoot,
+		leaf: first,
+		w:    &rangeWriter{w: w, rang: transport.Range{From: rang.From - start, To: rang.To - start}},
+	}
+	if len(f.Chunks) > 0 {
+		if len(f.Chunks) != tree.Leaves {
+			return ErrInvalidSignature
+		}
+		chunks := f
+		chunks.Chunks = f.Chunks[first : last+1]
+		_, err = p.readChunks(chunks, nil, mw)
+	} else {
+		_, err = p.readFile(p.bodyName(f.Id, f.Slot), &transport.Range{From: start, To: end}, mw)
+	}
+	if err != nil {
+		return err
+	}
+	if mw.leaf != last+1 {
+		core.IsErr(ErrInvalidSignature, "incomplete range in feed %d: %v", f.Id)
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// merkleWriter verifies the content written to it one leaf at a time, starting from leaf, and forwards to w
+// only the verified leaves
+type merkleWriter struct {
+	tree algo.MerkleTree
+	root []byte
+	leaf int
+	buf  []byte
+	w    io.Writer
+}
+
+func (m *merkleWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if m.leaf >= m.tree.Leaves {
+			return 0, ErrInvalidSignature
+		}
+		block := m.tree.Blocks[m.leaf]
+		c := int(block.Length) - len(m.buf)
+		if c > len(p) {
+			c = len(p)
+		}
+		m.buf = append(m.buf, p[0:c]...)
+		p = p[c:]
+		if len(m.buf) < int(block.Length) {
+			break
+		}
+
+		if !bytes.Equal(algo.MerkleLeaf(m.buf).Hash, block.Hash) ||
+			!algo.VerifyMerkleProof(m.root, block.Hash, algo.MerkleTreeProof(m.tree, m.leaf)) {
+			core.IsErr(ErrInvalidSignature, "block %d does not match the merkle root: %v", m.leaf)
+			return 0, ErrInvalidSignature
+		}
+		_, err := m.w.Write(m.buf)
+		if err != nil {
+			return 0, err
+		}
+		m.buf = m.buf[:0]
+		m.leaf++
+	}
+	return n, nil
+}
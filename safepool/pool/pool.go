@@ -11,11 +11,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/code-to-go/safe/safepool/algo"
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/security"
 	"github.com/code-to-go/safe/safepool/transport"
-
-	"github.com/godruoyi/go-snowflake"
 )
 
 const SafeConfigFile = ".safepool-pool.json"
@@ -28,6 +27,8 @@ var ErrAlreadyExist = errors.New("pool already exists")
 var ErrInvalidToken = errors.New("provided token is invalid: missing name or configs")
 var ErrInvalidId = errors.New("provided id not a valid ed25519 public key")
 var ErrInvalidConfig = errors.New("provided config is invalid: missing name or configs")
+var ErrAccessConflict = errors.New("access file has been changed concurrently")
+var ErrNotAdmin = errors.New("the admin role is required")
 
 type Consumer interface {
 	TimeOffset(s *Pool) time.Time
@@ -46,10 +47,18 @@ type Pool struct {
 	masterKey        []byte
 	lastHouseKeeping time.Time
 	accessHash       []byte
+	accessTags       map[string]string
+	accessTagsLock   sync.Mutex
 	config           Config
-	// houseKeeping     *time.Ticker
 	houseKeepingLock sync.Mutex
-	// stopHouseKeeping chan bool
+	// stateLock serializes the syncs and the changes to the accesses, the master key and the device keys
+	stateLock     sync.Mutex
+	keyLock       sync.RWMutex
+	service       *syncService
+	serviceLock   sync.Mutex
+	exchangerDown bool
+	subscribers   subscribers
+	deviceKeys    []DeviceKey
 }
 
 type Identity struct {
@@ -69,8 +78,14 @@ type Feed struct {
 	AuthorId  string
 	Signature []byte
 	Meta      []byte
-	Offset    int    `json:"-"`
-	Slot      string `json:"-"`
+	// Chunks lists the content of a feed in the chunked format. It is empty when the body is a single file
+	Chunks []algo.HashBlock `json:",omitempty"`
+	// MerkleRoot is the root of the Merkle tree of the content, used to verify a range read
+	MerkleRoot []byte `json:",omitempty"`
+	// DeviceId is the device that signed the feed on behalf of the author, if any
+	DeviceId string `json:",omitempty"`
+	Offset   int    `json:"-"`
+	Slot     string `json:"-"`
 }
 
 const (
@@ -83,6 +98,12 @@ var ReplicaPeriod = time.Hour
 var CacheSizeMB = 16
 var FeedDateFormat = "20060102"
 
+// AccessLockTimeout is the longest wait for the lock on the access file
+var AccessLockTimeout = 2 * time.Minute
+
+// AccessLeaseSpan is how long the lock on the access file survives a holder that stops renewing it
+var AccessLeaseSpan = time.Minute
+
 type Config struct {
 	Name    string
 	Public  []string
@@ -111,10 +132,8 @@ func Create(self security.Identity, name string, apps []string) (*Pool, error) {
 		return nil, err
 	}
 
-	p.masterKeyId = snowflake.ID()
-	p.masterKey = security.GenerateBytesKey(32)
-	err = p.sqlSetKey(p.masterKeyId, p.masterKey)
-	if core.IsErr(err, "çannot store master encryption key to db: %v") {
+	err = p.updateMasterKey()
+	if err != nil {
 		return nil, err
 	}
 
@@ -122,14 +141,22 @@ func Create(self security.Identity, name string, apps []string) (*Pool, error) {
 		Id:      self.Id(),
 		State:   Active,
 		ModTime: core.Now(),
+		Role:    Admin,
 	}
 	err = p.sqlSetAccess(access)
 	if core.IsErr(err, "cannot link identity to pool '%s': %v", p.Name) {
 		return nil, err
 	}
 
-	if !ForceCreation {
-		_, err = p.e.Stat(path.Join(p.Name, ".access"))
+	accessFile := path.Join(p.Name, ".access")
+	if ForceCreation {
+		tag, err := transport.ETag(p.e, accessFile)
+		if err == nil {
+			p.setAccessTag(p.e, tag)
+		}
+		p.deleteAccessLog()
+	} else {
+		_, err = p.e.Stat(accessFile)
 		if err == nil {
 			return nil, ErrAlreadyExist
 		}
@@ -140,11 +167,23 @@ func Create(self security.Identity, name string, apps []string) (*Pool, error) {
 		return nil, err
 	}
 
+	err = p.appendAccessLog()
+	if err == ErrAccessConflict {
+		return nil, ErrAlreadyExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	err = p.exportAccessFile()
+	if err == ErrAccessConflict {
+		return nil, ErrAlreadyExist
+	}
 	if core.IsErr(err, "cannot export access file for pool '%s': %v", name) {
 		return nil, err
 	}
 
+	p.startSync()
 	return p, err
 }
 
@@ -170,8 +209,10 @@ func Open(self security.Identity, name string) (*Pool, error) {
 	}
 
 	_, err = p.sync(p.e)
-
-	//	p.startHouseKeeping()
+	err = p.checkJoin(err)
+	if err == nil {
+		p.startSync()
+	}
 	return p, err
 }
 
@@ -179,48 +220,92 @@ type AcceptFunc func(feed Feed)
 
 const All = ""
 
+// List returns the feeds after offset. A feed signed with keys that the author replaced later is attributed to
+// the current identity of the author
 func (p *Pool) List(offset int) ([]Feed, error) {
 	hs, err := sqlGetFeeds(p.Name, offset)
 	if core.IsErr(err, "cannot read Pool feeds: %v") {
 		return nil, err
 	}
+	for i := range hs {
+		hs[i].AuthorId = security.Successor(hs[i].AuthorId)
+	}
 	return hs, err
 }
 
+// Send encrypts and uploads the content of r as a new feed. When the upload is interrupted, it is listed in
+// PendingUploads and can be continued with Resume
 func (p *Pool) Send(name string, r io.Reader, meta []byte) (Feed, error) {
-	id := snowflake.ID()
-	slot := core.Now().Format(FeedDateFormat)
-	n := path.Join(p.Name, FeedsFolder, slot, fmt.Sprintf("%d.body", id))
-	hr, err := p.writeFile(n, r)
-	if core.IsErr(err, "cannot post file %s to %s: %v", name, p.e) {
+	if !p.hasRole(security.UserOf(p.Self.Id()), Writer) {
+		return Feed{}, ErrNotAuthorized
+	}
+	u := p.newUpload(name, meta)
+	err := p.sqlAddSend(u)
+	if err != nil {
 		return Feed{}, err
 	}
+	return p.send(u, r)
+}
 
-	hash := hr.Hash()
-	signature, err := security.Sign(p.Self, hash)
-	if core.IsErr(err, "cannot sign file %s.body in %s: %v", name, p.e) {
+func (p *Pool) send(u Upload, r io.Reader) (Feed, error) {
+	var hr *security.HashStream
+	var chunks, leaves []algo.HashBlock
+	var err error
+	if ChunkFeeds {
+		hr, chunks, leaves, err = p.writeChunks(r)
+	} else {
+		ms := newMerkleSplitter()
+		cr := p.newCheckpointReader(u.Id, r)
+		hr, err = p.writeFileResumable(p.bodyName(u.Id, u.slot), u.keyId, u.iv, io.TeeReader(cr, ms))
+		var splitErr error
+		leaves, splitErr = ms.leaves()
+		if err == nil {
+			err = splitErr
+		}
+	}
+	if core.IsErr(err, "cannot post file %s to %s: %v", u.Name, p.e) {
 		return Feed{}, err
 	}
+
+	tree := algo.MerkleTreeFromBlocks(leaves)
+	err = p.writeTree(p.treeName(u.Id, u.slot), tree)
+	if err != nil {
+		return Feed{}, err
+	}
+
+	selfId := p.Self.Id()
 	f := Feed{
-		Id:        id,
-		Name:      name,
-		Size:      hr.Size(),
-		Hash:      hash,
-		ModTime:   core.Now(),
-		AuthorId:  p.Self.Id(),
-		Signature: signature,
-		Meta:      meta,
-		Slot:      slot,
+		Id:         u.Id,
+		Name:       u.Name,
+		Size:       hr.Size(),
+		Hash:       hr.Hash(),
+		ModTime:    core.Now(),
+		AuthorId:   security.UserOf(selfId),
+		Meta:       u.Meta,
+		Chunks:     chunks,
+		MerkleRoot: *algo.MerkleTreeHash(tree),
+		Slot:       u.slot,
+	}
+	if f.AuthorId != selfId {
+		f.DeviceId = selfId
+	}
+	f.Signature, err = security.Sign(p.Self, feedSignedData(f))
+	if core.IsErr(err, "cannot sign file %s.body in %s: %v", u.Name, p.e) {
+		return Feed{}, err
 	}
 	data, err := json.Marshal(f)
 	if core.IsErr(err, "cannot marshal header to json: %v") {
 		return Feed{}, err
 	}
 
-	n = path.Join(p.Name, FeedsFolder, slot, fmt.Sprintf("%d.head", id))
+	n := path.Join(p.Name, FeedsFolder, u.slot, fmt.Sprintf("%d.head", u.Id))
 	_, err = p.writeFile(n, bytes.NewBuffer(data))
-	core.IsErr(err, "cannot write header %s.head in %s: %v", name, p.e)
+	if core.IsErr(err, "cannot write header %s.head in %s: %v", u.Name, p.e) {
+		// the upload stays pending, so that Resume can write the header again
+		return Feed{}, err
+	}
 
+	_ = p.sqlDelSend(u.Id)
 	return f, nil
 }
 
@@ -230,29 +315,43 @@ func (p *Pool) Receive(id uint64, rang *transport.Range, w io.Writer) error {
 		return err
 	}
 
-	bodyName := path.Join(p.Name, FeedsFolder, f.Slot, fmt.Sprintf("%d.body", id))
+	bodyName := p.bodyName(id, f.Slot)
 	cached, err := p.getFromCache(bodyName, rang, w)
 	if cached {
 		return err
 	}
+	if rang != nil {
+		return p.receiveRange(f, rang, w)
+	}
+
 	cw, err := p.cacheWriter(bodyName, w)
 	if err == nil {
 		defer cw.Close()
 		w = cw
 	}
 
-	hr, err := p.readFile(bodyName, rang, w)
+	hr, err := p.readBody(f, nil, w)
 	if core.IsErr(err, "cannot read body '%s': %v", bodyName) {
 		return err
 	}
 	hash := hr.Hash()
 	if !bytes.Equal(hash, f.Hash) {
+		if cw != nil {
+			cw.failed = true
+		}
 		return ErrInvalidSignature
 	}
 
 	return nil
 }
 
+func (p *Pool) readBody(f Feed, rang *transport.Range, w io.Writer) (*security.HashStream, error) {
+	if len(f.Chunks) > 0 {
+		return p.readChunks(f, rang, w)
+	}
+	return p.readFile(p.bodyName(f.Id, f.Slot), rang, w)
+}
+
 func (p *Pool) CreateBranch(sub string, ids []string, apps []string) (Config, error) {
 	var name string
 	parts := strings.Split(p.Name, "/")
@@ -287,15 +386,13 @@ func (p *Pool) CreateBranch(sub string, ids []string, apps []string) (Config, er
 }
 
 func (p *Pool) Close() {
-	// if p.houseKeeping != nil {
-	// 	p.stopHouseKeeping <- true
-	// 	p.houseKeepingLock.Lock()
-	// 	defer p.houseKeepingLock.Unlock()
-	// }
-
+	p.stopSync()
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
 	for _, e := range p.exchangers {
 		_ = e.Close()
 	}
+	p.closeSubscribers()
 }
 
 func (p *Pool) Delete() error {
@@ -313,30 +410,107 @@ func (p *Pool) Identities() ([]security.Identity, error) {
 	return identities, err
 }
 
+// SetAccess enables or disables the identity userId. A new member gets the Writer role. Only an admin can
+// change the accesses
 func (p *Pool) SetAccess(userId string, state State) error {
-	_, ok, _ := security.GetIdentity(userId)
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	if !p.hasRole(p.Self.Id(), Admin) {
+		return ErrNotAdmin
+	}
+	access, ok, err := p.sqlGetAccess(userId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		access.Role = Writer
+	}
+	access.Id, access.State = userId, state
+
+	change := AccessEntry{Change: Grant, Id: userId, Role: access.Role}
+	if state == Disabled {
+		change = AccessEntry{Change: Revoke, Id: userId}
+	}
+	return p.setAccess(access, change)
+}
+
+// SetRole changes the role of the member userId. Only an admin can change the roles
+func (p *Pool) SetRole(userId string, role Role) error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	if !p.hasRole(p.Self.Id(), Admin) {
+		return ErrNotAdmin
+	}
+	access, ok, err := p.sqlGetAccess(userId)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		identity, err := security.IdentityFromId(userId)
-		if core.IsErr(err, "id '%s' is invalid: %v") {
+		return ErrInvalidId
+	}
+	access.Role = role
+	return p.setAccess(access, AccessEntry{Change: RoleChange, Id: userId, Role: role})
+}
+
+// setAccess records the change in the access log, stores the access and exports the access file
+func (p *Pool) setAccess(access Access, change AccessEntry) error {
+	userId, state := access.Id, access.State
+	err := p.ensureIdentity(userId)
+	if err != nil {
+		return err
+	}
+
+	err = p.appendAccessLog(change)
+	if err == ErrAccessConflict {
+		err = p.appendAccessLog(change)
+	}
+	if err != nil {
+		return err
+	}
+
+	access.ModTime = core.Now()
+	err = p.sqlSetAccess(access)
+	if core.IsErr(err, "cannot link identity '%s' to pool '%s': %v", userId, p.Name) {
+		return err
+	}
+
+	// a disabled identity still holds the current master key, so following content uses a new one
+	if state == Disabled {
+		err = p.rotateMasterKey(userId)
+		if err != nil {
 			return err
 		}
-		identity.Nick = "❓ Incognito..."
-		err = security.SetIdentity(identity)
-		if core.IsErr(err, "cannot save identity '%s' to db: %v", identity) {
-			return err
+	}
+
+	err = p.exportAccessFile()
+	if err == ErrAccessConflict {
+		_, err = p.sync(p.e)
+		if err == nil {
+			err = p.exportAccessFile()
 		}
 	}
+	if err == nil {
+		p.publish(Event{Kind: AccessChanged, Id: userId})
+	}
+	return err
+}
 
-	err := p.sqlSetAccess(Access{
-		Id:      userId,
-		State:   state,
-		ModTime: core.Now(),
-	})
-	if core.IsErr(err, "cannot link identity '%s' to pool '%s': %v", userId, p.Name) {
+// ensureIdentity stores the identity userId when it is not known yet
+func (p *Pool) ensureIdentity(userId string) error {
+	_, ok, _ := security.GetIdentity(userId)
+	if ok {
+		return nil
+	}
+	identity, err := security.IdentityFromId(userId)
+	if core.IsErr(err, "id '%s' is invalid: %v", userId) {
 		return err
 	}
-
-	return p.exportAccessFile()
+	identity.Nick = "❓ Incognito..."
+	err = security.SetIdentity(identity)
+	core.IsErr(err, "cannot save identity '%s' to db: %v", identity)
+	return err
 }
 
 func (p *Pool) ToString() string {
@@ -1,7 +1,8 @@
 package pool
 
 import (
-	"path"
+	"errors"
+	"io/fs"
 
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/transport"
@@ -18,35 +19,61 @@ func (p *Pool) replica() {
 	}
 }
 
+var errWalkStopped = errors.New("walk stopped")
+
+// walkNames lists in a goroutine the files under prefix, in the order of transport.Walk. The walk ends early
+// when stop is closed. The error of the walk is sent on the error channel after the names channel is closed
+func walkNames(e transport.Exchanger, prefix string, stop <-chan struct{}) (<-chan string, <-chan error) {
+	names := make(chan string, 64)
+	errs := make(chan error, 1)
+	go func() {
+		err := transport.Walk(e, prefix, func(name string, info fs.FileInfo) error {
+			select {
+			case names <- name:
+				return nil
+			case <-stop:
+				return errWalkStopped
+			}
+		})
+		close(names)
+		errs <- err
+	}()
+	return names, errs
+}
+
+// syncContent copies the files missing on either side between the main exchanger and e. Both sides are walked
+// in lexical order and compared as they are listed, so the file names are never kept in memory
 func (p *Pool) syncContent(e transport.Exchanger) error {
-	ls, err := p.e.ReadDir(p.Name, 0)
-	if core.IsErr(err, "cannot read file list from %s: %v", p.e) {
-		return err
-	}
+	stop := make(chan struct{})
+	defer close(stop)
+	names, errs := walkNames(e, p.Name, stop)
 
-	m := map[string]bool{}
-	for _, l := range ls {
-		n := l.Name()
-		if n[0] != '.' {
-			m[l.Name()] = true
+	other, ok := <-names
+	err := transport.Walk(p.e, p.Name, func(name string, info fs.FileInfo) error {
+		for ok && other < name {
+			err := transport.CopyFile(p.e, other, e, other)
+			core.IsErr(err, "cannot clone '%s': %v", other)
+			other, ok = <-names
 		}
-	}
-
-	ls, _ = e.ReadDir(p.Name, 0)
-	for _, l := range ls {
-		n := l.Name()
-		if n[0] != '.' && !m[n] {
-			n = path.Join(p.Name, n)
-			_ = transport.CopyFile(p.e, n, e, n)
+		if ok && other == name {
+			other, ok = <-names
+			return nil
 		}
-		delete(m, n)
+		err := transport.CopyFile(e, name, p.e, name)
+		core.IsErr(err, "cannot clone '%s': %v", name)
+		return nil
+	})
+	if core.IsErr(err, "cannot read file list from %s: %v", p.e) {
+		return err
 	}
 
-	for n := range m {
-		n = path.Join(p.Name, n)
-		err = transport.CopyFile(e, n, p.e, n)
-		core.IsErr(err, "cannot clone '%s': %v", n)
+	for ; ok; other, ok = <-names {
+		err := transport.CopyFile(p.e, other, e, other)
+		core.IsErr(err, "cannot clone '%s': %v", other)
+	}
+	err = <-errs
+	if core.IsErr(err, "cannot read file list from %s: %v", e) {
+		return err
 	}
-
 	return nil
 }
@@ -0,0 +1,111 @@
+package pool
+
+import (
+	"math/rand"
+	"time"
+)
+
+// SyncPeriod is the time between two background syncs of an open pool
+var SyncPeriod = time.Minute
+
+// SyncMaxBackoff is the longest wait between two background syncs when they keep failing
+var SyncMaxBackoff = 30 * time.Minute
+
+// BackgroundSync starts a goroutine for each opened pool that syncs accesses and feeds. Applications that
+// prefer to call Sync on demand can disable it before opening the pools
+var BackgroundSync = true
+
+type syncService struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (p *Pool) startSync() {
+	p.serviceLock.Lock()
+	defer p.serviceLock.Unlock()
+	if !BackgroundSync || p.service != nil {
+		return
+	}
+	s := &syncService{stop: make(chan struct{}), done: make(chan struct{})}
+	p.service = s
+	go p.runSync(s)
+}
+
+// stopSync stops the background sync and waits for the current sync, if any, to end
+func (p *Pool) stopSync() {
+	p.serviceLock.Lock()
+	s := p.service
+	p.service = nil
+	p.serviceLock.Unlock()
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+func (p *Pool) runSync(s *syncService) {
+	defer close(s.done)
+
+	failures := 0
+	for {
+		t := time.NewTimer(syncDelay(failures))
+		select {
+		case <-s.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		if p.refresh() == nil {
+			failures = 0
+		} else {
+			failures++
+		}
+	}
+}
+
+// syncDelay returns the wait before the next sync, which doubles after each failure up to SyncMaxBackoff. A random
+// jitter of ±25% spreads the syncs of different pools and clients
+func syncDelay(failures int) time.Duration {
+	d := SyncPeriod
+	for i := 0; i < failures && d < SyncMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > SyncMaxBackoff {
+		d = SyncMaxBackoff
+	}
+	return d - d/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// refresh syncs the accesses and the feeds of the pool and reports the state of the primary exchanger
+func (p *Pool) refresh() error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	_, err := p.sync(p.e)
+	if err == nil {
+		err = p.syncFeeds()
+	}
+	p.checkExchanger(err)
+	return err
+}
+
+// checkExchanger publishes ExchangerDown when a sync fails and the primary exchanger cannot be reached, and
+// ExchangerUp when it is back
+func (p *Pool) checkExchanger(syncErr error) {
+	down := false
+	if syncErr != nil {
+		_, err := pingExchanger(p.e, p.Name, []byte(p.Self.Id()))
+		down = err != nil
+	}
+	if down == p.exchangerDown {
+		return
+	}
+	p.exchangerDown = down
+	if down {
+		p.publish(Event{Kind: ExchangerDown, Exchanger: p.e.String()})
+	} else {
+		p.publish(Event{Kind: ExchangerUp, Exchanger: p.e.String()})
+	}
+}
@@ -0,0 +1,110 @@
+package pool
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
+)
+
+// SuccessionExt is the extension of the succession records in the identities folder. A record is named after
+// the identity it replaces
+const SuccessionExt = ".succession"
+
+// syncSuccessions imports the successions published in the pool and publishes those that replace the local
+// identity
+func (p *Pool) syncSuccessions(e transport.Exchanger) {
+	folder := path.Join(p.Name, IdentityFolder)
+	published := map[string]bool{}
+	ls, _ := e.ReadDir(folder, 0)
+	for _, l := range ls {
+		oldId := strings.TrimSuffix(l.Name(), SuccessionExt)
+		if oldId == l.Name() {
+			continue
+		}
+		var s security.Succession
+		name := path.Join(folder, l.Name())
+		err := transport.ReadJSON(e, name, &s, nil)
+		if core.IsErr(err, "cannot read succession '%s': %v", name) || s.OldId != oldId {
+			continue
+		}
+		_, known, _ := security.GetSuccession(oldId)
+		err = security.SetSuccession(s)
+		if !core.IsErr(err, "invalid succession '%s': %v", name) {
+			published[oldId] = true
+			if !known && security.IsVerified(oldId) {
+				p.publish(Event{Kind: KeyChanged, Id: oldId})
+			}
+		}
+	}
+
+	for _, id := range security.Aliases(p.Self.Id()) {
+		s, ok, _ := security.GetSuccession(id)
+		if !ok || published[id] {
+			continue
+		}
+		name := path.Join(folder, id+SuccessionExt)
+		err := transport.WriteJSON(e, name, s, nil)
+		core.IsErr(err, "cannot publish succession '%s': %v", name)
+	}
+}
+
+// successorAt returns the current identity of id when id was replaced after t, otherwise id itself. A feed
+// signed with old keys before the succession keeps the role of the successor
+func successorAt(id string, t time.Time) string {
+	s, ok, _ := security.GetSuccession(id)
+	if !ok || !t.Before(s.Time) {
+		return id
+	}
+	return security.Successor(id)
+}
+
+// migrateSuccessors grants the access of the members that replaced their identity to the successors and revokes
+// the old identities. The Admin role moves only with the succession of the local identity; the successor of
+// another admin becomes a writer until an admin confirms it with SetRole. An admin does not revoke its own old
+// identity, since it could not export the access file anymore: the revocation is left to the successor or to
+// another admin
+func (p *Pool) migrateSuccessors() error {
+	selfId := p.Self.Id()
+	if !p.hasRole(selfId, Admin) {
+		return nil
+	}
+	_, accesses, err := p.sqlGetAccesses(false)
+	if err != nil {
+		return err
+	}
+	current := map[string]Access{}
+	for _, a := range accesses {
+		current[a.Id] = a
+	}
+
+	for _, a := range accesses {
+		newId := security.Successor(a.Id)
+		if a.State != Active || newId == a.Id {
+			continue
+		}
+		if n, ok := current[newId]; !ok || n.State != Active {
+			core.Info("identity '%s' in pool '%s' is replaced by '%s'", a.Id, p.Name, newId)
+			role := a.Role
+			if role == Admin && a.Id != selfId {
+				role = Writer
+			}
+			err = p.setAccess(Access{Id: newId, State: Active, Role: role},
+				AccessEntry{Change: Grant, Id: newId, Role: role})
+			if err != nil {
+				return err
+			}
+		}
+		if a.Id != selfId {
+			a.State = Disabled
+			err = p.setAccess(a, AccessEntry{Change: Revoke, Id: a.Id})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
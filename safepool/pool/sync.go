@@ -5,9 +5,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
 )
 
 const FeedsFolder = "feeds"
@@ -22,7 +22,7 @@ func (p *Pool) getSlots() ([]string, error) {
 
 	var slots []string
 	for _, f := range fs {
-		if f.Name() >= last {
+		if f.IsDir() && f.Name() >= last {
 			slots = append(slots, f.Name())
 		}
 	}
@@ -31,7 +31,14 @@ func (p *Pool) getSlots() ([]string, error) {
 	return slots, nil
 }
 
+// Sync imports the new feeds of the pool. Open pools are also synced in background, see BackgroundSync
 func (p *Pool) Sync() error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.syncFeeds()
+}
+
+func (p *Pool) syncFeeds() error {
 	if !p.e.Touched(p.Name + "/") {
 		return nil
 	}
@@ -76,14 +83,25 @@ func (p *Pool) Sync() error {
 			if core.IsErr(err, "cannot read file %s from %s: %v", n, p.e) {
 				continue
 			}
+			signer := f.AuthorId
+			if f.DeviceId != "" {
+				signer = f.DeviceId
+			}
+			author := security.UserOf(signer)
+			writer := p.hasRole(author, Writer) || p.hasRole(successorAt(author, f.ModTime), Writer)
+			if author != f.AuthorId || !writer {
+				core.IsErr(ErrNotAuthorized, "feed %s is ignored since its author is not an active writer: %v", n)
+				continue
+			}
 			f.Slot = slot
 			_ = sqlAddFeed(p.Name, f)
 			hs = append(hs, f)
+			p.publish(Event{Kind: NewFeed, FeedId: f.Id, Id: f.AuthorId})
 		}
 		sqlSetSlot(p.Name, p.e.String(), slot)
 	}
 
-	if time.Until(p.lastHouseKeeping) > ReplicaPeriod {
+	if core.Since(p.lastHouseKeeping) > ReplicaPeriod {
 		p.HouseKeeping()
 		p.replica()
 		p.lastHouseKeeping = core.Now()
@@ -1,27 +1,90 @@
 package pool
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
 )
 
+// TokenVersion is the format of the tokens created by EncodeToken. Tokens of previous versions have no expiry and
+// no nonce and are refused
+const TokenVersion = 2.0
+
+const TokensFolder = "tokens"
+
+// TokenLife is the validity of a token when the host does not set an expiry
+var TokenLife = 7 * 24 * time.Hour
+
+var ErrTokenExpired = errors.New("token has expired")
+var ErrTokenUsed = errors.New("token has already been used")
+var ErrUnknownTokenHost = errors.New("token host is not an admin of the pool")
+var ErrSingleUseNotSupported = errors.New("the exchanger cannot record the single use of a token")
+
 type Token struct {
-	Config Config
-	Host   security.Identity
+	Version float32
+	Config  Config
+	Host    security.Identity
+	Issued  time.Time
+	Expires time.Time
+	// Nonce identifies the token in the pool, where it is recorded on first use
+	Nonce []byte
+	// Apps is the list of apps the guest is invited to
+	Apps []string `json:",omitempty"`
+	// Role is the role offered to the guest, if any
+	Role *Role `json:",omitempty"`
+
+	raw string
+}
+
+// tokenUse is the record of a token in the pool
+type tokenUse struct {
+	GuestId   string
+	Time      time.Time
+	Signature []byte
 }
 
+// EncodeToken returns the token t signed by the host. When guestId is not empty, the token is encrypted for the
+// guest. Issued, Expires and Nonce are set when missing
 func EncodeToken(t Token, guestId string) (string, error) {
+	now := core.Now()
+	if t.Issued.IsZero() {
+		t.Issued = now
+	}
+	if t.Expires.IsZero() {
+		t.Expires = t.Issued.Add(TokenLife)
+	}
+	if len(t.Nonce) == 0 {
+		t.Nonce = make([]byte, 16)
+		_, err := rand.Read(t.Nonce)
+		if core.IsErr(err, "cannot generate token nonce: %v") {
+			return "", err
+		}
+	}
+
 	tk, err := json.Marshal(Token{
+		Version: TokenVersion,
 		Config: Config{
 			Name:   t.Config.Name,
 			Public: t.Config.Public,
 		},
-		Host: t.Host.Public(),
+		Host:    t.Host.Public(),
+		Issued:  t.Issued,
+		Expires: t.Expires,
+		Nonce:   t.Nonce,
+		Apps:    t.Apps,
+		Role:    t.Role,
 	})
 	if core.IsErr(err, "cannot marshal config to token: %v") {
 		return "", err
@@ -53,7 +116,31 @@ func EncodeToken(t Token, guestId string) (string, error) {
 
 }
 
+// DecodeToken verifies the signature of the token and returns it. A token that is expired, of a previous version
+// or already used on this device is refused
 func DecodeToken(guest security.Identity, token string) (Token, error) {
+	t, err := parseToken(guest, token)
+	if err != nil {
+		return t, err
+	}
+
+	if !core.Now().Before(t.Expires) {
+		core.IsErr(ErrTokenExpired, "token for pool '%s' expired on %s: %v", t.Config.Name, t.Expires)
+		return t, ErrTokenExpired
+	}
+	used, err := sqlIsTokenUsed(t.Nonce)
+	if err != nil {
+		return t, err
+	}
+	if used {
+		core.IsErr(ErrTokenUsed, "token for pool '%s': %v", t.Config.Name)
+		return t, ErrTokenUsed
+	}
+	return t, nil
+}
+
+// parseToken verifies the signature and the format of the token
+func parseToken(guest security.Identity, token string) (Token, error) {
 	var t Token
 	parts := strings.Split(token, ":")
 	if len(parts) != 3 {
@@ -81,5 +168,141 @@ func DecodeToken(guest security.Identity, token string) (Token, error) {
 		return t, ErrInvalidSignature
 	}
 
+	if t.Version != TokenVersion || len(t.Nonce) == 0 || t.Config.Name == "" ||
+		len(t.Config.Public)+len(t.Config.Private) == 0 {
+		core.IsErr(ErrInvalidToken, "token for pool '%s' version %v: %v", t.Config.Name, t.Version)
+		return t, ErrInvalidToken
+	}
+	t.raw = token
 	return t, nil
 }
+
+func tokenUseName(pool string, nonce []byte) string {
+	return path.Join(pool, TokensFolder, hex.EncodeToString(nonce))
+}
+
+// checkTokenHost returns ErrUnknownTokenHost when hostId is not an admin of the pool, see tokenAdmins
+func (p *Pool) checkTokenHost(hostId string) error {
+	_, err := p.tokenAdmins(hostId)
+	return err
+}
+
+// tokenAdmins returns the admins of the pool after checking that hostId is one of them. The admins known locally
+// are used when the pool has been synced; otherwise the host must be an admin in the access file and must have
+// signed it. A pool without an access file, i.e. not created yet, cannot be checked and has no admins
+func (p *Pool) tokenAdmins(hostId string) ([]security.Identity, error) {
+	_, accesses, err := p.sqlGetAccesses(false)
+	if core.IsErr(err, "cannot read accesses of pool '%s': %v", p.Name) {
+		return nil, err
+	}
+	if len(accesses) > 0 {
+		if !p.hasRole(hostId, Admin) {
+			core.IsErr(ErrUnknownTokenHost, "host '%s' of token for pool '%s': %v", hostId, p.Name)
+			return nil, ErrUnknownTokenHost
+		}
+		return admins(accesses), nil
+	}
+
+	a, h, sa, err := readSignedAccessFile(p.e, p.Name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if core.IsErr(err, "cannot read access file of pool '%s': %v", p.Name) {
+		return nil, err
+	}
+	sh := sa.Signature
+
+	migrateRoles(&a, sh, h.Sum(nil))
+	var listed []Access
+	for _, ak := range a.AccessKeys {
+		listed = append(listed, ak.Access)
+	}
+	identities := admins(listed)
+	for _, i := range identities {
+		if i.Id() == hostId && security.VerifySignedHash(sh, []security.Identity{i}, h.Sum(nil)) {
+			return identities, nil
+		}
+	}
+	core.IsErr(ErrUnknownTokenHost, "host '%s' of token for pool '%s': %v", hostId, p.Name)
+	return nil, ErrUnknownTokenHost
+}
+
+// AcceptToken checks that the host of t is an admin of the pool, see checkTokenHost, and records the host: until
+// the pool is synced, only access files signed by the host are accepted. The token is not used yet, so that it
+// is still valid when the pool cannot be opened. The pool must be defined
+func AcceptToken(guest security.Identity, t Token) error {
+	p, err := connectToken(guest, t)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	if !t.universal() {
+		err = p.checkSingleUse()
+		if err != nil {
+			return err
+		}
+	}
+	err = p.checkTokenHost(t.Host.Id())
+	if err != nil {
+		return err
+	}
+	return sqlSetTokenHost(p.Name, t.Host.Id())
+}
+
+// checkSingleUse returns ErrSingleUseNotSupported when the exchanger cannot write conditionally, since a token
+// could then be recorded by two guests at the same time
+func (p *Pool) checkSingleUse() error {
+	if _, ok := p.e.(transport.ConditionalWriter); !ok {
+		core.IsErr(ErrSingleUseNotSupported, "token for pool '%s' on %s: %v", p.Name, p.e)
+		return ErrSingleUseNotSupported
+	}
+	return nil
+}
+
+// universal returns true when t is not encrypted for a specific guest
+func (t Token) universal() bool {
+	return strings.HasPrefix(t.raw, "0:")
+}
+
+// UseToken records the nonce of t in the pool and on the device, so that the token cannot be used again by the
+// same or by another guest. It is called once the guest opened the pool. A universal token can be used by
+// several guests until it expires and it is not recorded
+func UseToken(guest security.Identity, t Token) error {
+	if t.universal() {
+		return nil
+	}
+	p, err := connectToken(guest, t)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	return p.useToken(t)
+}
+
+func (p *Pool) useToken(t Token) error {
+	err := p.checkSingleUse()
+	if err != nil {
+		return err
+	}
+
+	use := tokenUse{GuestId: p.Self.Id(), Time: core.Now()}
+	use.Signature, err = security.Sign(p.Self, append([]byte(use.GuestId), t.Nonce...))
+	if core.IsErr(err, "cannot sign token use: %v") {
+		return err
+	}
+	data, err := json.Marshal(use)
+	if core.IsErr(err, "cannot marshal token use: %v") {
+		return err
+	}
+
+	err = transport.WriteIfMatch(p.e, tokenUseName(p.Name, t.Nonce), "", bytes.NewReader(data))
+	if errors.Is(err, core.ErrPreconditionFailed) {
+		core.IsErr(ErrTokenUsed, "token for pool '%s': %v", p.Name)
+		return ErrTokenUsed
+	}
+	if core.IsErr(err, "cannot record token use in pool '%s': %v", p.Name) {
+		return err
+	}
+	return sqlSetTokenUsed(p.Name, t.Nonce)
+}
@@ -0,0 +1,180 @@
+package pool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/security"
+	"github.com/code-to-go/safe/safepool/transport"
+	"github.com/godruoyi/go-snowflake"
+)
+
+// ResumeCheckpoint is the amount of content a Send reads between two records of the hash of the content read so
+// far. The record is saved before the content is encrypted, so that it covers all the data sent with the IV of
+// the upload
+var ResumeCheckpoint = 1 << 20
+
+var ErrResumeMismatch = errors.New("content does not match the interrupted upload")
+
+// Upload is a Send that has not completed yet
+type Upload struct {
+	Id      uint64
+	Name    string
+	Meta    []byte
+	ModTime time.Time
+	// Uploaded is the amount of encrypted data already confirmed by the exchanger
+	Uploaded int64
+
+	slot  string
+	keyId uint64
+	iv    []byte
+}
+
+func (p *Pool) bodyName(id uint64, slot string) string {
+	return path.Join(p.Name, FeedsFolder, slot, fmt.Sprintf("%d.body", id))
+}
+
+// PendingUploads returns the uploads interrupted before completion. They can be continued with Resume or
+// discarded with CancelUpload
+func (p *Pool) PendingUploads() ([]Upload, error) {
+	uploads, err := p.sqlGetSends()
+	if err != nil {
+		return nil, err
+	}
+	for i := range uploads {
+		uploads[i].Uploaded = transport.UploadProgress(p.e, p.bodyName(uploads[i].Id, uploads[i].slot))
+	}
+	return uploads, nil
+}
+
+// Resume continues an interrupted Send. r must provide the same content passed to Send; the data already
+// confirmed by the exchanger is skipped. Since the upload keeps its key and IV, the content read by the
+// interrupted Send is compared first with the hash recorded then: when r is an io.ReadSeeker a different content
+// is refused with ErrResumeMismatch, otherwise the upload restarts from the beginning with a new IV
+func (p *Pool) Resume(id uint64, r io.Reader) (Feed, error) {
+	u, err := p.sqlGetSend(id)
+	if err != nil {
+		return Feed{}, err
+	}
+	offset, hash, err := p.sqlGetSendCheckpoint(id)
+	if err != nil {
+		return Feed{}, err
+	}
+	if offset > 0 {
+		if rs, ok := r.(io.ReadSeeker); ok {
+			err = checkResume(rs, offset, hash)
+		} else {
+			u, err = p.restartUpload(u)
+		}
+		if err != nil {
+			return Feed{}, err
+		}
+	}
+	return p.send(u, r)
+}
+
+// checkResume compares the first offset bytes of r with the hash and rewinds r
+func checkResume(r io.ReadSeeker, offset int64, hash []byte) error {
+	h := security.NewHash()
+	_, err := io.CopyN(h, r, offset)
+	if err == io.EOF || err == nil && !bytes.Equal(h.Sum(nil), hash) {
+		core.IsErr(ErrResumeMismatch, "cannot resume upload: %v")
+		return ErrResumeMismatch
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// restartUpload discards the data already uploaded and gives the upload a new IV
+func (p *Pool) restartUpload(u Upload) (Upload, error) {
+	err := transport.AbortWrite(p.e, p.bodyName(u.Id, u.slot))
+	if core.IsErr(err, "cannot abort upload %d in pool %s: %v", u.Id, p.Name) {
+		return Upload{}, err
+	}
+	err = p.sqlDelSend(u.Id)
+	if err != nil {
+		return Upload{}, err
+	}
+	u.iv = security.GenerateBytesKey(aes.BlockSize)
+	return u, p.sqlAddSend(u)
+}
+
+// checkpointReader records the hash of the content read from r every ResumeCheckpoint bytes, before the content
+// is passed on
+type checkpointReader struct {
+	p      *Pool
+	id     uint64
+	r      io.Reader
+	hash   hash.Hash
+	offset int64
+	buf    []byte
+	err    error
+}
+
+func (p *Pool) newCheckpointReader(id uint64, r io.Reader) *checkpointReader {
+	return &checkpointReader{p: p, id: id, r: r, hash: security.NewHash()}
+}
+
+func (c *checkpointReader) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		block := make([]byte, ResumeCheckpoint)
+		n, err := io.ReadFull(c.r, block)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if n > 0 {
+			c.hash.Write(block[0:n])
+			c.offset += int64(n)
+			if serr := c.p.sqlSetSendCheckpoint(c.id, c.offset, c.hash.Sum(nil)); serr != nil {
+				err, n = serr, 0
+			}
+		}
+		c.buf, c.err = block[0:n], err
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// CancelUpload discards an interrupted Send and the data already uploaded
+func (p *Pool) CancelUpload(id uint64) error {
+	u, err := p.sqlGetSend(id)
+	if err != nil {
+		return err
+	}
+
+	err = transport.AbortWrite(p.e, p.bodyName(u.Id, u.slot))
+	if core.IsErr(err, "cannot abort upload %d in pool %s: %v", id, p.Name) {
+		return err
+	}
+	return p.sqlDelSend(id)
+}
+
+func (p *Pool) newUpload(name string, meta []byte) Upload {
+	keyId, _ := p.currentKey()
+	return Upload{
+		Id:      snowflake.ID(),
+		Name:    name,
+		Meta:    meta,
+		ModTime: core.Now(),
+		slot:    core.Now().Format(FeedDateFormat),
+		keyId:   keyId,
+		iv:      security.GenerateBytesKey(aes.BlockSize),
+	}
+}
@@ -6,9 +6,6 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
-	"errors"
-	"io"
 
 	"github.com/code-to-go/safe/safepool/core"
 
@@ -38,7 +35,12 @@ func EncryptBlock(key []byte, nonce []byte, data []byte) ([]byte, error) {
 	return cipherdata, nil
 }
 
+// DecryptBlock decrypts the output of EncryptBlock. It returns ErrInvalidSize when the nonce or the data do not have
+// the size of AES-CBC, which would make the decryption panic
 func DecryptBlock(key []byte, nonce []byte, cipherdata []byte) ([]byte, error) {
+	if len(nonce) != aes.BlockSize || len(cipherdata) == 0 || len(cipherdata)%aes.BlockSize != 0 {
+		return nil, core.ErrInvalidSize
+	}
 	block, err := newBlock(key)
 	if err != nil {
 		return nil, err
@@ -55,93 +57,38 @@ func DecryptBlock(key []byte, nonce []byte, cipherdata []byte) ([]byte, error) {
 	return data, nil
 }
 
-type StreamReader struct {
-	loc    int
-	header []byte
-	r      cipher.StreamReader
-}
-
-func (sr *StreamReader) Read(p []byte) (n int, err error) {
-	if sr.loc < 8+aes.BlockSize {
-		m := copy(p[sr.loc:], sr.header)
-		sr.loc += m
-		n, err = sr.r.Read(p[m:])
-		return m + n, err
-	} else {
-		return sr.r.Read(p)
+// SealBlock encrypts and authenticates data with AES-256-GCM under a key derived from key and nonce, which must be
+// random and aes.BlockSize long. ad is authenticated but not encrypted, so that the result cannot be moved to a
+// different context
+func SealBlock(key []byte, nonce []byte, data []byte, ad []byte) ([]byte, error) {
+	if len(nonce) != aes.BlockSize {
+		return nil, core.ErrInvalidSize
 	}
-}
-
-// EncryptedWriter wraps w with an OFB cipher stream.
-func EncryptingReader(keyId uint64, keyFunc func(uint64) []byte, r io.Reader) (*StreamReader, error) {
-
-	header := make([]byte, 8+aes.BlockSize)
-	binary.LittleEndian.PutUint64(header, keyId)
-
-	// generate random initial value
-	if _, err := io.ReadFull(rand.Reader, header[8:]); err != nil {
+	aead, err := newAEAD(key, nonce, "safepool block")
+	if err != nil {
 		return nil, err
 	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), data, ad), nil
+}
 
-	value := keyFunc(keyId)
-	if value == nil {
-		return nil, errors.New("unknown encryption key")
+// OpenBlock decrypts the output of SealBlock. It returns ErrCorrupted when the key, the nonce or ad do not match
+// or the data has been modified
+func OpenBlock(key []byte, nonce []byte, cipherdata []byte, ad []byte) ([]byte, error) {
+	if len(nonce) != aes.BlockSize {
+		return nil, core.ErrInvalidSize
 	}
-
-	block, err := newBlock(value)
+	aead, err := newAEAD(key, nonce, "safepool block")
 	if err != nil {
 		return nil, err
 	}
-
-	stream := cipher.NewOFB(block, header[8:])
-	return &StreamReader{
-		header: header,
-		r:      cipher.StreamReader{S: stream, R: r},
-	}, nil
-}
-
-type StreamWriter struct {
-	loc     int
-	header  []byte
-	keyFunc func(uint64) []byte
-	w       *cipher.StreamWriter
-}
-
-func (sr *StreamWriter) Write(p []byte) (n int, err error) {
-	if sr.w.S == nil {
-		m := copy(sr.header[sr.loc:], p)
-		sr.loc += m
-
-		if sr.loc == 8+aes.BlockSize {
-			keyId := binary.LittleEndian.Uint64(sr.header)
-			value := sr.keyFunc(keyId)
-			if value == nil {
-				return 0, errors.New("unknown encryption key")
-			}
-
-			block, err := newBlock(value)
-			if err != nil {
-				return 0, err
-			}
-
-			iv := sr.header[8:]
-			sr.w.S = cipher.NewOFB(block, iv)
-		}
-		return sr.w.Write(p[m:])
-	} else {
-		return sr.w.Write(p)
+	data, err := aead.Open(nil, make([]byte, aead.NonceSize()), cipherdata, ad)
+	if err != nil {
+		return nil, ErrCorrupted
 	}
+	return data, nil
 }
 
-// EncryptedWriter wraps w with an OFB cipher stream.
-func DecryptingWriter(keyFunc func(uint64) []byte, w io.Writer) (*StreamWriter, error) {
-	return &StreamWriter{
-		keyFunc: keyFunc,
-		header:  make([]byte, 8+aes.BlockSize),
-		w:       &cipher.StreamWriter{S: nil, W: w},
-	}, nil
-}
-
+// newBlock returns the AES-128 cipher used by the legacy stream format and by EncryptBlock
 func newBlock(key []byte) (cipher.Block, error) {
 	sh := sha256.Sum256(key)
 	hash := md5.Sum(sh[:])
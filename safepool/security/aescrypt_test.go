@@ -2,10 +2,14 @@ package security
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"io"
 	"testing"
 
+	"github.com/code-to-go/safe/safepool/core"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,6 +32,7 @@ func TestAESCrypt(t *testing.T) {
 	w2 := &bytes.Buffer{}
 	ew, _ := DecryptingWriter(keyFunc, w2)
 	io.Copy(ew, w)
+	assert.NoError(t, ew.Close())
 
 	assert.Equal(t, w2.Bytes(), b)
 }
@@ -50,10 +55,157 @@ func TestAESCryptAndHash(t *testing.T) {
 	io.Copy(w, er)
 
 	w2 := &bytes.Buffer{}
-	s2, _ := NewHashStream(nil, w)
+	s2, _ := NewHashStream(nil, w2)
 	ew, _ := DecryptingWriter(keyFunc, s2)
 	io.Copy(ew, w)
+	assert.NoError(t, ew.Close())
 
 	assert.Equal(t, w2.Bytes(), b)
 	assert.Equal(t, s1.Hash(), s2.Hash())
 }
+
+func encryptStream(t *testing.T, keyFunc func(uint64) []byte, data []byte) []byte {
+	er, err := EncryptingReader(1, keyFunc, bytes.NewReader(data))
+	assert.NoError(t, err)
+	encrypted, err := io.ReadAll(er)
+	assert.NoError(t, err)
+	return encrypted
+}
+
+func decryptStream(keyFunc func(uint64) []byte, encrypted []byte) ([]byte, error) {
+	var b bytes.Buffer
+	ew, _ := DecryptingWriter(keyFunc, &b)
+	_, err := ew.Write(encrypted)
+	if err == nil {
+		err = ew.Close()
+	}
+	return b.Bytes(), err
+}
+
+func TestStreamSegments(t *testing.T) {
+	key := GenerateBytesKey(32)
+	keyFunc := func(_ uint64) []byte {
+		return key
+	}
+
+	for _, size := range []int{0, 100, SegmentSize, 3*SegmentSize + 100} {
+		data := GenerateBytesKey(size + 1)[0:size]
+		encrypted := encryptStream(t, keyFunc, data)
+		decrypted, err := decryptStream(keyFunc, encrypted)
+		assert.NoError(t, err)
+		assert.Truef(t, bytes.Equal(data, decrypted), "content of size %d does not match", size)
+	}
+
+	data := GenerateBytesKey(3*SegmentSize + 100)
+	encrypted := encryptStream(t, keyFunc, data)
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[streamHeaderSize+sealedSize+10] ^= 1
+	_, err := decryptStream(keyFunc, tampered)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	_, err = decryptStream(keyFunc, encrypted[0:streamHeaderSize+2*sealedSize])
+	assert.ErrorIs(t, err, ErrTruncated, "a stream cut at the end of a segment must be detected")
+	_, err = decryptStream(keyFunc, encrypted[0:streamHeaderSize+2*sealedSize+100])
+	assert.Error(t, err)
+
+	swapped := append([]byte{}, encrypted[0:streamHeaderSize]...)
+	swapped = append(swapped, encrypted[streamHeaderSize+sealedSize:streamHeaderSize+2*sealedSize]...)
+	swapped = append(swapped, encrypted[streamHeaderSize:streamHeaderSize+sealedSize]...)
+	swapped = append(swapped, encrypted[streamHeaderSize+2*sealedSize:]...)
+	_, err = decryptStream(keyFunc, swapped)
+	assert.ErrorIs(t, err, ErrCorrupted, "segments cannot be reordered")
+}
+
+func TestStreamRange(t *testing.T) {
+	key := GenerateBytesKey(32)
+	keyFunc := func(_ uint64) []byte {
+		return key
+	}
+	data := GenerateBytesKey(3*SegmentSize + 100)
+	encrypted := encryptStream(t, keyFunc, data)
+
+	for _, r := range [][2]int64{{0, 10}, {100, SegmentSize}, {SegmentSize + 5, 2*SegmentSize + 5}, {3 * SegmentSize, 3*SegmentSize + 100}} {
+		from, to, err := EncryptedRange(encrypted, r[0], r[1])
+		assert.NoError(t, err)
+		if to > int64(len(encrypted)) {
+			to = int64(len(encrypted))
+		}
+
+		var b bytes.Buffer
+		ew, err := DecryptingWriterAt(keyFunc, encrypted[0:MaxEncryptionHeaderSize], r[0], &b)
+		assert.NoError(t, err)
+		_, err = ew.Write(encrypted[from:to])
+		assert.NoError(t, err)
+		assert.NoError(t, ew.Close())
+		assert.Equal(t, data[r[0]:r[1]], b.Bytes()[0:r[1]-r[0]])
+	}
+}
+
+func TestLegacyStream(t *testing.T) {
+	key := GenerateBytesKey(32)
+	keyFunc := func(_ uint64) []byte {
+		return key
+	}
+	data := GenerateBytesKey(100000)
+
+	// legacy streams are the key id and the initial value followed by the AES-OFB encrypted content
+	header := make([]byte, legacyHeaderSize)
+	binary.LittleEndian.PutUint64(header, 1)
+	iv := GenerateBytesKey(aes.BlockSize)
+	copy(header[8:], iv)
+	block, _ := newBlock(key)
+	encrypted := make([]byte, len(data))
+	cipher.NewOFB(block, iv).XORKeyStream(encrypted, data)
+	encrypted = append(header, encrypted...)
+
+	decrypted, err := decryptStream(keyFunc, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	from, to, err := EncryptedRange(encrypted, 50000, 60000)
+	assert.NoError(t, err)
+	var b bytes.Buffer
+	ew, err := DecryptingWriterAt(keyFunc, encrypted[0:MaxEncryptionHeaderSize], 50000, &b)
+	assert.NoError(t, err)
+	ew.Write(encrypted[from:to])
+	assert.NoError(t, ew.Close())
+	assert.Equal(t, data[50000:60000], b.Bytes())
+}
+
+func TestSealBlock(t *testing.T) {
+	key := GenerateBytesKey(32)
+	nonce := GenerateBytesKey(aes.BlockSize)
+	data := []byte("the keys of the pool")
+
+	sealed, err := SealBlock(key, nonce, data, []byte("pool"))
+	assert.NoError(t, err)
+	opened, err := OpenBlock(key, nonce, sealed, []byte("pool"))
+	assert.NoError(t, err)
+	assert.Equal(t, data, opened)
+
+	_, err = OpenBlock(key, nonce, sealed, []byte("another pool"))
+	assert.ErrorIs(t, err, ErrCorrupted)
+	sealed[0] ^= 1
+	_, err = OpenBlock(key, nonce, sealed, []byte("pool"))
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestDecryptBlock(t *testing.T) {
+	key := GenerateBytesKey(32)
+	nonce := GenerateBytesKey(aes.BlockSize)
+	data := []byte("the keys of the pool")
+
+	encrypted, err := EncryptBlock(key, nonce, data)
+	assert.NoError(t, err)
+	decrypted, err := DecryptBlock(key, nonce, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	_, err = DecryptBlock(key, nonce, encrypted[1:])
+	assert.ErrorIs(t, err, core.ErrInvalidSize, "a truncated keystore must not panic")
+	_, err = DecryptBlock(key, nonce[1:], encrypted)
+	assert.ErrorIs(t, err, core.ErrInvalidSize)
+	_, err = DecryptBlock(key, nonce, nil)
+	assert.ErrorIs(t, err, core.ErrInvalidSize)
+}
@@ -0,0 +1,224 @@
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ed25519"
+	"crypto/rand"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/code-to-go/safe/safepool/core"
+	eciesgo "github.com/ecies/go/v2"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// BackupVersion is the format of the files created by ExportIdentity
+const BackupVersion = 1
+
+// Argon2id parameters for the key that protects an exported identity
+var (
+	BackupTime    uint32 = 3
+	BackupMemory  uint32 = 64 * 1024
+	BackupThreads uint8  = 4
+)
+
+// Largest Argon2id parameters accepted by ImportIdentity, so that a forged backup cannot exhaust time or memory
+const (
+	backupMaxTime    = 16
+	backupMaxMemory  = 1024 * 1024
+	backupMaxThreads = 16
+)
+
+var ErrInvalidPassphrase = errors.New("passphrase is wrong or the backup is corrupted")
+var ErrInvalidPaperKey = errors.New("paper key is not valid")
+var ErrInvalidBackupParams = errors.New("key derivation parameters of the backup are out of bounds")
+
+// identityBackup is an identity encrypted with a key derived from a passphrase. The parameters of the
+// derivation are authenticated together with the identity
+type identityBackup struct {
+	Version int
+	KDF     string
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Salt    []byte
+	Data    []byte
+}
+
+func (b identityBackup) ad() []byte {
+	return []byte(fmt.Sprintf("%d:%s:%d:%d:%d", b.Version, b.KDF, b.Time, b.Memory, b.Threads))
+}
+
+// checkParams refuses the parameters that make argon2 panic or that are much larger than BackupTime, BackupMemory
+// and BackupThreads
+func (b identityBackup) checkParams() error {
+	if b.Time < 1 || b.Time > backupMaxTime || b.Threads < 1 || b.Threads > backupMaxThreads ||
+		b.Memory < 8*uint32(b.Threads) || b.Memory > backupMaxMemory {
+		return ErrInvalidBackupParams
+	}
+	return nil
+}
+
+func (b identityBackup) key(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), b.Salt, b.Time, b.Memory, b.Threads, 32)
+}
+
+// ExportIdentity returns the identity with its private keys encrypted with the passphrase
+func ExportIdentity(i Identity, passphrase string) ([]byte, error) {
+	b := identityBackup{
+		Version: BackupVersion,
+		KDF:     "argon2id",
+		Time:    BackupTime,
+		Memory:  BackupMemory,
+		Threads: BackupThreads,
+		Salt:    make([]byte, aes.BlockSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, b.Salt); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(i)
+	if core.IsErr(err, "cannot marshal identity: %v") {
+		return nil, err
+	}
+	b.Data, err = SealBlock(b.key(passphrase), b.Salt, data, b.ad())
+	if core.IsErr(err, "cannot encrypt identity: %v") {
+		return nil, err
+	}
+	return json.Marshal(b)
+}
+
+// ImportIdentity decrypts the output of ExportIdentity
+func ImportIdentity(data []byte, passphrase string) (Identity, error) {
+	var b identityBackup
+	var i Identity
+	err := json.Unmarshal(data, &b)
+	if core.IsErr(err, "invalid identity backup: %v") {
+		return i, err
+	}
+	if b.Version != BackupVersion || b.KDF != "argon2id" {
+		return i, core.ErrInvalidVersion
+	}
+	err = b.checkParams()
+	if core.IsErr(err, "cannot import identity: %v") {
+		return i, err
+	}
+
+	data, err = OpenBlock(b.key(passphrase), b.Salt, b.Data, b.ad())
+	if err != nil {
+		return i, ErrInvalidPassphrase
+	}
+	err = json.Unmarshal(data, &i)
+	if core.IsErr(err, "cannot unmarshal identity: %v") {
+		return i, err
+	}
+	return i, nil
+}
+
+// A paper key holds the two private keys of an identity and a checksum as a list of words, 11 bits per word, so
+// that it can be written down and typed again. The checksum covers a version byte, which is not written
+const (
+	paperVersion  = 1
+	paperChecksum = 2
+	paperWords    = (ed25519.SeedSize + 32 + paperChecksum) * 8 / 11
+)
+
+// wordlist is the english word list of BIP39: 2048 words that are unique in their first four letters
+//
+//go:embed wordlist.txt
+var wordlist string
+
+var paperWordList = strings.Fields(wordlist)
+
+// paperWordIndex maps each word and its first four letters to its position in the list
+var paperWordIndex = func() map[string]int {
+	m := map[string]int{}
+	for i, w := range paperWordList {
+		m[w] = i
+		if len(w) > 4 {
+			m[w[0:4]] = i
+		}
+	}
+	return m
+}()
+
+func paperSum(keys []byte) []byte {
+	h := blake2b.Sum256(append([]byte{paperVersion}, keys...))
+	return h[0:paperChecksum]
+}
+
+// PaperKey returns a printable backup of the private keys of the identity. Nick and email are not included
+func PaperKey(i Identity) (string, error) {
+	crypt := i.EncryptionKey.Private
+	if len(i.SignatureKey.Private) != ed25519.PrivateKeySize || len(crypt) == 0 || len(crypt) > 32 {
+		return "", core.ErrInvalidSize
+	}
+	data := append([]byte{}, ed25519.PrivateKey(i.SignatureKey.Private).Seed()...)
+	// the identity keeps the secp256k1 key without leading zeros
+	data = append(data, make([]byte, 32-len(crypt))...)
+	data = append(data, crypt...)
+	data = append(data, paperSum(data)...)
+
+	var words []string
+	var acc, bits uint
+	for _, b := range data {
+		acc, bits = acc<<8|uint(b), bits+8
+		if bits >= 11 {
+			bits -= 11
+			words = append(words, paperWordList[acc>>bits])
+			acc &= 1<<bits - 1
+		}
+	}
+	return strings.Join(words, " "), nil
+}
+
+// IdentityFromPaperKey restores the identity backed up with PaperKey. Words can be separated by spaces, new lines or
+// dashes and can be shortened to their first four letters; case is ignored
+func IdentityFromPaperKey(paper string, nick string) (Identity, error) {
+	words := strings.FieldsFunc(strings.ToLower(paper), func(r rune) bool {
+		return r == '-' || unicode.IsSpace(r)
+	})
+	if len(words) != paperWords {
+		return Identity{}, ErrInvalidPaperKey
+	}
+
+	var data []byte
+	var acc, bits uint
+	for _, w := range words {
+		idx, ok := paperWordIndex[w]
+		if !ok {
+			return Identity{}, ErrInvalidPaperKey
+		}
+		acc, bits = acc<<11|uint(idx), bits+11
+		for bits >= 8 {
+			bits -= 8
+			data = append(data, byte(acc>>bits))
+			acc &= 1<<bits - 1
+		}
+	}
+	l := len(data) - paperChecksum
+	if !bytes.Equal(paperSum(data[0:l]), data[l:]) {
+		return Identity{}, ErrInvalidPaperKey
+	}
+
+	privateSign := ed25519.NewKeyFromSeed(data[0:ed25519.SeedSize])
+	privateCrypt := eciesgo.NewPrivateKeyFromBytes(data[ed25519.SeedSize:l])
+	return Identity{
+		Nick: nick,
+		SignatureKey: Key{
+			Public:  privateSign.Public().(ed25519.PublicKey),
+			Private: privateSign,
+		},
+		EncryptionKey: Key{
+			Public:  privateCrypt.PublicKey.Bytes(true),
+			Private: privateCrypt.Bytes(),
+		},
+	}, nil
+}
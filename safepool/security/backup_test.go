@@ -0,0 +1,75 @@
+package security
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportIdentity(t *testing.T) {
+	BackupMemory = 1024
+
+	identity, err := NewIdentity("test")
+	assert.NoErrorf(t, err, "cannot create identity")
+
+	data, err := ExportIdentity(identity, "secret")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), identity.Nick)
+
+	i, err := ImportIdentity(data, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, identity, i)
+
+	_, err = ImportIdentity(data, "wrong")
+	assert.ErrorIs(t, err, ErrInvalidPassphrase)
+	_, err = ImportIdentity([]byte(strings.Replace(string(data), `"Time":3`, `"Time":1`, 1)), "secret")
+	assert.ErrorIs(t, err, ErrInvalidPassphrase, "the derivation parameters are authenticated")
+	_, err = ImportIdentity([]byte(strings.Replace(string(data), `"Time":3`, `"Time":0`, 1)), "secret")
+	assert.ErrorIs(t, err, ErrInvalidBackupParams)
+	_, err = ImportIdentity([]byte(strings.Replace(string(data), `"Memory":1024`, `"Memory":4294967295`, 1)), "secret")
+	assert.ErrorIs(t, err, ErrInvalidBackupParams)
+	_, err = ImportIdentity([]byte(strings.Replace(string(data), `"Threads":4`, `"Threads":0`, 1)), "secret")
+	assert.ErrorIs(t, err, ErrInvalidBackupParams)
+}
+
+func TestPaperKey(t *testing.T) {
+	identity, err := NewIdentity("test")
+	assert.NoErrorf(t, err, "cannot create identity")
+
+	paper, err := PaperKey(identity)
+	assert.NoError(t, err)
+
+	words := strings.Fields(paper)
+	assert.Len(t, words, paperWords)
+
+	i, err := IdentityFromPaperKey(strings.ToUpper(strings.Join(words, "-")), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, identity, i)
+
+	short := make([]string, len(words))
+	for j, w := range words {
+		if len(w) > 4 {
+			w = w[0:4]
+		}
+		short[j] = w
+	}
+	i, err = IdentityFromPaperKey(strings.Join(short, "\n"), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, identity, i)
+
+	typo := append([]string{}, words...)
+	if typo[0] == "zoo" {
+		typo[0] = "abandon"
+	} else {
+		typo[0] = "zoo"
+	}
+	_, err = IdentityFromPaperKey(strings.Join(typo, " "), "test")
+	assert.ErrorIs(t, err, ErrInvalidPaperKey)
+
+	typo[0] = "zzzz"
+	_, err = IdentityFromPaperKey(strings.Join(typo, " "), "test")
+	assert.ErrorIs(t, err, ErrInvalidPaperKey)
+	_, err = IdentityFromPaperKey(strings.Join(words[1:], " "), "test")
+	assert.ErrorIs(t, err, ErrInvalidPaperKey)
+}
@@ -1,6 +1,8 @@
 package security
 
 import (
+	"encoding/json"
+
 	"github.com/code-to-go/safe/safepool/core"
 	"github.com/code-to-go/safe/safepool/sql"
 )
@@ -82,3 +84,248 @@ func sqlSetAlias(i Identity, alias string) error {
 	})
 	return err
 }
+
+func sqlGetDelegation(deviceId string) (d Delegation, ok bool, err error) {
+	var d64 string
+	err = sql.QueryRow("GET_DELEGATION", sql.Args{"device": deviceId}, &d64)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return d, false, nil
+	default:
+		core.IsErr(err, "cannot read delegation from db: %v")
+		return d, false, err
+	}
+
+	err = json.Unmarshal(sql.DecodeBase64(d64), &d)
+	if core.IsErr(err, "corrupted delegation on db: %v") {
+		return d, false, err
+	}
+	return d, true, nil
+}
+
+func sqlGetDelegations(userId string) ([]Delegation, error) {
+	rows, err := sql.Query("GET_DELEGATIONS", sql.Args{"userId": userId})
+	if core.IsErr(err, "cannot get delegations from db: %v") {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var delegations []Delegation
+	for rows.Next() {
+		var d64 string
+		var d Delegation
+		err = rows.Scan(&d64)
+		if core.IsErr(err, "cannot read delegation from db: %v") {
+			continue
+		}
+		err = json.Unmarshal(sql.DecodeBase64(d64), &d)
+		if core.IsErr(err, "corrupted delegation on db: %v") {
+			continue
+		}
+		delegations = append(delegations, d)
+	}
+	return delegations, nil
+}
+
+func sqlSetDelegation(d Delegation) error {
+	data, err := json.Marshal(d)
+	if core.IsErr(err, "cannot marshal delegation: %v") {
+		return err
+	}
+	_, err = sql.Exec("SET_DELEGATION", sql.Args{
+		"device":  d.DeviceId,
+		"userId":  d.UserId,
+		"revoked": d.Revoked,
+		"d64":     sql.EncodeBase64(data),
+	})
+	core.IsErr(err, "cannot save delegation to db: %v")
+	return err
+}
+
+func sqlGetSuccession(oldId string) (s Succession, ok bool, err error) {
+	var s64 string
+	err = sql.QueryRow("GET_SUCCESSION", sql.Args{"oldId": oldId}, &s64)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return s, false, nil
+	default:
+		core.IsErr(err, "cannot read succession from db: %v")
+		return s, false, err
+	}
+
+	err = json.Unmarshal(sql.DecodeBase64(s64), &s)
+	if core.IsErr(err, "corrupted succession on db: %v") {
+		return s, false, err
+	}
+	return s, true, nil
+}
+
+func sqlGetPredecessor(newId string) (oldId string, ok bool, err error) {
+	err = sql.QueryRow("GET_PREDECESSOR", sql.Args{"newId": newId}, &oldId)
+	switch err {
+	case nil:
+		return oldId, true, nil
+	case sql.ErrNoRows:
+		return "", false, nil
+	default:
+		core.IsErr(err, "cannot read succession from db: %v")
+		return "", false, err
+	}
+}
+
+func sqlSetSuccession(s Succession) error {
+	data, err := json.Marshal(s)
+	if core.IsErr(err, "cannot marshal succession: %v") {
+		return err
+	}
+	_, err = sql.Exec("SET_SUCCESSION", sql.Args{
+		"oldId": s.OldId,
+		"newId": s.New.Id(),
+		"s64":   sql.EncodeBase64(data),
+	})
+	core.IsErr(err, "cannot save succession to db: %v")
+	return err
+}
+
+func sqlGetEndorsement(endorserId string, endorseeId string) (e Endorsement, ok bool, err error) {
+	var e64 string
+	err = sql.QueryRow("GET_ENDORSEMENT", sql.Args{"endorserId": endorserId, "endorseeId": endorseeId}, &e64)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return e, false, nil
+	default:
+		core.IsErr(err, "cannot read endorsement from db: %v")
+		return e, false, err
+	}
+
+	err = json.Unmarshal(sql.DecodeBase64(e64), &e)
+	if core.IsErr(err, "corrupted endorsement on db: %v") {
+		return e, false, err
+	}
+	return e, true, nil
+}
+
+func sqlQueryEndorsements(key string, args sql.Args) ([]Endorsement, error) {
+	rows, err := sql.Query(key, args)
+	if core.IsErr(err, "cannot get endorsements from db: %v") {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endorsements []Endorsement
+	for rows.Next() {
+		var e64 string
+		var e Endorsement
+		err = rows.Scan(&e64)
+		if core.IsErr(err, "cannot read endorsement from db: %v") {
+			continue
+		}
+		err = json.Unmarshal(sql.DecodeBase64(e64), &e)
+		if core.IsErr(err, "corrupted endorsement on db: %v") {
+			continue
+		}
+		endorsements = append(endorsements, e)
+	}
+	return endorsements, nil
+}
+
+func sqlGetEndorsementsBy(endorserId string) ([]Endorsement, error) {
+	return sqlQueryEndorsements("GET_ENDORSEMENTS_BY", sql.Args{"endorserId": endorserId})
+}
+
+func sqlGetEndorsements() ([]Endorsement, error) {
+	return sqlQueryEndorsements("GET_ENDORSEMENTS", sql.Args{})
+}
+
+func sqlSetEndorsement(e Endorsement) error {
+	data, err := json.Marshal(e)
+	if core.IsErr(err, "cannot marshal endorsement: %v") {
+		return err
+	}
+	_, err = sql.Exec("SET_ENDORSEMENT", sql.Args{
+		"endorserId": e.EndorserId,
+		"endorseeId": e.EndorseeId,
+		"revoked":    e.Revoked,
+		"e64":        sql.EncodeBase64(data),
+	})
+	core.IsErr(err, "cannot save endorsement to db: %v")
+	return err
+}
+
+func sqlGetTrustPolicy() (p TrustPolicy, ok bool) {
+	var s, b64 string
+	err := sql.QueryRow("GET_CONFIG", sql.Args{"pool": "", "key": "TRUST_DEPTH"}, &s, &p.Depth, &b64)
+	if err != nil {
+		return p, false
+	}
+	err = sql.QueryRow("GET_CONFIG", sql.Args{"pool": "", "key": "TRUST_THRESHOLD"}, &s, &p.Threshold, &b64)
+	return p, err == nil
+}
+
+func sqlSetTrustPolicy(p TrustPolicy) error {
+	_, err := sql.Exec("SET_CONFIG", sql.Args{"pool": "", "key": "TRUST_DEPTH", "s": "", "i": p.Depth, "b": ""})
+	if core.IsErr(err, "cannot save trust policy to db: %v") {
+		return err
+	}
+	_, err = sql.Exec("SET_CONFIG", sql.Args{"pool": "", "key": "TRUST_THRESHOLD", "s": "", "i": p.Threshold, "b": ""})
+	core.IsErr(err, "cannot save trust policy to db: %v")
+	return err
+}
+
+func sqlIsVerified(id string) bool {
+	var verifiedAt int64
+	err := sql.QueryRow("GET_VERIFIED", sql.Args{"id": id}, &verifiedAt)
+	if err != nil && err != sql.ErrNoRows {
+		core.IsErr(err, "cannot read verification from db: %v")
+	}
+	return err == nil
+}
+
+func sqlSetVerified(id string, verified bool) error {
+	var err error
+	if verified {
+		_, err = sql.Exec("SET_VERIFIED", sql.Args{"id": id, "verifiedAt": sql.EncodeTime(core.Now())})
+	} else {
+		_, err = sql.Exec("DEL_VERIFIED", sql.Args{"id": id})
+	}
+	core.IsErr(err, "cannot save verification to db: %v")
+	return err
+}
+
+// sqlSetKeyChange stores the key change and returns true when it was not stored yet
+func sqlSetKeyChange(k KeyChange) (bool, error) {
+	res, err := sql.Exec("SET_KEY_CHANGE", sql.Args{
+		"id":        k.Id,
+		"newId":     k.NewId,
+		"changedAt": sql.EncodeTime(k.Time),
+	})
+	if core.IsErr(err, "cannot save key change to db: %v") {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func sqlGetKeyChanges() ([]KeyChange, error) {
+	rows, err := sql.Query("GET_KEY_CHANGES", sql.Args{})
+	if core.IsErr(err, "cannot get key changes from db: %v") {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []KeyChange
+	for rows.Next() {
+		var k KeyChange
+		var changedAt int64
+		err = rows.Scan(&k.Id, &k.NewId, &changedAt)
+		if core.IsErr(err, "cannot read key change from db: %v") {
+			continue
+		}
+		k.Time = sql.DecodeTime(changedAt)
+		changes = append(changes, k)
+	}
+	return changes, nil
+}
@@ -0,0 +1,157 @@
+package security
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+var ErrInvalidDelegation = errors.New("delegation is not valid")
+
+// Delegation is a certificate signed by a user and countersigned by a device, with its own identity, that lets
+// the device act on behalf of the user. The countersignature prevents a user from claiming an identity that is
+// not its device. A delegation with Revoked set, which the user signs alone, cancels the previous ones for the
+// same device and is final
+type Delegation struct {
+	UserId          string
+	DeviceId        string
+	Device          string
+	Time            time.Time
+	Revoked         bool
+	Signature       []byte `json:",omitempty"`
+	DeviceSignature []byte `json:",omitempty"`
+}
+
+func (d Delegation) data() []byte {
+	d.Signature, d.DeviceSignature = nil, nil
+	data, _ := json.Marshal(d)
+	return data
+}
+
+func newDelegation(user Identity, deviceId string, device string, revoked bool) (Delegation, error) {
+	if _, err := IdentityFromId(deviceId); err != nil {
+		return Delegation{}, err
+	}
+	if deviceId == user.Id() {
+		return Delegation{}, ErrInvalidDelegation
+	}
+
+	d := Delegation{
+		UserId:   user.Id(),
+		DeviceId: deviceId,
+		Device:   device,
+		Time:     core.Now(),
+		Revoked:  revoked,
+	}
+	var err error
+	d.Signature, err = Sign(user, d.data())
+	if core.IsErr(err, "cannot sign delegation: %v") {
+		return Delegation{}, err
+	}
+	return d, nil
+}
+
+// NewDelegation returns the certificate that lets the device deviceId act on behalf of user. The certificate is
+// valid once the device countersigns it with CountersignDelegation
+func NewDelegation(user Identity, deviceId string, device string) (Delegation, error) {
+	return newDelegation(user, deviceId, device, false)
+}
+
+// RevokeDelegation returns the certificate that excludes the device deviceId from acting on behalf of user
+func RevokeDelegation(user Identity, deviceId string) (Delegation, error) {
+	return newDelegation(user, deviceId, "", true)
+}
+
+// CountersignDelegation adds the signature of the device to the certificate created by the user
+func CountersignDelegation(device Identity, d Delegation) (Delegation, error) {
+	if d.DeviceId != device.Id() || d.Revoked || !Verify(d.UserId, d.data(), d.Signature) {
+		return Delegation{}, ErrInvalidDelegation
+	}
+	var err error
+	d.DeviceSignature, err = Sign(device, d.data())
+	if core.IsErr(err, "cannot countersign delegation: %v") {
+		return Delegation{}, err
+	}
+	return d, nil
+}
+
+func (d Delegation) Verify() bool {
+	return d.UserId != d.DeviceId && Verify(d.UserId, d.data(), d.Signature) &&
+		(d.Revoked || Verify(d.DeviceId, d.data(), d.DeviceSignature))
+}
+
+func (d Delegation) Base64() (string, error) {
+	data, err := json.Marshal(d)
+	if core.IsErr(err, "cannot marshal delegation: %v") {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func DelegationFromBase64(b64 string) (Delegation, error) {
+	var d Delegation
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if core.IsErr(err, "cannot decode delegation string in base64: %v") {
+		return d, err
+	}
+	err = json.Unmarshal(data, &d)
+	if core.IsErr(err, "cannot decode delegation from json: %v") {
+		return d, err
+	}
+	return d, nil
+}
+
+// SetDelegation stores a valid delegation. It is ignored when the device is already revoked or the stored
+// delegation is more recent. A device cannot be delegated by two users and a revocation is ignored when the
+// device is not delegated, since nobody else but the user signs it
+func SetDelegation(d Delegation) error {
+	if !d.Verify() {
+		return ErrInvalidDelegation
+	}
+
+	current, ok, err := sqlGetDelegation(d.DeviceId)
+	if err != nil {
+		return err
+	}
+	if !ok && d.Revoked {
+		return nil
+	}
+	if ok {
+		if current.UserId != d.UserId {
+			return ErrInvalidDelegation
+		}
+		if current.Revoked || (!d.Revoked && !d.Time.After(current.Time)) {
+			return nil
+		}
+	}
+	return sqlSetDelegation(d)
+}
+
+// GetDelegation returns the delegation of the device deviceId, if any
+func GetDelegation(deviceId string) (d Delegation, ok bool, err error) {
+	return sqlGetDelegation(deviceId)
+}
+
+// Delegations returns the delegations of the devices of the user, including the revoked ones
+func Delegations(userId string) ([]Delegation, error) {
+	return sqlGetDelegations(userId)
+}
+
+// IsDelegated returns true when the device deviceId can act on behalf of the user userId
+func IsDelegated(deviceId string, userId string) bool {
+	d, ok, _ := sqlGetDelegation(deviceId)
+	return ok && !d.Revoked && d.UserId == userId
+}
+
+// UserOf returns the user on whose behalf the identity id acts. It is id itself when the identity is not
+// a delegated device
+func UserOf(id string) string {
+	d, ok, _ := sqlGetDelegation(id)
+	if ok && !d.Revoked {
+		return d.UserId
+	}
+	return id
+}
@@ -0,0 +1,352 @@
+package security
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"golang.org/x/crypto/hkdf"
+)
+
+// An encrypted stream starts with a header. In the legacy format the header is the key id followed by the initial
+// value of an AES-OFB stream. In the current format the header is a format word, the key id and a random salt.
+// The format word has the most significant bit set, which is never the case for a snowflake key id, and holds the
+// version. The content follows in segments of SegmentSize bytes, each sealed with AES-256-GCM under a key derived
+// from the salt. The nonce of a segment is its position and a flag set only on the last segment, so that
+// segments cannot be reordered and a truncated stream is detected
+const (
+	StreamVersion = 1
+	SegmentSize   = 64 * 1024
+
+	legacyHeaderSize = 8 + aes.BlockSize
+	saltSize         = aes.BlockSize
+	streamHeaderSize = 8 + 8 + saltSize
+	streamFlag       = uint64(1) << 63
+	segmentOverhead  = 16
+	sealedSize       = SegmentSize + segmentOverhead
+)
+
+// MaxEncryptionHeaderSize is the largest header of an encrypted stream in any format
+const MaxEncryptionHeaderSize = streamHeaderSize
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+var ErrCorrupted = errors.New("encrypted content has been modified")
+var ErrTruncated = errors.New("encrypted content is truncated")
+
+// newAEAD returns AES-256-GCM with a key derived from key and salt. info separates the keys of different uses
+func newAEAD(key []byte, salt []byte, info string) (cipher.AEAD, error) {
+	derived := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(info)), derived)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// headerSize returns the size of the header that starts with prefix, or 8 when prefix is too short to tell
+func headerSize(prefix []byte) int {
+	switch {
+	case len(prefix) < 8:
+		return 8
+	case binary.LittleEndian.Uint64(prefix)&streamFlag != 0:
+		return streamHeaderSize
+	default:
+		return legacyHeaderSize
+	}
+}
+
+type StreamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	ad      []byte
+	counter uint64
+	plain   []byte
+	sealed  []byte
+	out     []byte
+	final   bool
+}
+
+func (sr *StreamReader) Read(p []byte) (n int, err error) {
+	for len(sr.out) == 0 {
+		if sr.final {
+			return 0, io.EOF
+		}
+		err = sr.seal()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, sr.out)
+	sr.out = sr.out[n:]
+	return n, nil
+}
+
+// seal reads the next segment and encrypts it. A full segment is the last one when nothing follows
+func (sr *StreamReader) seal() error {
+	n, err := io.ReadFull(sr.r, sr.plain)
+	switch err {
+	case nil:
+		_, err = sr.r.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		sr.final = err == io.EOF
+	case io.EOF, io.ErrUnexpectedEOF:
+		sr.final = true
+	default:
+		return err
+	}
+
+	sr.sealed = sr.aead.Seal(sr.sealed[:0], segmentNonce(sr.counter, sr.final), sr.plain[:n], sr.ad)
+	sr.out = sr.sealed
+	sr.counter++
+	return nil
+}
+
+// EncryptingReader returns the encrypted stream of the content of r
+func EncryptingReader(keyId uint64, keyFunc func(uint64) []byte, r io.Reader) (*StreamReader, error) {
+	// generate random salt
+	iv := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	return EncryptingReaderWithIV(keyId, keyFunc, iv, r)
+}
+
+// EncryptingReaderWithIV is like EncryptingReader with a provided salt. The same key, salt and content produce
+// the same encrypted stream, which is required to resume an interrupted upload. A salt must never be used for
+// different contents
+func EncryptingReaderWithIV(keyId uint64, keyFunc func(uint64) []byte, iv []byte, r io.Reader) (*StreamReader, error) {
+	if len(iv) != saltSize {
+		return nil, errors.New("invalid initial value size")
+	}
+
+	header := make([]byte, streamHeaderSize)
+	binary.LittleEndian.PutUint64(header, streamFlag|StreamVersion)
+	binary.LittleEndian.PutUint64(header[8:], keyId)
+	copy(header[16:], iv)
+
+	value := keyFunc(keyId)
+	if value == nil {
+		return nil, ErrUnknownKey
+	}
+	aead, err := newAEAD(value, iv, "safepool stream")
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamReader{
+		r:     bufio.NewReader(r),
+		aead:  aead,
+		ad:    header,
+		plain: make([]byte, SegmentSize),
+		out:   header,
+	}, nil
+}
+
+// StreamWriter decrypts the stream written to it in any format. Close must be called at the end of the stream
+// to decrypt the last segment and to detect a truncation
+type StreamWriter struct {
+	header  []byte
+	keyFunc func(uint64) []byte
+	w       io.Writer
+
+	legacy *cipher.StreamWriter
+
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+	plain   []byte
+	skip    int
+	partial bool
+}
+
+func (sw *StreamWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if sw.legacy == nil && sw.aead == nil {
+		for len(sw.header) < headerSize(sw.header) && len(p) > 0 {
+			m := headerSize(sw.header) - len(sw.header)
+			if m > len(p) {
+				m = len(p)
+			}
+			sw.header = append(sw.header, p[0:m]...)
+			p = p[m:]
+		}
+		if len(sw.header) < headerSize(sw.header) {
+			return n, nil
+		}
+		err = sw.init()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if sw.legacy != nil {
+		_, err = sw.legacy.Write(p)
+		return n, err
+	}
+
+	sw.buf = append(sw.buf, p...)
+	for len(sw.buf) > sealedSize {
+		err = sw.open(sw.buf[0:sealedSize], false)
+		if err != nil {
+			return 0, err
+		}
+		sw.buf = append(sw.buf[:0], sw.buf[sealedSize:]...)
+	}
+	return n, nil
+}
+
+func (sw *StreamWriter) init() error {
+	if len(sw.header) == legacyHeaderSize {
+		keyId := binary.LittleEndian.Uint64(sw.header)
+		value := sw.keyFunc(keyId)
+		if value == nil {
+			return ErrUnknownKey
+		}
+		block, err := newBlock(value)
+		if err != nil {
+			return err
+		}
+		sw.legacy = &cipher.StreamWriter{S: cipher.NewOFB(block, sw.header[8:]), W: sw.w}
+		return nil
+	}
+
+	version := binary.LittleEndian.Uint64(sw.header) &^ streamFlag
+	if version != StreamVersion {
+		return core.ErrInvalidVersion
+	}
+	keyId := binary.LittleEndian.Uint64(sw.header[8:])
+	value := sw.keyFunc(keyId)
+	if value == nil {
+		return ErrUnknownKey
+	}
+	aead, err := newAEAD(value, sw.header[16:], "safepool stream")
+	if err != nil {
+		return err
+	}
+	sw.aead = aead
+	return nil
+}
+
+func (sw *StreamWriter) open(segment []byte, final bool) error {
+	plain, err := sw.aead.Open(sw.plain[:0], segmentNonce(sw.counter, final), segment, sw.header)
+	if err != nil {
+		return ErrCorrupted
+	}
+	sw.plain = plain
+	sw.counter++
+
+	if sw.skip > 0 {
+		m := sw.skip
+		if m > len(plain) {
+			m = len(plain)
+		}
+		plain, sw.skip = plain[m:], sw.skip-m
+	}
+	_, err = sw.w.Write(plain)
+	return err
+}
+
+// Close decrypts the last segment of the stream
+func (sw *StreamWriter) Close() error {
+	switch {
+	case sw.legacy != nil:
+		return nil
+	case sw.aead == nil:
+		return ErrTruncated
+	case sw.partial && len(sw.buf) == 0:
+		return nil
+	}
+
+	buf := sw.buf
+	sw.buf = nil
+	err := sw.open(buf, true)
+	if err != ErrCorrupted || len(buf) != sealedSize {
+		return err
+	}
+	err = sw.open(buf, false)
+	if err == nil && !sw.partial {
+		return ErrTruncated
+	}
+	return err
+}
+
+// DecryptingWriter returns a writer that decrypts the stream written to it and writes the content to w
+func DecryptingWriter(keyFunc func(uint64) []byte, w io.Writer) (*StreamWriter, error) {
+	return &StreamWriter{
+		keyFunc: keyFunc,
+		w:       w,
+	}, nil
+}
+
+// EncryptedRange returns the range of the encrypted stream that starts with header that must be read to decrypt
+// the content from offset from to offset to
+func EncryptedRange(header []byte, from, to int64) (int64, int64, error) {
+	size := headerSize(header)
+	if len(header) < size {
+		return 0, 0, core.ErrInvalidSize
+	}
+	if size == legacyHeaderSize {
+		return from + legacyHeaderSize, to + legacyHeaderSize, nil
+	}
+
+	first, last := from/SegmentSize, (to+SegmentSize-1)/SegmentSize
+	return streamHeaderSize + first*sealedSize, streamHeaderSize + last*sealedSize, nil
+}
+
+// DecryptingWriterAt is like DecryptingWriter for the part of an encrypted stream returned by EncryptedRange.
+// header is the beginning of the stream and from the offset of the content to write to w. Close does not
+// report a truncation, since the part may end before the stream
+func DecryptingWriterAt(keyFunc func(uint64) []byte, header []byte, from int64, w io.Writer) (*StreamWriter, error) {
+	size := headerSize(header)
+	if len(header) < size {
+		return nil, core.ErrInvalidSize
+	}
+	sw := &StreamWriter{
+		keyFunc: keyFunc,
+		w:       w,
+		header:  append([]byte{}, header[0:size]...),
+	}
+	err := sw.init()
+	if err != nil {
+		return nil, err
+	}
+
+	if sw.legacy != nil {
+		skip := make([]byte, 32*1024)
+		for from > 0 {
+			n := int64(len(skip))
+			if from < n {
+				n = from
+			}
+			sw.legacy.S.XORKeyStream(skip[0:n], skip[0:n])
+			from -= n
+		}
+		return sw, nil
+	}
+
+	sw.counter = uint64(from / SegmentSize)
+	sw.skip = int(from % SegmentSize)
+	sw.partial = true
+	return sw, nil
+}
@@ -0,0 +1,136 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+var ErrInvalidSuccession = errors.New("succession is not valid")
+
+// maxSuccessions bounds the length of a chain of successions
+const maxSuccessions = 64
+
+// Succession is a record by which an identity names the identity that replaces it, e.g. after its keys are
+// compromised. It is signed by both the old and the new identity, so that nobody can be named as a successor
+// without consent. An identity has at most one successor and one predecessor
+type Succession struct {
+	OldId        string
+	New          Identity
+	Time         time.Time
+	OldSignature []byte `json:",omitempty"`
+	NewSignature []byte `json:",omitempty"`
+}
+
+func (s Succession) data() []byte {
+	s.OldSignature, s.NewSignature = nil, nil
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// NewSuccession returns the record that names next as the successor of old
+func NewSuccession(old Identity, next Identity) (Succession, error) {
+	if SameIdentity(old, next) {
+		return Succession{}, ErrInvalidSuccession
+	}
+
+	s := Succession{
+		OldId: old.Id(),
+		New:   next.Public(),
+		Time:  core.Now(),
+	}
+	var err error
+	s.OldSignature, err = Sign(old, s.data())
+	if core.IsErr(err, "cannot sign succession with old identity: %v") {
+		return Succession{}, err
+	}
+	s.NewSignature, err = Sign(next, s.data())
+	if core.IsErr(err, "cannot sign succession with new identity: %v") {
+		return Succession{}, err
+	}
+	return s, nil
+}
+
+func (s Succession) Verify() bool {
+	newId := s.New.Id()
+	return s.OldId != newId && Verify(s.OldId, s.data(), s.OldSignature) &&
+		Verify(newId, s.data(), s.NewSignature)
+}
+
+// SetSuccession stores a valid succession and the new identity. A succession that conflicts with a stored one
+// is refused
+func SetSuccession(s Succession) error {
+	if !s.Verify() {
+		return ErrInvalidSuccession
+	}
+
+	newId := s.New.Id()
+	current, ok, err := sqlGetSuccession(s.OldId)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if current.New.Id() == newId {
+			return nil
+		}
+		return ErrInvalidSuccession
+	}
+	oldId, ok, err := sqlGetPredecessor(newId)
+	if err != nil {
+		return err
+	}
+	if ok && oldId != s.OldId {
+		return ErrInvalidSuccession
+	}
+	for _, id := range Aliases(s.OldId) {
+		if id == newId {
+			return ErrInvalidSuccession
+		}
+	}
+
+	err = sqlSetSuccession(s)
+	if err != nil {
+		return err
+	}
+	// a verified identity with new keys must be verified again
+	_, _ = WarnKeyChange(s.OldId, newId)
+	if _, ok, _ := GetIdentity(newId); !ok {
+		err = SetIdentity(s.New)
+	}
+	return err
+}
+
+// GetSuccession returns the succession of the identity id, if any
+func GetSuccession(id string) (s Succession, ok bool, err error) {
+	return sqlGetSuccession(id)
+}
+
+// Successor returns the last identity in the chain of successions that starts with id, or id itself when the
+// identity has no successor
+func Successor(id string) string {
+	for i := 0; i < maxSuccessions; i++ {
+		s, ok, _ := sqlGetSuccession(id)
+		if !ok {
+			break
+		}
+		id = s.New.Id()
+	}
+	return id
+}
+
+// Aliases returns all the identities of the chain of successions id belongs to, starting from the oldest. Content
+// signed by any of them comes from the same person
+func Aliases(id string) []string {
+	latest := Successor(id)
+	ids := []string{latest}
+	for i := 0; i < maxSuccessions; i++ {
+		oldId, ok, _ := sqlGetPredecessor(ids[0])
+		if !ok {
+			break
+		}
+		ids = append([]string{oldId}, ids...)
+	}
+	return ids
+}
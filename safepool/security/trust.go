@@ -0,0 +1,160 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+var ErrInvalidEndorsement = errors.New("endorsement is not valid")
+var ErrInvalidTrustPolicy = errors.New("trust policy is not valid")
+
+// Endorsement is the statement, signed by the endorser, that the endorsee is who claims to be. An endorsement
+// with Revoked set withdraws the previous ones
+type Endorsement struct {
+	EndorserId string
+	EndorseeId string
+	Time       time.Time
+	Revoked    bool
+	Signature  []byte `json:",omitempty"`
+}
+
+func (e Endorsement) data() []byte {
+	e.Signature = nil
+	data, _ := json.Marshal(e)
+	return data
+}
+
+// NewEndorsement returns the endorsement of the identity endorseeId by endorser. When revoked is true the
+// endorsement withdraws a previous one
+func NewEndorsement(endorser Identity, endorseeId string, revoked bool) (Endorsement, error) {
+	if _, err := IdentityFromId(endorseeId); err != nil {
+		return Endorsement{}, err
+	}
+	if endorseeId == endorser.Id() {
+		return Endorsement{}, ErrInvalidEndorsement
+	}
+
+	e := Endorsement{
+		EndorserId: endorser.Id(),
+		EndorseeId: endorseeId,
+		Time:       core.Now(),
+		Revoked:    revoked,
+	}
+	var err error
+	e.Signature, err = Sign(endorser, e.data())
+	if core.IsErr(err, "cannot sign endorsement: %v") {
+		return Endorsement{}, err
+	}
+	return e, nil
+}
+
+func (e Endorsement) Verify() bool {
+	return e.EndorserId != e.EndorseeId && Verify(e.EndorserId, e.data(), e.Signature)
+}
+
+// SetEndorsement stores a valid endorsement unless a more recent one from the same endorser is already stored
+func SetEndorsement(e Endorsement) error {
+	if !e.Verify() {
+		return ErrInvalidEndorsement
+	}
+
+	current, ok, err := sqlGetEndorsement(e.EndorserId, e.EndorseeId)
+	if err != nil {
+		return err
+	}
+	if ok && !e.Time.After(current.Time) {
+		return nil
+	}
+	return sqlSetEndorsement(e)
+}
+
+// Endorse creates and stores the endorsement of endorseeId by endorser, or its revocation when endorse is false
+func Endorse(endorser Identity, endorseeId string, endorse bool) error {
+	e, err := NewEndorsement(endorser, endorseeId, !endorse)
+	if err != nil {
+		return err
+	}
+	return SetEndorsement(e)
+}
+
+// EndorsementsBy returns the endorsements signed by the identity endorserId, including the revoked ones
+func EndorsementsBy(endorserId string) ([]Endorsement, error) {
+	return sqlGetEndorsementsBy(endorserId)
+}
+
+// TrustPolicy defines how far trust propagates through endorsements. Depth is the maximum number of endorsements
+// between a directly trusted identity and a trusted one; Threshold is how many endorsers an identity needs at
+// each step
+type TrustPolicy struct {
+	Depth     int
+	Threshold int
+}
+
+// DefaultTrustPolicy trusts the identities endorsed by at least one directly trusted identity
+var DefaultTrustPolicy = TrustPolicy{Depth: 1, Threshold: 1}
+
+// GetTrustPolicy returns the policy saved with SetTrustPolicy or DefaultTrustPolicy
+func GetTrustPolicy() TrustPolicy {
+	p, ok := sqlGetTrustPolicy()
+	if !ok {
+		return DefaultTrustPolicy
+	}
+	return p
+}
+
+func SetTrustPolicy(p TrustPolicy) error {
+	if p.Depth < 0 || p.Threshold < 1 {
+		return ErrInvalidTrustPolicy
+	}
+	return sqlSetTrustPolicy(p)
+}
+
+// TrustLevels computes the trust level of the identities reachable with the trust policy. Identities trusted
+// directly with Trust have level Depth+1; an identity endorsed by Threshold identities of level l+1 or higher
+// has level l. Identities missing in the map have level 0, i.e. they are not trusted
+func TrustLevels() (map[string]int, error) {
+	policy := GetTrustPolicy()
+	trusted, err := Trusted()
+	if err != nil {
+		return nil, err
+	}
+	levels := map[string]int{}
+	for _, i := range trusted {
+		levels[i.Id()] = policy.Depth + 1
+	}
+	if policy.Depth == 0 {
+		return levels, nil
+	}
+
+	endorsements, err := sqlGetEndorsements()
+	if err != nil {
+		return nil, err
+	}
+	for l := policy.Depth; l > 0; l-- {
+		counts := map[string]int{}
+		for _, e := range endorsements {
+			if levels[e.EndorserId] > l {
+				counts[e.EndorseeId]++
+			}
+		}
+		for id, c := range counts {
+			if c >= policy.Threshold && levels[id] < l {
+				levels[id] = l
+			}
+		}
+	}
+	return levels, nil
+}
+
+// TrustLevel returns the trust level of the identity id according to the trust policy. The level is 0 when the
+// identity is not trusted
+func TrustLevel(id string) int {
+	levels, err := TrustLevels()
+	if core.IsErr(err, "cannot compute trust levels: %v") {
+		return 0
+	}
+	return levels[id]
+}
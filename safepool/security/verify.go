@@ -0,0 +1,142 @@
+package security
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+var ErrInvalidVerificationCode = errors.New("verification code is not valid")
+
+const (
+	fingerprintVersion    = 0
+	fingerprintIterations = 5200
+	fingerprintSize       = 32
+	fingerprintEmojis     = 8
+)
+
+// VerificationCodePrefix starts the text exchanged, usually as a QR code, to compare identities in person
+const VerificationCodePrefix = "safepool-verify:1:"
+
+var emojis = []string{
+	"🐶", "🐱", "🐭", "🐹", "🐰", "🦊", "🐻", "🐼", "🐨", "🐯", "🦁", "🐮", "🐷", "🐸", "🐵", "🐔",
+	"🐧", "🐦", "🦆", "🦉", "🐴", "🦄", "🐝", "🦋", "🐌", "🐞", "🐢", "🐍", "🐙", "🦀", "🐠", "🐳",
+	"🌵", "🌲", "🌻", "🍄", "🌙", "⭐", "🔥", "🌈", "❄", "🍎", "🍋", "🍌", "🍉", "🍇", "🍓", "🥕",
+	"🌽", "🍕", "🎂", "☕", "⚽", "🎸", "🎲", "🚲", "🚀", "⛵", "🔑", "🔔", "📚", "✏", "⏰", "🎁",
+}
+
+// SafetyNumber is the same for two identities no matter who computes it. When both sides read the same number,
+// or the same emoji, their keys have not been replaced in transit
+type SafetyNumber struct {
+	Numeric string
+	Emoji   string
+}
+
+// fingerprintOf returns the iterated hash of the public keys of the identity
+func fingerprintOf(i Identity) []byte {
+	keys := append(append([]byte{}, i.SignatureKey.Public...), i.EncryptionKey.Public...)
+	h := append([]byte{0, fingerprintVersion}, keys...)
+	for n := 0; n < fingerprintIterations; n++ {
+		s := sha512.Sum512(append(h, keys...))
+		h = s[:]
+	}
+	return h[0:fingerprintSize]
+}
+
+// sortedFingerprints returns the fingerprints of a and b in a fixed order
+func sortedFingerprints(a, b Identity) ([]byte, []byte) {
+	fa, fb := fingerprintOf(a), fingerprintOf(b)
+	if bytes.Compare(fa, fb) > 0 {
+		return fb, fa
+	}
+	return fa, fb
+}
+
+func numericFingerprint(f []byte) []string {
+	var groups []string
+	for n := 0; n < 30; n += 5 {
+		v := uint64(f[n])<<32 | uint64(binary.BigEndian.Uint32(f[n+1:n+5]))
+		groups = append(groups, fmt.Sprintf("%05d", v%100000))
+	}
+	return groups
+}
+
+// Fingerprint returns the safety number of the identities a and b in numeric form, 12 groups of 5 digits, and
+// as a sequence of emoji
+func Fingerprint(a, b Identity) SafetyNumber {
+	f1, f2 := sortedFingerprints(a, b)
+	numeric := append(numericFingerprint(f1), numericFingerprint(f2)...)
+
+	var emoji strings.Builder
+	h := sha512.Sum512(append(append([]byte{}, f1...), f2...))
+	for n := 0; n < fingerprintEmojis; n++ {
+		emoji.WriteString(emojis[int(h[n])%len(emojis)])
+	}
+	return SafetyNumber{
+		Numeric: strings.Join(numeric, " "),
+		Emoji:   emoji.String(),
+	}
+}
+
+// VerificationCode returns the text that self shows to other, e.g. as a QR code, so that other can check the
+// keys with CheckVerificationCode
+func VerificationCode(self, other Identity) string {
+	data := append(fingerprintOf(self), fingerprintOf(other)...)
+	return VerificationCodePrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// CheckVerificationCode returns true when code, created by other with VerificationCode, matches the keys that
+// self knows for both identities
+func CheckVerificationCode(self, other Identity, code string) bool {
+	if !strings.HasPrefix(code, VerificationCodePrefix) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(code, VerificationCodePrefix))
+	if err != nil || len(data) != 2*fingerprintSize {
+		return false
+	}
+	return bytes.Equal(data[0:fingerprintSize], fingerprintOf(other)) &&
+		bytes.Equal(data[fingerprintSize:], fingerprintOf(self))
+}
+
+// SetVerified marks the identity id as verified out-of-band, e.g. after comparing the safety numbers in person
+func SetVerified(id string, verified bool) error {
+	return sqlSetVerified(id, verified)
+}
+
+func IsVerified(id string) bool {
+	return sqlIsVerified(id)
+}
+
+// KeyChange warns that the keys published for a verified identity changed. NewId is the identity with the new
+// keys, which is not verified yet
+type KeyChange struct {
+	Id    string
+	NewId string
+	Time  time.Time
+}
+
+// WarnKeyChange records that different keys, newId, appeared for the identity id. Nothing is recorded when the
+// identity is not verified. It returns true only the first time a change is recorded
+func WarnKeyChange(id string, newId string) (bool, error) {
+	if id == newId || !IsVerified(id) {
+		return false, nil
+	}
+	added, err := sqlSetKeyChange(KeyChange{Id: id, NewId: newId, Time: core.Now()})
+	if added {
+		core.Info("keys of verified identity '%s' changed to '%s'", id, newId)
+	}
+	return added, err
+}
+
+// KeyChanges returns the warnings on verified identities whose new keys are not verified yet
+func KeyChanges() ([]KeyChange, error) {
+	return sqlGetKeyChanges()
+}
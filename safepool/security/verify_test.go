@@ -0,0 +1,29 @@
+package security
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	alice, err := NewIdentity("alice")
+	assert.NoErrorf(t, err, "cannot create identity")
+	bob, err := NewIdentity("bob")
+	assert.NoErrorf(t, err, "cannot create identity")
+	eve, err := NewIdentity("eve")
+	assert.NoErrorf(t, err, "cannot create identity")
+
+	s := Fingerprint(alice, bob)
+	assert.Equal(t, s, Fingerprint(bob.Public(), alice), "both sides compute the same safety number")
+	assert.Len(t, strings.Split(s.Numeric, " "), 12)
+	assert.Len(t, strings.ReplaceAll(s.Numeric, " ", ""), 60)
+	assert.NotEqual(t, s, Fingerprint(alice, eve))
+
+	code := VerificationCode(bob, alice.Public())
+	assert.True(t, CheckVerificationCode(alice, bob.Public(), code))
+	assert.False(t, CheckVerificationCode(alice, eve, code), "the keys do not match")
+	assert.False(t, CheckVerificationCode(bob, alice, code), "the code is read by the other side")
+	assert.False(t, CheckVerificationCode(alice, bob, strings.TrimPrefix(code, VerificationCodePrefix)))
+}
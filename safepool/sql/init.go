@@ -89,6 +89,10 @@ func CloseDB() error {
 	if db == nil {
 		return os.ErrClosed
 	}
+	for key, stmt := range stmtCache {
+		stmt.Close()
+		delete(stmtCache, key)
+	}
 	err := db.Close()
 	db = nil
 	return err
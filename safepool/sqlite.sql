@@ -30,6 +30,102 @@ INSERT INTO identities(id,i64,alias) VALUES(:id,:i64,'')
 -- SET_ALIAS
 UPDATE identities SET alias=:alias WHERE id=:id
 
+-- INIT
+CREATE TABLE IF NOT EXISTS verifications (
+    id VARCHAR(256) NOT NULL,
+    verifiedAt INTEGER NOT NULL,
+    CONSTRAINT pk_verifications PRIMARY KEY(id)
+);
+
+-- GET_VERIFIED
+SELECT verifiedAt FROM verifications WHERE id=:id
+
+-- SET_VERIFIED
+INSERT INTO verifications(id,verifiedAt) VALUES(:id,:verifiedAt)
+    ON CONFLICT(id) DO NOTHING
+
+-- DEL_VERIFIED
+DELETE FROM verifications WHERE id=:id
+
+-- INIT
+CREATE TABLE IF NOT EXISTS keyChanges (
+    id VARCHAR(256) NOT NULL,
+    newId VARCHAR(256) NOT NULL,
+    changedAt INTEGER NOT NULL,
+    CONSTRAINT pk_keyChanges PRIMARY KEY(id,newId)
+);
+
+-- GET_KEY_CHANGES
+SELECT id, newId, changedAt FROM keyChanges WHERE id IN (SELECT id FROM verifications)
+    AND newId NOT IN (SELECT id FROM verifications)
+
+-- SET_KEY_CHANGE
+INSERT INTO keyChanges(id,newId,changedAt) VALUES(:id,:newId,:changedAt)
+    ON CONFLICT(id,newId) DO NOTHING
+
+-- INIT
+CREATE TABLE IF NOT EXISTS delegations (
+    device VARCHAR(256) NOT NULL,
+    userId VARCHAR(256) NOT NULL,
+    revoked INTEGER NOT NULL,
+    d64 BLOB NOT NULL,
+    CONSTRAINT pk_delegations PRIMARY KEY(device)
+);
+
+-- GET_DELEGATION
+SELECT d64 FROM delegations WHERE device=:device
+
+-- GET_DELEGATIONS
+SELECT d64 FROM delegations WHERE userId=:userId
+
+-- SET_DELEGATION
+INSERT INTO delegations(device,userId,revoked,d64) VALUES(:device,:userId,:revoked,:d64)
+    ON CONFLICT(device) DO UPDATE SET userId=:userId,revoked=:revoked,d64=:d64
+	    WHERE device=:device
+
+-- INIT
+CREATE TABLE IF NOT EXISTS successions (
+    oldId VARCHAR(256) NOT NULL,
+    newId VARCHAR(256) NOT NULL,
+    s64 BLOB NOT NULL,
+    CONSTRAINT pk_successions PRIMARY KEY(oldId)
+);
+
+-- INIT
+CREATE UNIQUE INDEX IF NOT EXISTS idx_successions_new ON successions(newId);
+
+-- GET_SUCCESSION
+SELECT s64 FROM successions WHERE oldId=:oldId
+
+-- GET_PREDECESSOR
+SELECT oldId FROM successions WHERE newId=:newId
+
+-- SET_SUCCESSION
+INSERT INTO successions(oldId,newId,s64) VALUES(:oldId,:newId,:s64)
+
+-- INIT
+CREATE TABLE IF NOT EXISTS endorsements (
+    endorserId VARCHAR(256) NOT NULL,
+    endorseeId VARCHAR(256) NOT NULL,
+    revoked INTEGER NOT NULL,
+    e64 BLOB NOT NULL,
+    CONSTRAINT pk_endorsements PRIMARY KEY(endorserId,endorseeId)
+);
+
+-- GET_ENDORSEMENT
+SELECT e64 FROM endorsements WHERE endorserId=:endorserId AND endorseeId=:endorseeId
+
+-- GET_ENDORSEMENTS_BY
+SELECT e64 FROM endorsements WHERE endorserId=:endorserId
+
+-- GET_ENDORSEMENTS
+SELECT e64 FROM endorsements WHERE NOT revoked
+
+-- SET_ENDORSEMENT
+INSERT INTO endorsements(endorserId,endorseeId,revoked,e64) VALUES(:endorserId,:endorseeId,:revoked,:e64)
+    ON CONFLICT(endorserId,endorseeId) DO UPDATE SET revoked=:revoked,e64=:e64
+	    WHERE endorserId=:endorserId AND endorseeId=:endorseeId
+
 -- INIT
 CREATE TABLE IF NOT EXISTS configs (
     pool VARCHAR(128) NOT NULL, 
@@ -83,6 +179,44 @@ INSERT INTO feeds(pool,id,name,modTime,size,authorId,hash,meta,slot) VALUES(:poo
 -- DEL_FEED_BEFORE
 DELETE FROM feeds WHERE pool=:pool AND id <:beforeId
 
+-- INIT
+CREATE TABLE IF NOT EXISTS feed_chunks (
+    pool VARCHAR(128) NOT NULL,
+    id INTEGER NOT NULL,
+    chunks BLOB NOT NULL,
+    CONSTRAINT pk_feed_chunks PRIMARY KEY(pool,id)
+);
+
+-- GET_FEED_CHUNKS
+SELECT chunks FROM feed_chunks WHERE pool=:pool AND id=:id
+
+-- SET_FEED_CHUNKS
+INSERT INTO feed_chunks(pool,id,chunks) VALUES(:pool,:id,:chunks)
+    ON CONFLICT(pool,id) DO UPDATE SET chunks=:chunks
+	WHERE pool=:pool AND id=:id
+
+-- DEL_FEED_CHUNKS_BEFORE
+DELETE FROM feed_chunks WHERE pool=:pool AND id <:beforeId
+
+-- INIT
+CREATE TABLE IF NOT EXISTS feed_roots (
+    pool VARCHAR(128) NOT NULL,
+    id INTEGER NOT NULL,
+    root VARCHAR(128) NOT NULL,
+    CONSTRAINT pk_feed_roots PRIMARY KEY(pool,id)
+);
+
+-- GET_FEED_ROOT
+SELECT root FROM feed_roots WHERE pool=:pool AND id=:id
+
+-- SET_FEED_ROOT
+INSERT INTO feed_roots(pool,id,root) VALUES(:pool,:id,:root)
+    ON CONFLICT(pool,id) DO UPDATE SET root=:root
+	WHERE pool=:pool AND id=:id
+
+-- DEL_FEED_ROOTS_BEFORE
+DELETE FROM feed_roots WHERE pool=:pool AND id <:beforeId
+
 -- INIT
 CREATE TABLE IF NOT EXISTS keys (
     pool VARCHAR(128) NOT NULL, 
@@ -120,6 +254,40 @@ INSERT INTO pools(name,configs) VALUES(:name,:configs)
     ON CONFLICT(name) DO UPDATE SET configs=:configs
 	    WHERE name=:name
 
+-- INIT
+CREATE TABLE IF NOT EXISTS tokens (
+    nonce VARCHAR(64) NOT NULL,
+    pool VARCHAR(512) NOT NULL,
+    used INTEGER NOT NULL,
+    CONSTRAINT pk_tokens PRIMARY KEY(nonce)
+);
+
+-- GET_TOKEN
+SELECT used FROM tokens WHERE nonce=:nonce
+
+-- SET_TOKEN
+INSERT INTO tokens(nonce,pool,used) VALUES(:nonce,:pool,:used)
+    ON CONFLICT(nonce) DO NOTHING
+
+-- INIT
+CREATE TABLE IF NOT EXISTS joins (
+    pool VARCHAR(512) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    host VARCHAR(256) NOT NULL,
+    CONSTRAINT pk_joins PRIMARY KEY(pool)
+);
+
+-- GET_JOIN
+SELECT nonce, host FROM joins WHERE pool=:pool
+
+-- SET_JOIN
+INSERT INTO joins(pool,nonce,host) VALUES(:pool,:nonce,:host)
+    ON CONFLICT(pool) DO UPDATE SET nonce=:nonce,host=:host
+	    WHERE pool=:pool
+
+-- DEL_JOIN
+DELETE FROM joins WHERE pool=:pool
+
 -- INIT
 CREATE TABLE IF NOT EXISTS slots (
     pool VARCHAR(512),
@@ -146,20 +314,56 @@ CREATE TABLE IF NOT EXISTS accesses (
     CONSTRAINT pk_safe_sig_enc PRIMARY KEY(pool,id)
 );
 
+-- INIT
+CREATE TABLE IF NOT EXISTS access_roles (
+    pool VARCHAR(128),
+    id VARCHAR(256),
+    role INTEGER,
+    CONSTRAINT pk_access_roles PRIMARY KEY(pool,id)
+);
+
 -- GET_TRUSTED_ACCESSES
-SELECT s.id, i.i64, state, modTime, ts FROM identities i INNER JOIN accesses s WHERE s.pool=:pool AND (i.id = s.id OR i.id IS NULL) AND i.trusted
+SELECT s.id, i.i64, state, modTime, ts, IFNULL(r.role, 0) FROM identities i INNER JOIN accesses s
+    LEFT JOIN access_roles r ON r.pool=s.pool AND r.id=s.id
+    WHERE s.pool=:pool AND (i.id = s.id OR i.id IS NULL) AND i.trusted
 
 -- GET_ACCESSES
-SELECT s.id, i.i64, state, modTime, ts FROM identities i INNER JOIN accesses s WHERE s.pool=:pool AND (i.id = s.id OR i.id IS NULL)
+SELECT s.id, i.i64, state, modTime, ts, IFNULL(r.role, 0) FROM identities i INNER JOIN accesses s
+    LEFT JOIN access_roles r ON r.pool=s.pool AND r.id=s.id
+    WHERE s.pool=:pool AND (i.id = s.id OR i.id IS NULL)
 
 -- GET_ACCESS
-SELECT state, modTime, ts FROM accesses s WHERE s.pool=:pool AND id = :id 
+SELECT state, modTime, ts, IFNULL(r.role, 0) FROM accesses s
+    LEFT JOIN access_roles r ON r.pool=s.pool AND r.id=s.id
+    WHERE s.pool=:pool AND s.id = :id
+
+-- SET_ACCESS_ROLE
+INSERT INTO access_roles(pool,id,role) VALUES(:pool,:id,:role)
+    ON CONFLICT(pool,id) DO UPDATE SET role=:role WHERE
+    pool=:pool AND id=:id
 
 -- SET_ACCESS
 INSERT INTO accesses(pool,id,state,modTime,ts) VALUES(:pool,:id,:state,:modTime,:ts)
     ON CONFLICT(pool,id) DO UPDATE SET state=:state,modTime=:modTime,ts=:ts WHERE
     pool=:pool AND id=:id
 
+-- INIT
+CREATE TABLE IF NOT EXISTS access_log (
+    pool VARCHAR(128) NOT NULL,
+    seq INTEGER NOT NULL,
+    entry BLOB NOT NULL,
+    CONSTRAINT pk_access_log PRIMARY KEY(pool,seq)
+);
+
+-- GET_ACCESS_LOG
+SELECT entry FROM access_log WHERE pool=:pool ORDER BY seq
+
+-- SET_ACCESS_LOG
+INSERT INTO access_log(pool,seq,entry) VALUES(:pool,:seq,:entry)
+
+-- DEL_ACCESS_LOG
+DELETE FROM access_log WHERE pool=:pool
+
 -- DEL_GRANT
 DELETE FROM accesses WHERE id=:id AND pool=:pool
 
@@ -258,3 +462,105 @@ SELECT name,path,id,authorId,modTime,size,hash,hashChain FROM library_locals WHE
 
 -- GET_LIBRARY_LOCAL
 SELECT name,path,id,authorId,modTime,size,hash,hashChain FROM library_locals WHERE pool=:pool AND base=:base AND name=:name
+
+-- INIT
+CREATE TABLE IF NOT EXISTS uploads (
+    exchanger VARCHAR(512) NOT NULL,
+    name VARCHAR(8192) NOT NULL,
+    uploadId VARCHAR(1024) NOT NULL,
+    offset INTEGER NOT NULL,
+    parts BLOB,
+    modTime INTEGER NOT NULL,
+    CONSTRAINT pk_uploads PRIMARY KEY(exchanger,name)
+);
+
+-- GET_UPLOAD
+SELECT uploadId, offset, parts, modTime FROM uploads WHERE exchanger=:exchanger AND name=:name
+
+-- SET_UPLOAD
+INSERT INTO uploads(exchanger,name,uploadId,offset,parts,modTime) VALUES(:exchanger,:name,:uploadId,:offset,:parts,:modTime)
+    ON CONFLICT(exchanger,name) DO UPDATE SET uploadId=:uploadId,offset=:offset,parts=:parts,modTime=:modTime
+	WHERE exchanger=:exchanger AND name=:name
+
+-- DEL_UPLOAD
+DELETE FROM uploads WHERE exchanger=:exchanger AND name=:name
+
+-- INIT
+CREATE TABLE IF NOT EXISTS sends (
+    pool VARCHAR(128) NOT NULL,
+    id INTEGER NOT NULL,
+    name VARCHAR(8192) NOT NULL,
+    slot VARCHAR(16) NOT NULL,
+    keyId INTEGER NOT NULL,
+    iv VARCHAR(64) NOT NULL,
+    meta VARCHAR(4096) NOT NULL,
+    modTime INTEGER NOT NULL,
+    CONSTRAINT pk_sends PRIMARY KEY(pool,id)
+);
+
+-- GET_SENDS
+SELECT id, name, slot, keyId, iv, meta, modTime FROM sends WHERE pool=:pool ORDER BY id
+
+-- GET_SEND
+SELECT id, name, slot, keyId, iv, meta, modTime FROM sends WHERE pool=:pool AND id=:id
+
+-- SET_SEND
+INSERT INTO sends(pool,id,name,slot,keyId,iv,meta,modTime) VALUES(:pool,:id,:name,:slot,:keyId,:iv,:meta,:modTime)
+
+-- DEL_SEND
+DELETE FROM sends WHERE pool=:pool AND id=:id
+
+-- INIT
+CREATE TABLE IF NOT EXISTS sendCheckpoints (
+    pool VARCHAR(128) NOT NULL,
+    id INTEGER NOT NULL,
+    offset INTEGER NOT NULL,
+    hash VARCHAR(128) NOT NULL,
+    CONSTRAINT pk_sendCheckpoints PRIMARY KEY(pool,id)
+);
+
+-- GET_SEND_CHECKPOINT
+SELECT offset, hash FROM sendCheckpoints WHERE pool=:pool AND id=:id
+
+-- SET_SEND_CHECKPOINT
+INSERT INTO sendCheckpoints(pool,id,offset,hash) VALUES(:pool,:id,:offset,:hash)
+    ON CONFLICT(pool,id) DO UPDATE SET offset=:offset,hash=:hash
+    WHERE pool=:pool AND id=:id
+
+-- DEL_SEND_CHECKPOINT
+DELETE FROM sendCheckpoints WHERE pool=:pool AND id=:id
+
+-- INIT
+CREATE TABLE IF NOT EXISTS library_blocks (
+    pool VARCHAR(128) NOT NULL,
+    base VARCHAR(128) NOT NULL,
+    name VARCHAR(4096) NOT NULL,
+    hash VARCHAR(128) NOT NULL,
+    blocks BLOB NOT NULL,
+    CONSTRAINT pk_library_blocks PRIMARY KEY(pool,base,name)
+);
+
+-- GET_LIBRARY_BLOCKS
+SELECT blocks FROM library_blocks WHERE pool=:pool AND base=:base AND name=:name AND hash=:hash
+
+-- SET_LIBRARY_BLOCKS
+INSERT INTO library_blocks(pool,base,name,hash,blocks) VALUES(:pool,:base,:name,:hash,:blocks)
+    ON CONFLICT(pool,base,name) DO UPDATE SET hash=:hash,blocks=:blocks
+	WHERE pool=:pool AND base=:base AND name=:name
+
+-- INIT
+CREATE TABLE IF NOT EXISTS library_deltas (
+    pool VARCHAR(128) NOT NULL,
+    base VARCHAR(128) NOT NULL,
+    id INTEGER NOT NULL,
+    delta BLOB NOT NULL,
+    CONSTRAINT pk_library_deltas PRIMARY KEY(pool,base,id)
+);
+
+-- GET_LIBRARY_DELTA
+SELECT delta FROM library_deltas WHERE pool=:pool AND base=:base AND id=:id
+
+-- SET_LIBRARY_DELTA
+INSERT INTO library_deltas(pool,base,id,delta) VALUES(:pool,:base,:id,:delta)
+    ON CONFLICT(pool,base,id) DO UPDATE SET delta=:delta
+	WHERE pool=:pool AND base=:base AND id=:id
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+var ErrConditionalNotSupported = errors.New("conditional writes not supported by the exchanger")
+
+// ConditionalWriter is implemented by exchangers that can write a file only when a precondition holds. It is
+// the building block for locks and for updates that must not overwrite a concurrent change
+type ConditionalWriter interface {
+	// ETag returns a tag that changes every time the file is modified
+	ETag(name string) (string, error)
+
+	// WriteIfAbsent writes the file only when it does not exist. Otherwise it returns core.ErrPreconditionFailed
+	WriteIfAbsent(name string, source io.Reader) error
+
+	// WriteIfMatch writes the file only when its current tag is etag. Otherwise it returns core.ErrPreconditionFailed
+	WriteIfMatch(name string, etag string, source io.Reader) error
+}
+
+// ETag returns the tag of the current version of a file. It returns an empty tag when the exchanger does not
+// implement ConditionalWriter
+func ETag(e Exchanger, name string) (string, error) {
+	if c, ok := e.(ConditionalWriter); ok {
+		return c.ETag(name)
+	}
+	return "", nil
+}
+
+// WriteIfMatch writes a file only when its current tag is etag; an empty etag means the file must not exist.
+// It returns ErrConditionalNotSupported when the exchanger does not implement ConditionalWriter, since a plain
+// write would silently replace a concurrent change
+func WriteIfMatch(e Exchanger, name string, etag string, source io.Reader) error {
+	c, ok := e.(ConditionalWriter)
+	switch {
+	case !ok:
+		core.IsErr(ErrConditionalNotSupported, "cannot write %s/%s: %v", e, name)
+		return ErrConditionalNotSupported
+	case etag == "":
+		return c.WriteIfAbsent(name, source)
+	default:
+		return c.WriteIfMatch(name, etag, source)
+	}
+}
+
+// contentTag is the tag for storages without native etags. It is computed from the content, so it is meant
+// for small files such as locks and access files
+func contentTag(e Exchanger, name string) (string, error) {
+	h := sha256.New()
+	err := e.Read(name, nil, h)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// exclusiveCreator is an exchanger that can create a file only when it does not exist. The call fails
+// with fs.ErrExist when the file is already present
+type exclusiveCreator interface {
+	Exchanger
+	createExclusive(name string, source io.Reader) error
+}
+
+const casGuardTimeout = time.Minute
+
+var casGuardWait = 100 * time.Millisecond
+
+func casGuardName(name string) string {
+	dir, base := path.Split(name)
+	return path.Join(dir, tempPrefix+base+".cas"+tempSuffix)
+}
+
+// writeIfMatch emulates compare-and-swap on storages that provide only exclusive creation. A guard file next to
+// the destination serializes the conditional writers. A guard older than casGuardTimeout is considered abandoned
+// and taken over, so a writer that stalls for longer between the check and the write, or two writers that take
+// over the same guard, may replace a concurrent change. For this reason the exchangers that rely on the emulation
+// implement ConditionalWriter but do not have the ConditionalWrite capability
+func writeIfMatch(e exclusiveCreator, name string, etag string, source io.Reader) error {
+	guard := casGuardName(name)
+	for {
+		err := e.createExclusive(guard, &bytes.Buffer{})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			core.IsErr(err, "cannot create guard for %s/%s: %v", e, name)
+			return err
+		}
+		if stat, err := e.Stat(guard); err == nil && core.Since(stat.ModTime()) > casGuardTimeout {
+			e.Delete(guard)
+			continue
+		}
+		time.Sleep(casGuardWait)
+	}
+	defer e.Delete(guard)
+
+	current, err := contentTag(e, name)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && current != etag {
+		return core.ErrPreconditionFailed
+	}
+	if core.IsErr(err, "cannot read tag of %s/%s: %v", e, name) {
+		return err
+	}
+	return e.Write(name, source)
+}
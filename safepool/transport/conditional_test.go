@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConditionalWrite(t *testing.T, e Exchanger) {
+	c, ok := e.(ConditionalWriter)
+	assert.True(t, ok, "%s must support conditional writes", e)
+
+	assert.NoError(t, c.WriteIfAbsent("cas/a", bytes.NewBufferString("first")))
+	assert.ErrorIs(t, c.WriteIfAbsent("cas/a", bytes.NewBufferString("second")), core.ErrPreconditionFailed)
+
+	tag, err := c.ETag("cas/a")
+	assert.NoError(t, err)
+	assert.NoError(t, c.WriteIfMatch("cas/a", tag, bytes.NewBufferString("second")))
+	assert.ErrorIs(t, c.WriteIfMatch("cas/a", tag, bytes.NewBufferString("third")), core.ErrPreconditionFailed)
+	assert.ErrorIs(t, c.WriteIfMatch("cas/b", tag, bytes.NewBufferString("third")), core.ErrPreconditionFailed)
+
+	data, err := ReadFile(e, "cas/a")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	ls, err := e.ReadDir("cas", IncludeHiddenFiles)
+	assert.NoError(t, err)
+	assert.Len(t, ls, 1, "guard files must be hidden and removed")
+}
+
+func TestConditionalWrite(t *testing.T) {
+	defer DeleteMemory("mem://test.conditional")
+
+	for _, url := range []string{"mem://test.conditional", "file://" + t.TempDir()} {
+		e, err := NewExchanger(url)
+		assert.NoErrorf(t, err, "cannot create exchanger %s: %v", url, err)
+		testConditionalWrite(t, e)
+	}
+
+	e, _ := NewExchanger("mem://test.conditional")
+	plain := struct{ Exchanger }{e}
+	err := WriteIfMatch(plain, "cas/c", "", bytes.NewBufferString("first"))
+	assert.ErrorIs(t, err, ErrConditionalNotSupported, "a plain write would replace a concurrent change")
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"errors"
+	"io"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+var ErrCopyNotSupported = errors.New("server-side copy not supported between the exchangers")
+
+// Copier is implemented by exchangers that can copy a file from another exchanger without transferring the
+// content through the client, usually when both exchangers are on the same backend
+type Copier interface {
+	// CopyFrom copies sourceName from source to destName. It returns ErrCopyNotSupported when the copy cannot
+	// be done on the server
+	CopyFrom(destName string, source Exchanger, sourceName string) error
+}
+
+// CopyFile copies a file between exchangers. The copy is done on the server when the destination is a Copier
+// for the source; otherwise the content is streamed through the client
+func CopyFile(dest Exchanger, destName string, source Exchanger, sourceName string) error {
+	if c, ok := dest.(Copier); ok {
+		err := c.CopyFrom(destName, source, sourceName)
+		if !errors.Is(err, ErrCopyNotSupported) {
+			return err
+		}
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	errs := make(chan error, 1)
+	go func() {
+		err := source.Read(sourceName, nil, pw)
+		pw.CloseWithError(err)
+		errs <- err
+	}()
+
+	err := dest.Write(destName, pr)
+	pr.CloseWithError(err)
+	if err2 := <-errs; err2 != nil {
+		err = err2
+	}
+	core.IsErr(err, "cannot copy %s/%s to %s/%s: %v", source, sourceName, dest, destName)
+	return err
+}
@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func testCopyFile(t *testing.T, dest Exchanger, source Exchanger) {
+	data := []byte("just a simple test")
+	assert.NoError(t, WriteFile(source, "pool/feeds/1.body", data))
+	assert.NoError(t, CopyFile(dest, "pool/feeds/1.body", source, "pool/feeds/1.body"))
+
+	b, err := ReadFile(dest, "pool/feeds/1.body")
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	assert.Error(t, CopyFile(dest, "pool/feeds/2.body", source, "pool/feeds/2.body"))
+}
+
+func TestCopyFile(t *testing.T) {
+	defer DeleteMemory("mem://test.copy.a")
+	defer DeleteMemory("mem://test.copy.b")
+	m1, _ := NewExchanger("mem://test.copy.a")
+	m2, _ := NewExchanger("mem://test.copy.b")
+	testCopyFile(t, m1, m2)
+
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	l1, _ := NewExchanger("file://" + dir1)
+	l2, _ := NewExchanger("file://" + dir2)
+	testCopyFile(t, l1, l2)
+	s1, _ := os.Stat(filepath.Join(dir1, "pool/feeds/1.body"))
+	s2, _ := os.Stat(filepath.Join(dir2, "pool/feeds/1.body"))
+	assert.True(t, os.SameFile(s1, s2), "local copies must be links")
+
+	testCopyFile(t, m1, l1)
+
+	server := httptest.NewServer(&webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	w1, _ := NewExchanger("webdav://" + host + "/a")
+	w2, _ := NewExchanger("webdav://" + host + "/b")
+	testCopyFile(t, w1, w2)
+}
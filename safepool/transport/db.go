@@ -0,0 +1,37 @@
+package transport
+
+import (
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/sql"
+)
+
+func sqlGetUpload(exchanger, name string) (uploadState, error) {
+	var s uploadState
+	var modTime int64
+	err := sql.QueryRow("GET_UPLOAD", sql.Args{"exchanger": exchanger, "name": name},
+		&s.UploadId, &s.Offset, &s.Parts, &modTime)
+	if err != nil {
+		return uploadState{}, err
+	}
+	s.ModTime = sql.DecodeTime(modTime)
+	return s, nil
+}
+
+func sqlSetUpload(exchanger, name string, s uploadState) error {
+	_, err := sql.Exec("SET_UPLOAD", sql.Args{
+		"exchanger": exchanger,
+		"name":      name,
+		"uploadId":  s.UploadId,
+		"offset":    s.Offset,
+		"parts":     s.Parts,
+		"modTime":   sql.EncodeTime(core.Now()),
+	})
+	core.IsErr(err, "cannot save upload state for %s/%s: %v", exchanger, name)
+	return err
+}
+
+func sqlDelUpload(exchanger, name string) error {
+	_, err := sql.Exec("DEL_UPLOAD", sql.Args{"exchanger": exchanger, "name": name})
+	core.IsErr(err, "cannot delete upload state for %s/%s: %v", exchanger, name)
+	return err
+}
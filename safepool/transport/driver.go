@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+// Capability is a feature an exchanger supports natively. The pool uses capabilities to choose the best
+// strategy for an operation
+type Capability uint32
+
+const (
+	// RangeRead means the exchanger can read a portion of a file without transferring the full content
+	RangeRead Capability = 1 << iota
+	// AtomicRename means a rename replaces the destination in a single step
+	AtomicRename
+	// ServerSideCopy means the exchanger can copy a file without transferring the content through the client.
+	// The exchanger implements Copier
+	ServerSideCopy
+	// ConditionalWrite means the storage can write a file only when it does not exist or has not changed.
+	// The exchanger implements ConditionalWriter. Exchangers that emulate conditional writes with a guard file
+	// implement ConditionalWriter without the capability
+	ConditionalWrite
+)
+
+// Driver describes how to create exchangers for a url scheme
+type Driver struct {
+	// New creates an exchanger for the connection url
+	New func(connectionUrl string) (Exchanger, error)
+
+	// Validate checks the connection url without connecting to the storage. It is optional
+	Validate func(connectionUrl string) error
+
+	// Capabilities are the features supported by all exchangers created with the driver
+	Capabilities Capability
+}
+
+// Capable is implemented by exchangers whose capabilities depend on the connection and not only on the driver
+type Capable interface {
+	Capabilities() Capability
+}
+
+var drivers = map[string]Driver{}
+var driversMutex sync.RWMutex
+
+func init() {
+	Register("sftp", Driver{
+		New:          NewSFTP,
+		Validate:     validateSFTPUrl,
+		Capabilities: RangeRead | AtomicRename,
+	})
+	Register("s3", Driver{
+		New:          NewS3,
+		Validate:     validateS3Url,
+		Capabilities: RangeRead | ServerSideCopy | ConditionalWrite,
+	})
+	Register("webdav", Driver{
+		New:          NewWebDAV,
+		Validate:     validateWebDAVUrl,
+		Capabilities: RangeRead | AtomicRename | ServerSideCopy | ConditionalWrite,
+	})
+	Register("webdavs", Driver{
+		New:          NewWebDAV,
+		Validate:     validateWebDAVUrl,
+		Capabilities: RangeRead | AtomicRename | ServerSideCopy | ConditionalWrite,
+	})
+	Register("file", Driver{
+		New:          NewLocal,
+		Capabilities: RangeRead | AtomicRename | ServerSideCopy,
+	})
+	Register("mem", Driver{
+		New:          NewMemory,
+		Capabilities: RangeRead | AtomicRename | ServerSideCopy | ConditionalWrite,
+	})
+}
+
+// Register makes a driver available for the provided url scheme (e.g. sftp). A driver registered with the
+// same scheme of an existing one replaces it
+func Register(scheme string, d Driver) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	drivers[strings.ToLower(scheme)] = d
+}
+
+// Schemes returns the url schemes with a registered driver
+func Schemes() []string {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+
+	var schemes []string
+	for s := range drivers {
+		schemes = append(schemes, s)
+	}
+	return schemes
+}
+
+// getDriver returns the driver for the scheme of the connection url. The rest of the url is not parsed here, so
+// that urls accepted by a driver, e.g. sftp passwords with characters invalid in a url, are not refused
+func getDriver(connectionUrl string) (Driver, error) {
+	scheme, _, found := strings.Cut(connectionUrl, "://")
+	if !found {
+		core.IsErr(core.ErrNoDriver, "missing scheme in url '%s': %v", connectionUrl)
+		return Driver{}, core.ErrNoDriver
+	}
+
+	driversMutex.RLock()
+	d, ok := drivers[strings.ToLower(scheme)]
+	driversMutex.RUnlock()
+	if !ok || d.New == nil {
+		return Driver{}, core.ErrNoDriver
+	}
+	return d, nil
+}
+
+// parseUrl parses a connection url like url.Parse. When the user info has characters that are not valid in a url,
+// e.g. '^' in a password, the user info is taken as it is, up to the last '@'
+func parseUrl(connectionUrl string) (*url.URL, error) {
+	u, err := url.Parse(connectionUrl)
+	if err == nil {
+		return u, nil
+	}
+
+	scheme, rest, _ := strings.Cut(connectionUrl, "://")
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return nil, err
+	}
+	u, hostErr := url.Parse(scheme + "://" + rest[at+1:])
+	if hostErr != nil {
+		return nil, err
+	}
+	if username, password, ok := strings.Cut(rest[:at], ":"); ok {
+		u.User = url.UserPassword(username, password)
+	} else {
+		u.User = url.User(username)
+	}
+	return u, nil
+}
+
+// ValidateUrl checks that a driver exists for the connection url and that the url is valid for the driver
+func ValidateUrl(connectionUrl string) error {
+	d, err := getDriver(connectionUrl)
+	if err != nil {
+		return err
+	}
+	if d.Validate != nil {
+		return d.Validate(connectionUrl)
+	}
+	return nil
+}
+
+// Capabilities returns the features supported by the exchanger
+func Capabilities(e Exchanger) Capability {
+	if c, ok := e.(Capable); ok {
+		return c.Capabilities()
+	}
+
+	d, err := getDriver(e.String())
+	if err != nil {
+		return 0
+	}
+	return d.Capabilities
+}
+
+// HasCapability returns true when the exchanger supports the provided feature
+func HasCapability(e Exchanger, c Capability) bool {
+	return Capabilities(e)&c == c
+}
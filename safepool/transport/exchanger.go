@@ -1,12 +1,16 @@
 package transport
 
 import (
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"strings"
 
 	"github.com/code-to-go/safe/safepool/core"
+
+	"github.com/godruoyi/go-snowflake"
 )
 
 type Source struct {
@@ -25,6 +29,28 @@ const (
 	IncludeHiddenFiles ListOption = 1
 )
 
+// Temporary files are written next to the destination with a hidden name and renamed into place when
+// complete. They are never returned by ReadDir
+const (
+	tempPrefix = ".~"
+	tempSuffix = ".tmp"
+)
+
+func tempName(name string) string {
+	dir, base := path.Split(name)
+	return path.Join(dir, fmt.Sprintf("%s%s.%d%s", tempPrefix, base, snowflake.ID(), tempSuffix))
+}
+
+func isTempName(name string) bool {
+	name = path.Base(name)
+	return strings.HasPrefix(name, tempPrefix) && strings.HasSuffix(name, tempSuffix)
+}
+
+// hideFile returns true when an entry must not be returned by ReadDir
+func hideFile(name string, opts ListOption) bool {
+	return isTempName(name) || opts&IncludeHiddenFiles == 0 && strings.HasPrefix(name, ".")
+}
+
 type Range struct {
 	From int64
 	To   int64
@@ -39,10 +65,11 @@ type Exchanger interface {
 	// Read reads data from a file into a writer
 	Read(name string, rang *Range, dest io.Writer) error
 
-	// Write writes data to a file name. An existing file is overwritten
+	// Write writes data to a file name. An existing file is overwritten atomically, so that a concurrent reader
+	// gets either the old or the new content and never a partial file
 	Write(name string, source io.Reader) error
 
-	//ReadDir returns the entries of a folder content
+	//ReadDir returns the entries of a folder content, including sub-folders. Backends that list in pages return all of them
 	ReadDir(name string, opts ListOption) ([]fs.FileInfo, error)
 
 	// Stat provides statistics about a file
@@ -61,16 +88,18 @@ type Exchanger interface {
 	String() string
 }
 
-// NewExchanger creates a new exchanger giving a provided configuration
+// NewExchanger creates a new exchanger giving a provided configuration. The driver is chosen with the url scheme
 func NewExchanger(connectionUrl string) (Exchanger, error) {
-	switch {
-	case strings.HasPrefix(connectionUrl, "sftp://"):
-		return NewSFTP(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "s3://"):
-		return NewS3(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "file:/"):
-		return NewLocal(connectionUrl)
+	d, err := getDriver(connectionUrl)
+	if core.IsErr(err, "no driver for '%s': %v", connectionUrl) {
+		return nil, err
 	}
 
-	return nil, core.ErrNoDriver
+	if d.Validate != nil {
+		err = d.Validate(connectionUrl)
+		if core.IsErr(err, "invalid url '%s': %v", connectionUrl) {
+			return nil, err
+		}
+	}
+	return d.New(connectionUrl)
 }
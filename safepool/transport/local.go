@@ -2,6 +2,7 @@ package transport
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -57,24 +58,17 @@ func (l *Local) Read(name string, rang *Range, dest io.Writer) error {
 	if core.IsErr(err, "cannot open file on %v:%v", l) {
 		return err
 	}
+	defer f.Close()
 
 	if rang == nil {
 		_, err = io.Copy(dest, f)
 	} else {
-		left := rang.To - rang.From
-		f.Seek(rang.From, 0)
-		var b [4096]byte
-
-		for left > 0 && err == nil {
-			var sz int64
-			if rang.From-rang.To > 4096 {
-				sz = 4096
-			} else {
-				sz = rang.From - rang.To
-			}
-			_, err = f.Read(b[0:sz])
-			dest.Write(b[0:sz])
-			left -= sz
+		_, err = f.Seek(rang.From, 0)
+		if err == nil {
+			_, err = io.CopyN(dest, f, rang.To-rang.From)
+		}
+		if err == io.EOF {
+			err = nil
 		}
 	}
 	if core.IsErr(err, "cannot read from %s/%s:%v", l, name) {
@@ -95,25 +89,134 @@ func (l *Local) Write(name string, source io.Reader) error {
 		return err
 	}
 
-	f, err := os.Create(n)
+	f, err := os.CreateTemp(filepath.Dir(n), tempPrefix+filepath.Base(n)+".*"+tempSuffix)
 	if core.IsErr(err, "cannot create file on %v:%v", l) {
 		return err
 	}
-	defer f.Close()
+	tmp := f.Name()
+
+	_, err = io.Copy(f, source)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, n)
+	}
+	if core.IsErr(err, "cannot copy file on %v:%v", l) {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (l *Local) createExclusive(name string, source io.Reader) error {
+	n := filepath.Join(l.base, name)
+	err := createDir(n)
+	if err != nil {
+		return err
+	}
 
+	f, err := os.OpenFile(n, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
 	_, err = io.Copy(f, source)
-	core.IsErr(err, "cannot copy file on %v:%v", l)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(n)
+	}
 	return err
 }
 
+func (l *Local) ETag(name string) (string, error) {
+	return contentTag(l, name)
+}
+
+func (l *Local) WriteIfAbsent(name string, source io.Reader) error {
+	err := l.createExclusive(name, source)
+	if errors.Is(err, fs.ErrExist) {
+		return core.ErrPreconditionFailed
+	}
+	core.IsErr(err, "cannot create file on %v:%v", l)
+	return err
+}
+
+func (l *Local) WriteIfMatch(name string, etag string, source io.Reader) error {
+	return writeIfMatch(l, name, etag, source)
+}
+
+func (l *Local) WriteResumable(name string, source io.Reader) error {
+	return writePartial(l, name, source, func(tmp string) (partialFile, error) {
+		n := filepath.Join(l.base, tmp)
+		err := createDir(n)
+		if err != nil {
+			return nil, err
+		}
+		return os.OpenFile(n, os.O_WRONLY|os.O_CREATE, 0644)
+	}, func(tmp, name string) error {
+		return os.Rename(filepath.Join(l.base, tmp), filepath.Join(l.base, name))
+	})
+}
+
+func (l *Local) AbortWrite(name string) error {
+	err := os.Remove(filepath.Join(l.base, uploadTempName(name)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return sqlDelUpload(l.String(), name)
+}
+
+// CopyFrom links the source file when both exchangers are local. Pool files are never modified in place, so a
+// hard link is as good as a copy
+func (l *Local) CopyFrom(destName string, source Exchanger, sourceName string) error {
+	src, ok := source.(*Local)
+	if !ok {
+		return ErrCopyNotSupported
+	}
+
+	n := filepath.Join(l.base, destName)
+	err := createDir(n)
+	if core.IsErr(err, "cannot create parent of %s: %v", n) {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(n), tempName(filepath.Base(n)))
+	err = os.Link(filepath.Join(src.base, sourceName), tmp)
+	if errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err != nil {
+		// links fail across devices and on some file systems
+		return ErrCopyNotSupported
+	}
+
+	err = os.Rename(tmp, n)
+	if core.IsErr(err, "cannot copy file on %v:%v", l) {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 func (l *Local) ReadDir(dir string, opts ListOption) ([]fs.FileInfo, error) {
-	result, err := os.ReadDir(dir)
+	result, err := os.ReadDir(filepath.Join(l.base, dir))
 	if err != nil {
 		return nil, err
 	}
 
 	var infos []fs.FileInfo
 	for _, item := range result {
+		if hideFile(item.Name(), opts) {
+			continue
+		}
 		info, err := item.Info()
 		if err == nil {
 			infos = append(infos, info)
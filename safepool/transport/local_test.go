@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("connection lost")
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestLocalAtomicWrite(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewExchanger("file://" + dir)
+	assert.NoErrorf(t, err, "cannot create local exchanger: %v", err)
+	testCreateFile(t, l)
+
+	assert.NoError(t, WriteFile(l, "pool/.access", []byte("first")))
+	err = l.Write("pool/.access", &failingReader{data: []byte("second")})
+	assert.Error(t, err)
+
+	data, err := ReadFile(l, "pool/.access")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data), "a failed write must not modify the destination")
+
+	ls, err := os.ReadDir(filepath.Join(dir, "pool"))
+	assert.NoError(t, err)
+	assert.Len(t, ls, 1, "a failed write must not leave temporary files")
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "pool", tempName(".access")), []byte("in flight"), 0644))
+	infos, err := l.ReadDir("pool", IncludeHiddenFiles)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, ".access", infos[0].Name())
+
+	var b bytes.Buffer
+	assert.NoError(t, l.Read("pool/.access", &Range{From: 1, To: 3}, &b))
+	assert.Equal(t, "ir", b.String())
+}
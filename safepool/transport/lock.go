@@ -1,63 +1,260 @@
 package transport
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
 	"time"
 
 	"github.com/code-to-go/safe/safepool/core"
 
 	"github.com/godruoyi/go-snowflake"
+	"github.com/sirupsen/logrus"
 )
 
+var ErrLockTimeout = errors.New("timeout while waiting for lock")
+var ErrLeaseLost = errors.New("lease has been taken over by another holder")
+
 type lockFileContent struct {
-	Id   uint64
-	Span time.Duration
+	Id       uint64
+	Holder   string
+	Span     time.Duration
+	Renewed  time.Time
+	Released bool `json:",omitempty"`
 }
 
-func waitLock(e Exchanger, name string) {
-	var c lockFileContent
-	var err error
-	var id uint64
-	var shot time.Time
-
-	for shot.IsZero() && core.Since(shot) > c.Span {
-		id = c.Id
-		err = ReadJSON(e, name, &c, nil)
-		if err != nil {
-			return
+var lockPollInterval = time.Second
+
+// LockSettleTime is how long a lock written on an exchanger without conditional writes is left to settle before
+// reading it back. It should exceed the time the storage takes to make a write visible to other clients
+var LockSettleTime = time.Second
+
+// Lease is a lock on a file held for a span of time. The lease is renewed in background until it is released;
+// a lease that is not renewed within its span expires and can be taken over by another holder
+type Lease struct {
+	Id     uint64
+	Holder string
+
+	e     Exchanger
+	name  string
+	span  time.Duration
+	tag   string
+	err   error
+	mutex sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// AcquireLease creates the lock file name on the exchanger and keeps it alive until Release is called. holder
+// identifies the owner in the lock file (e.g. the user id). When the file is locked by someone else, AcquireLease
+// waits until the lock is released or expires. It returns ErrLockTimeout when ctx reaches its deadline
+func AcquireLease(ctx context.Context, e Exchanger, name string, holder string, span time.Duration) (*Lease, error) {
+	l := &Lease{
+		Id:     snowflake.ID(),
+		Holder: holder,
+		e:      e,
+		name:   name,
+		span:   span,
+	}
+
+	var held lockFileContent
+	var heldTag string
+	var since time.Time
+	for {
+		err := l.write("")
+		if err == nil {
+			l.startRenewal()
+			return l, nil
 		}
-		if c.Id != id {
-			shot = core.Now()
+		if !errors.Is(err, core.ErrPreconditionFailed) {
+			core.IsErr(err, "cannot write lock file %s: %v", name)
+			return nil, err
+		}
+
+		tag, err := l.currentTag()
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			heldTag = ""
+		case core.IsErr(err, "cannot read lock file %s: %v", name):
+			return nil, err
+		case tag != heldTag:
+			heldTag, since = tag, core.Now()
+			if ReadJSON(e, name, &held, nil) != nil {
+				held = lockFileContent{Span: span}
+			}
+			if !held.Released {
+				break
+			}
+			fallthrough
+		case core.Since(since) > held.Span:
+			err = l.write(tag)
+			if err == nil {
+				if !held.Released {
+					logrus.Infof("lock %s expired and taken over from %s", name, held.Holder)
+				}
+				l.startRenewal()
+				return l, nil
+			}
+			if !errors.Is(err, core.ErrPreconditionFailed) {
+				core.IsErr(err, "cannot take over lock file %s: %v", name)
+				return nil, err
+			}
+			heldTag = ""
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("%w: %s is held by %s", ErrLockTimeout, name, held.Holder)
+			}
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
 		}
-		time.Sleep(time.Second)
 	}
 }
 
-func LockFile(e Exchanger, name string, span time.Duration) (uint64, error) {
-	var c lockFileContent
-	id := snowflake.ID()
-	for c.Id != id {
-		waitLock(e, name)
-
-		err := WriteJSON(e, name, lockFileContent{
-			Id:   id,
-			Span: span,
-		}, nil)
-		if core.IsErr(err, "cannot write lock file %s: %v", name) {
-			return 0, err
+func (l *Lease) currentTag() (string, error) {
+	if c, ok := l.e.(ConditionalWriter); ok {
+		return c.ETag(l.name)
+	}
+	return contentTag(l.e, l.name)
+}
+
+// write stores the lock file when its current tag is etag; an empty etag means the file must not exist
+func (l *Lease) write(etag string) error {
+	return l.put(etag, lockFileContent{
+		Id:      l.Id,
+		Holder:  l.Holder,
+		Span:    l.span,
+		Renewed: core.Now(),
+	})
+}
+
+// put stores c in the lock file when its current tag is etag. Exchangers without conditional writes check the tag,
+// write and read back the file after LockSettleTime. A released lock is not read back, since the next holder may
+// take it over at once
+func (l *Lease) put(etag string, c lockFileContent) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := l.e.(ConditionalWriter); ok {
+		err = WriteIfMatch(l.e, l.name, etag, bytes.NewReader(data))
+	} else {
+		err = l.writeAndCheck(etag, data, !c.Released)
+	}
+	if err != nil || c.Released {
+		return err
+	}
+
+	tag, err := l.currentTag()
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.tag = tag
+	l.mutex.Unlock()
+	return nil
+}
+
+func (l *Lease) writeAndCheck(etag string, data []byte, readBack bool) error {
+	current, err := contentTag(l.e, l.name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if etag != "" {
+			return core.ErrPreconditionFailed
 		}
-		time.Sleep(time.Second)
-		err = ReadJSON(e, name, &c, nil)
-		if core.IsErr(err, "cannot read lock file %s: %v", name) {
-			return 0, err
+	case err != nil:
+		return err
+	case current != etag:
+		return core.ErrPreconditionFailed
+	}
+
+	err = l.e.Write(l.name, bytes.NewReader(data))
+	if err != nil || !readBack {
+		return err
+	}
+	time.Sleep(LockSettleTime)
+
+	var c lockFileContent
+	err = ReadJSON(l.e, l.name, &c, nil)
+	if err != nil {
+		return err
+	}
+	if c.Id != l.Id {
+		return core.ErrPreconditionFailed
+	}
+	return nil
+}
+
+func (l *Lease) startRenewal() {
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.renew()
+}
+
+func (l *Lease) renew() {
+	defer close(l.done)
+	period := l.span / 3
+	if period <= 0 {
+		period = lockPollInterval
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mutex.Lock()
+			tag := l.tag
+			l.mutex.Unlock()
+
+			err := l.write(tag)
+			if errors.Is(err, core.ErrPreconditionFailed) {
+				core.IsErr(ErrLeaseLost, "cannot renew lock %s: %v", l.name)
+				l.mutex.Lock()
+				l.err = ErrLeaseLost
+				l.mutex.Unlock()
+				return
+			}
+			core.IsErr(err, "cannot renew lock %s: %v", l.name)
 		}
 	}
-	return id, nil
 }
 
-func UnlockFile(e Exchanger, name string, id uint64) {
-	var c lockFileContent
-	_ = ReadJSON(e, name, &c, nil)
-	if c.Id == id {
-		e.Delete(name)
+// Err returns ErrLeaseLost when the lease could not be renewed in time and another holder took it over
+func (l *Lease) Err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.err
+}
+
+// Release stops the renewal and marks the lock file as released when it is still held by the lease. The mark is a
+// conditional write, so the lock of another holder is never touched; the next holder takes over a released lock
+// at once. The file is not deleted, since a deletion cannot be conditional
+func (l *Lease) Release() error {
+	close(l.stop)
+	<-l.done
+
+	if err := l.Err(); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	tag := l.tag
+	l.mutex.Unlock()
+	err := l.put(tag, lockFileContent{Id: l.Id, Holder: l.Holder, Renewed: core.Now(), Released: true})
+	if errors.Is(err, core.ErrPreconditionFailed) {
+		core.IsErr(ErrLeaseLost, "cannot release lock %s: %v", l.name)
+		return ErrLeaseLost
 	}
+	core.IsErr(err, "cannot release lock %s: %v", l.name)
+	return err
 }
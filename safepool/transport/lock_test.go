@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// plainExchanger hides the conditional writes of the wrapped exchanger
+type plainExchanger struct {
+	Exchanger
+}
+
+func testLeaseExclusion(t *testing.T, url string, wrap bool) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var holders, overlaps int
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, _ := NewExchanger(url)
+			if wrap {
+				e = plainExchanger{e}
+			}
+			for j := 0; j < 3; j++ {
+				l, err := AcquireLease(context.Background(), e, "pool/.access.lock", "holder", time.Minute)
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				mutex.Lock()
+				holders++
+				if holders > 1 {
+					overlaps++
+				}
+				mutex.Unlock()
+				time.Sleep(time.Millisecond)
+				mutex.Lock()
+				holders--
+				mutex.Unlock()
+
+				assert.NoError(t, l.Release())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Zero(t, overlaps, "the lock must be held by one owner at a time")
+}
+
+func TestLease(t *testing.T) {
+	url := "mem://test.lease"
+	defer DeleteMemory(url)
+	lockPollInterval = 10 * time.Millisecond
+	LockSettleTime = time.Millisecond
+
+	testLeaseExclusion(t, url, false)
+	testLeaseExclusion(t, url, true)
+
+	e, _ := NewExchanger(url)
+	l, err := AcquireLease(context.Background(), e, "pool/.access.lock", "alice", 60*time.Millisecond)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = AcquireLease(ctx, e, "pool/.access.lock", "bob", time.Minute)
+	assert.ErrorIs(t, err, ErrLockTimeout, "a renewed lease must not expire")
+	assert.NoError(t, l.Err())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = AcquireLease(ctx, e, "pool/.access.lock", "bob", time.Minute)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoError(t, l.Release())
+
+	assert.NoError(t, WriteJSON(e, "pool/.access.lock", lockFileContent{Id: 1, Holder: "crashed", Span: 50 * time.Millisecond}, nil))
+	l, err = AcquireLease(context.Background(), e, "pool/.access.lock", "bob", 60*time.Millisecond)
+	assert.NoError(t, err, "an expired lease must be taken over")
+	assert.Equal(t, "bob", l.Holder)
+
+	assert.NoError(t, WriteJSON(e, "pool/.access.lock", lockFileContent{Id: 2, Holder: "alice"}, nil))
+	time.Sleep(100 * time.Millisecond)
+	assert.ErrorIs(t, l.Err(), ErrLeaseLost)
+	assert.ErrorIs(t, l.Release(), ErrLeaseLost)
+
+	// a lease taken over before the renewal notices is not released
+	l, err = AcquireLease(context.Background(), e, "pool/.access.lock", "bob", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, WriteJSON(e, "pool/.access.lock", lockFileContent{Id: 3, Holder: "alice", Span: time.Minute}, nil))
+	assert.ErrorIs(t, l.Release(), ErrLeaseLost)
+	var c lockFileContent
+	assert.NoError(t, ReadJSON(e, "pool/.access.lock", &c, nil))
+	assert.Equal(t, "alice", c.Holder, "the lock of another holder must not be removed")
+
+	// a released lease is taken over at once
+	assert.NoError(t, WriteJSON(e, "pool/.access.lock", lockFileContent{Id: 4, Holder: "alice", Released: true}, nil))
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	l, err = AcquireLease(ctx, e, "pool/.access.lock", "bob", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Release())
+}
@@ -0,0 +1,424 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+)
+
+// MemoryFaults configures the faults injected by a memory exchanger. It is meant for tests that need
+// to verify the behavior of the pool when the storage is slow or unreliable
+type MemoryFaults struct {
+	// Latency is added to every operation
+	Latency time.Duration
+
+	// Fail is called before every operation with the operation name (e.g. "read", "write") and the file name.
+	// When it returns an error, the operation fails with that error
+	Fail func(op, name string) error
+
+	// PartialWrite when greater than 0 truncates every write to the provided number of bytes and makes the
+	// write fail with io.ErrShortWrite. The truncated content is left in a temporary file, like an interrupted
+	// upload, while the destination is not modified
+	PartialWrite int64
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+	version uint64
+}
+
+type memoryStore struct {
+	mutex sync.RWMutex
+	files map[string]memoryFile
+	// deleted holds the version at which a file was deleted or renamed, so that Touched sees the change
+	deleted map[string]uint64
+	version uint64
+	faults  MemoryFaults
+}
+
+var memoryStores = map[string]*memoryStore{}
+var memoryStoresMutex sync.Mutex
+
+// Memory is an exchanger that keeps data in memory. Exchangers with the same url share the same content
+// for the lifetime of the process. It is mainly used for tests and when the library is embedded
+type Memory struct {
+	store *memoryStore
+	url   string
+	touch map[string]uint64
+	mutex sync.Mutex
+}
+
+// NewMemory creates a new Exchanger. The url is in the format mem://name
+func NewMemory(connectionUrl string) (Exchanger, error) {
+	u, err := url.Parse(connectionUrl)
+	if core.IsErr(err, "invalid URL: %v") {
+		return nil, err
+	}
+
+	key := path.Join(u.Host, u.Path)
+	memoryStoresMutex.Lock()
+	defer memoryStoresMutex.Unlock()
+
+	store, ok := memoryStores[key]
+	if !ok {
+		store = &memoryStore{files: map[string]memoryFile{}, deleted: map[string]uint64{}}
+		memoryStores[key] = store
+	}
+	return &Memory{
+		store: store,
+		url:   connectionUrl,
+		touch: map[string]uint64{},
+	}, nil
+}
+
+// SetMemoryFaults sets the faults injected in all the memory exchangers with the provided url
+func SetMemoryFaults(connectionUrl string, faults MemoryFaults) error {
+	e, err := NewMemory(connectionUrl)
+	if err != nil {
+		return err
+	}
+
+	m := e.(*Memory)
+	m.store.mutex.Lock()
+	m.store.faults = faults
+	m.store.mutex.Unlock()
+	return nil
+}
+
+// DeleteMemory removes all the content stored by memory exchangers with the provided url
+func DeleteMemory(connectionUrl string) error {
+	u, err := url.Parse(connectionUrl)
+	if core.IsErr(err, "invalid URL: %v") {
+		return err
+	}
+
+	memoryStoresMutex.Lock()
+	delete(memoryStores, path.Join(u.Host, u.Path))
+	memoryStoresMutex.Unlock()
+	return nil
+}
+
+func memoryKey(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+func (m *Memory) inject(op, name string) error {
+	m.store.mutex.RLock()
+	faults := m.store.faults
+	m.store.mutex.RUnlock()
+
+	if faults.Latency > 0 {
+		time.Sleep(faults.Latency)
+	}
+	if faults.Fail != nil {
+		return faults.Fail(op, name)
+	}
+	return nil
+}
+
+func (m *Memory) Touched(name string) bool {
+	prefix := memoryKey(name)
+
+	m.store.mutex.RLock()
+	var version uint64
+	for k, f := range m.store.files {
+		if (prefix == "" || k == prefix || strings.HasPrefix(k, prefix+"/")) && f.version > version {
+			version = f.version
+		}
+	}
+	for k, v := range m.store.deleted {
+		if (prefix == "" || k == prefix || strings.HasPrefix(k, prefix+"/")) && v > version {
+			version = v
+		}
+	}
+	m.store.mutex.RUnlock()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	last, ok := m.touch[prefix]
+	if ok && version <= last {
+		return false
+	}
+	m.touch[prefix] = version
+	return true
+}
+
+func (m *Memory) Read(name string, rang *Range, dest io.Writer) error {
+	err := m.inject("read", name)
+	if core.IsErr(err, "cannot read from %s/%s:%v", m, name) {
+		return err
+	}
+
+	m.store.mutex.RLock()
+	f, ok := m.store.files[memoryKey(name)]
+	m.store.mutex.RUnlock()
+	if !ok {
+		return fs.ErrNotExist
+	}
+
+	data := f.data
+	if rang != nil {
+		from, to := rang.From, rang.To
+		if to > int64(len(data)) {
+			to = int64(len(data))
+		}
+		if from > to {
+			from = to
+		}
+		data = data[from:to]
+	}
+
+	_, err = io.Copy(dest, bytes.NewReader(data))
+	if core.IsErr(err, "cannot read from %s/%s:%v", m, name) {
+		return err
+	}
+	return nil
+}
+
+func (m *Memory) Write(name string, source io.Reader) error {
+	return m.write(name, source, nil)
+}
+
+func (m *Memory) ETag(name string) (string, error) {
+	err := m.inject("stat", name)
+	if err != nil {
+		return "", err
+	}
+
+	m.store.mutex.RLock()
+	defer m.store.mutex.RUnlock()
+	f, ok := m.store.files[memoryKey(name)]
+	if !ok {
+		return "", fs.ErrNotExist
+	}
+	return strconv.FormatUint(f.version, 16), nil
+}
+
+func (m *Memory) WriteIfAbsent(name string, source io.Reader) error {
+	return m.write(name, source, func(f memoryFile, ok bool) bool {
+		return !ok
+	})
+}
+
+func (m *Memory) WriteIfMatch(name string, etag string, source io.Reader) error {
+	return m.write(name, source, func(f memoryFile, ok bool) bool {
+		return ok && strconv.FormatUint(f.version, 16) == etag
+	})
+}
+
+// write stores the content when cond is nil or returns true for the current version of the file
+func (m *Memory) write(name string, source io.Reader, cond func(f memoryFile, ok bool) bool) error {
+	err := m.inject("write", name)
+	if core.IsErr(err, "cannot write %s/%s: %v", m, name) {
+		return err
+	}
+
+	data, err := io.ReadAll(source)
+	if core.IsErr(err, "cannot write %s/%s: %v", m, name) {
+		return err
+	}
+
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	k := memoryKey(name)
+	if cond != nil {
+		f, ok := m.store.files[k]
+		if !cond(f, ok) {
+			return core.ErrPreconditionFailed
+		}
+	}
+
+	partial := m.store.faults.PartialWrite
+	if partial > 0 && int64(len(data)) > partial {
+		data = data[0:partial]
+		err = io.ErrShortWrite
+		k = memoryKey(tempName(k))
+	}
+
+	m.store.version++
+	m.store.files[k] = memoryFile{
+		data:    data,
+		modTime: core.Now(),
+		version: m.store.version,
+	}
+	delete(m.store.deleted, k)
+	core.IsErr(err, "cannot write %s/%s: %v", m, name)
+	return err
+}
+
+// CopyFrom copies between memory exchangers without going through a reader
+func (m *Memory) CopyFrom(destName string, source Exchanger, sourceName string) error {
+	src, ok := source.(*Memory)
+	if !ok {
+		return ErrCopyNotSupported
+	}
+
+	src.store.mutex.RLock()
+	f, ok := src.store.files[memoryKey(sourceName)]
+	src.store.mutex.RUnlock()
+	if !ok {
+		return fs.ErrNotExist
+	}
+	return m.write(destName, bytes.NewReader(f.data), nil)
+}
+
+func (m *Memory) ReadDir(dir string, opts ListOption) ([]fs.FileInfo, error) {
+	err := m.inject("readDir", dir)
+	if core.IsErr(err, "cannot list %s/%s: %v", m, dir) {
+		return nil, err
+	}
+
+	prefix := memoryKey(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	m.store.mutex.RLock()
+	defer m.store.mutex.RUnlock()
+
+	entries := map[string]simpleFileInfo{}
+	for k, f := range m.store.files {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		name := k[len(prefix):]
+		if idx := strings.Index(name, "/"); idx != -1 {
+			name = name[0:idx]
+			info := entries[name]
+			if f.modTime.After(info.modTime) {
+				info.modTime = f.modTime
+			}
+			info.name, info.isDir = name, true
+			entries[name] = info
+		} else {
+			entries[name] = simpleFileInfo{
+				name:    name,
+				size:    int64(len(f.data)),
+				modTime: f.modTime,
+			}
+		}
+	}
+	if len(entries) == 0 && prefix != "" {
+		return nil, fs.ErrNotExist
+	}
+
+	var infos []fs.FileInfo
+	for name, info := range entries {
+		if hideFile(name, opts) {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (m *Memory) Stat(name string) (os.FileInfo, error) {
+	err := m.inject("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	k := memoryKey(name)
+	m.store.mutex.RLock()
+	defer m.store.mutex.RUnlock()
+
+	if f, ok := m.store.files[k]; ok {
+		return simpleFileInfo{
+			name:    path.Base(k),
+			size:    int64(len(f.data)),
+			modTime: f.modTime,
+		}, nil
+	}
+
+	var modTime time.Time
+	var found bool
+	for n, f := range m.store.files {
+		if k == "" || strings.HasPrefix(n, k+"/") {
+			found = true
+			if f.modTime.After(modTime) {
+				modTime = f.modTime
+			}
+		}
+	}
+	if !found {
+		return nil, fs.ErrNotExist
+	}
+	return simpleFileInfo{
+		name:    path.Base(k),
+		isDir:   true,
+		modTime: modTime,
+	}, nil
+}
+
+func (m *Memory) Rename(old, new string) error {
+	err := m.inject("rename", old)
+	if core.IsErr(err, "cannot rename %s to %s: %v", old, new) {
+		return err
+	}
+
+	o, n := memoryKey(old), memoryKey(new)
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	f, ok := m.store.files[o]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	delete(m.store.files, o)
+	m.store.version++
+	f.version = m.store.version
+	m.store.files[n] = f
+	m.store.deleted[o] = m.store.version
+	delete(m.store.deleted, n)
+	return nil
+}
+
+func (m *Memory) Delete(name string) error {
+	err := m.inject("delete", name)
+	if core.IsErr(err, "cannot delete %s: %v", name) {
+		return err
+	}
+
+	k := memoryKey(name)
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	var found bool
+	for n := range m.store.files {
+		if n == k || k == "" || strings.HasPrefix(n, k+"/") {
+			if !found {
+				m.store.version++
+			}
+			delete(m.store.files, n)
+			m.store.deleted[n] = m.store.version
+			found = true
+		}
+	}
+	if !found {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) String() string {
+	return m.url
+}
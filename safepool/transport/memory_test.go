@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	url := "mem://test.memory"
+	defer DeleteMemory(url)
+
+	m, err := NewExchanger(url)
+	assert.NoErrorf(t, err, "cannot create memory exchanger: %v", err)
+	testCreateFile(t, m)
+
+	data := []byte("just a simple test")
+	assert.NoError(t, WriteFile(m, "pool/feeds/1.body", data))
+	assert.NoError(t, WriteFile(m, "pool/.access", data))
+
+	var b bytes.Buffer
+	assert.NoError(t, m.Read("pool/feeds/1.body", &Range{From: 7, To: 13}, &b))
+	assert.Equal(t, "simple", b.String())
+
+	m2, _ := NewExchanger(url)
+	b2, err := ReadFile(m2, "pool/feeds/1.body")
+	assert.NoError(t, err)
+	assert.Equal(t, data, b2, "exchangers with the same url must share the content")
+
+	ls, err := m.ReadDir("pool", 0)
+	assert.NoError(t, err)
+	assert.Len(t, ls, 1)
+	assert.True(t, ls[0].IsDir())
+
+	ls, err = m.ReadDir("pool", IncludeHiddenFiles)
+	assert.NoError(t, err)
+	assert.Len(t, ls, 2)
+
+	assert.True(t, m.Touched("pool"))
+	assert.False(t, m.Touched("pool"))
+	assert.NoError(t, WriteFile(m2, "pool/feeds/2.body", data))
+	assert.True(t, m.Touched("pool"))
+
+	assert.NoError(t, m.Rename("pool/feeds/2.body", "pool/feeds/3.body"))
+	_, err = m.Stat("pool/feeds/2.body")
+	assert.Error(t, err)
+
+	assert.True(t, m.Touched("pool/feeds"))
+	assert.NoError(t, m.Delete("pool/feeds/3.body"))
+	assert.True(t, m.Touched("pool/feeds"))
+	assert.False(t, m.Touched("pool/feeds"))
+	assert.NoError(t, m.Rename("pool/feeds/1.body", "pool/1.body"))
+	assert.True(t, m.Touched("pool/feeds"))
+
+	assert.NoError(t, m.Delete("pool"))
+	_, err = m.Stat("pool/feeds/1.body")
+	assert.Error(t, err)
+}
+
+func TestMemoryFaults(t *testing.T) {
+	url := "mem://test.faults"
+	defer DeleteMemory(url)
+
+	m, _ := NewExchanger(url)
+	errFault := errors.New("injected fault")
+	SetMemoryFaults(url, MemoryFaults{
+		Fail: func(op, name string) error {
+			if op == "read" {
+				return errFault
+			}
+			return nil
+		},
+		PartialWrite: 4,
+	})
+
+	err := WriteFile(m, "a", []byte("0123456789"))
+	assert.ErrorIs(t, err, io.ErrShortWrite)
+	_, err = m.Stat("a")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "a partial write must not create the destination")
+	ls, err := m.ReadDir("", IncludeHiddenFiles)
+	assert.NoError(t, err)
+	assert.Empty(t, ls, "temporary files must be hidden")
+
+	_, err = ReadFile(m, "a")
+	assert.ErrorIs(t, err, errFault)
+}
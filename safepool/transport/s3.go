@@ -2,9 +2,11 @@ package transport
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
@@ -15,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -39,7 +42,7 @@ type S3 struct {
 }
 
 func ParseS3Url(s string) (S3Config, error) {
-	u, err := url.Parse(s)
+	u, err := parseUrl(s)
 	if err != nil {
 		return S3Config{}, err
 	}
@@ -52,6 +55,18 @@ func ParseS3Url(s string) (S3Config, error) {
 	}, nil
 }
 
+func validateS3Url(s string) error {
+	u, err := parseUrl(s)
+	if err != nil {
+		return err
+	}
+
+	if strings.Trim(u.Path, "/") == "" {
+		return fmt.Errorf("missing bucket in s3 url")
+	}
+	return nil
+}
+
 func S3ToUrl(c S3Config) string {
 	return fmt.Sprintf("s3://%s@%s/%s#region-%s", c.AccessKey, c.Endpoint, c.Bucket, c.Region)
 }
@@ -85,7 +100,7 @@ func getAWSConfig(u *url.URL) *aws.Config {
 }
 
 func NewS3(connectionUrl string) (Exchanger, error) {
-	u, err := url.Parse(connectionUrl)
+	u, err := parseUrl(connectionUrl)
 	if core.IsErr(err, "invalid url '%s': %v", connectionUrl) {
 		return nil, err
 	}
@@ -146,7 +161,7 @@ func (s *S3) Touched(name string) bool {
 func (s *S3) Read(name string, rang *Range, dest io.Writer) error {
 	var r *string
 	if rang != nil {
-		r = aws.String(fmt.Sprintf("byte%d-%d", rang.From, rang.To))
+		r = aws.String(fmt.Sprintf("bytes=%d-%d", rang.From, rang.To-1))
 	}
 
 	rawObject, err := s.svc.GetObject(
@@ -168,6 +183,8 @@ func (s *S3) Read(name string, rang *Range, dest io.Writer) error {
 	return nil
 }
 
+// Write uploads the content. S3 makes an object visible only when the upload completes, so no temporary
+// name is needed
 func (s *S3) Write(name string, source io.Reader) error {
 
 	_, err := s.uploader.Upload(&s3manager.UploadInput{
@@ -181,34 +198,184 @@ func (s *S3) Write(name string, source io.Reader) error {
 	return err
 }
 
+// s3PartSize is the size of a part in a resumable upload. S3 requires at least 5MB for all parts but the last
+var s3PartSize = 8 << 20
+
+// WriteResumable uploads the file with a multipart upload. The upload id and the completed parts are stored in the DB
+// so that an interrupted upload continues from the last part
+func (s *S3) WriteResumable(name string, source io.Reader) error {
+	var parts []*s3.CompletedPart
+	state, err := sqlGetUpload(s.String(), name)
+	if err == nil {
+		err = json.Unmarshal(state.Parts, &parts)
+	}
+	if err != nil {
+		out, err := s.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: &s.bucket,
+			Key:    &name,
+		})
+		if core.IsErr(err, "cannot start upload of %s/%s: %v", s, name) {
+			return err
+		}
+		state, parts = uploadState{UploadId: aws.StringValue(out.UploadId)}, nil
+	}
+
+	err = skipUploaded(source, state.Offset)
+	if core.IsErr(err, "cannot resume upload of %s/%s: %v", s, name) {
+		return err
+	}
+
+	buf := make([]byte, s3PartSize)
+	for last := false; !last; {
+		n, err := io.ReadFull(source, buf)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		default:
+			core.IsErr(err, "cannot read source for %s/%s: %v", s, name)
+			return err
+		}
+		if n == 0 && len(parts) > 0 {
+			break
+		}
+
+		number := int64(len(parts) + 1)
+		out, err := s.svc.UploadPart(&s3.UploadPartInput{
+			Bucket:     &s.bucket,
+			Key:        &name,
+			UploadId:   &state.UploadId,
+			PartNumber: &number,
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			sqlDelUpload(s.String(), name)
+		}
+		if core.IsErr(err, "cannot upload part %d of %s/%s: %v", number, s, name) {
+			return err
+		}
+
+		parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: &number})
+		state.Offset += int64(n)
+		state.Parts, _ = json.Marshal(parts)
+		err = sqlSetUpload(s.String(), name, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &name,
+		UploadId:        &state.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if core.IsErr(err, "cannot complete upload of %s/%s: %v", s, name) {
+		return err
+	}
+	return sqlDelUpload(s.String(), name)
+}
+
+func (s *S3) AbortWrite(name string) error {
+	state, err := sqlGetUpload(s.String(), name)
+	if err != nil {
+		return nil
+	}
+
+	_, err = s.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &name,
+		UploadId: &state.UploadId,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		err = nil
+	}
+	if core.IsErr(err, "cannot abort upload of %s/%s: %v", s, name) {
+		return err
+	}
+	return sqlDelUpload(s.String(), name)
+}
+
+func s3Prefix(dir string) string {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// ReadDir lists the folder through all the result pages. Common prefixes are reported as folders
 func (s *S3) ReadDir(dir string, opts ListOption) ([]fs.FileInfo, error) {
-	input := &s3.ListObjectsInput{
+	prefix := s3Prefix(dir)
+	input := &s3.ListObjectsV2Input{
 		Bucket:    aws.String(s.bucket),
-		Prefix:    aws.String(dir + "/"),
+		Prefix:    aws.String(prefix),
 		Delimiter: aws.String("/"),
 	}
 
-	result, err := s.svc.ListObjects(input)
+	var infos []fs.FileInfo
+	err := s.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, item := range page.CommonPrefixes {
+			name := strings.TrimSuffix(aws.StringValue(item.Prefix)[len(prefix):], "/")
+			if !hideFile(name, opts) {
+				infos = append(infos, simpleFileInfo{
+					name:  name,
+					isDir: true,
+				})
+			}
+		}
+		for _, item := range page.Contents {
+			name := aws.StringValue(item.Key)[len(prefix):]
+			if name == "" || hideFile(name, opts) {
+				continue
+			}
+			infos = append(infos, simpleFileInfo{
+				name:    name,
+				size:    aws.Int64Value(item.Size),
+				modTime: aws.TimeValue(item.LastModified),
+			})
+		}
+		return true
+	})
 	if err != nil {
 		logrus.Errorf("cannot list %s/%s: %v", s.String(), dir, err)
 		return nil, err
 	}
 
-	var infos []fs.FileInfo
-	for _, item := range result.Contents {
-		cut := len(path.Clean(dir))
-		name := (*item.Key)[cut+1:]
-
-		infos = append(infos, simpleFileInfo{
-			name:    name,
-			size:    *item.Size,
-			isDir:   false,
-			modTime: *item.LastModified,
-		})
+	return infos, nil
+}
 
+// Walk lists all the objects under the prefix with a flat listing, one page at a time
+func (s *S3) Walk(dir string, fn WalkFunc) error {
+	prefix := s3Prefix(dir)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
 	}
 
-	return infos, nil
+	var fnErr error
+	err := s.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, item := range page.Contents {
+			key := aws.StringValue(item.Key)
+			if hiddenPath(key[len(prefix):]) {
+				continue
+			}
+			fnErr = fn(key, simpleFileInfo{
+				name:    path.Base(key),
+				size:    aws.Int64Value(item.Size),
+				modTime: aws.TimeValue(item.LastModified),
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		logrus.Errorf("cannot list %s/%s: %v", s.String(), dir, err)
+		return err
+	}
+	return fnErr
 }
 
 func (s *S3) Stat(name string) (fs.FileInfo, error) {
@@ -236,11 +403,92 @@ func (s *S3) Stat(name string) (fs.FileInfo, error) {
 	}, nil
 }
 
-func (s *S3) Rename(old, new string) error {
+func (s *S3) ETag(name string) (string, error) {
+	head, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &name,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return "", fs.ErrNotExist
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(head.ETag), nil
+}
+
+func (s *S3) WriteIfAbsent(name string, source io.Reader) error {
+	return s.putIf(name, source, "If-None-Match", "*")
+}
+
+func (s *S3) WriteIfMatch(name string, etag string, source io.Reader) error {
+	return s.putIf(name, source, "If-Match", etag)
+}
+
+// putIf uploads the content with a conditional header. The SDK does not expose conditional headers for PutObject,
+// so they are added to the request
+func (s *S3) putIf(name string, source io.Reader, header, value string) error {
+	data, err := io.ReadAll(source)
+	if core.IsErr(err, "cannot read source for %s/%s: %v", s, name) {
+		return err
+	}
+
+	_, err = s.svc.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Bucket: &s.bucket,
+		Key:    &name,
+		Body:   bytes.NewReader(data),
+	}, request.WithSetRequestHeaders(map[string]string{header: value}))
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		switch rerr.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return core.ErrPreconditionFailed
+		}
+	}
+	if core.IsErr(err, "cannot write %s/%s: %v", s, name) {
+		return err
+	}
+	return nil
+}
+
+func (s *S3) copyObject(bucket, source, dest string) error {
 	_, err := s.svc.CopyObject(&s3.CopyObjectInput{
 		Bucket:     &s.bucket,
-		CopySource: aws.String(url.QueryEscape(old)),
-		Key:        aws.String(new),
+		CopySource: aws.String(url.PathEscape(path.Join(strings.Trim(bucket, "/"), source))),
+		Key:        aws.String(dest),
+	})
+	return err
+}
+
+// CopyFrom asks S3 to copy the object when both exchangers use the same endpoint, even across buckets
+func (s *S3) CopyFrom(destName string, source Exchanger, sourceName string) error {
+	src, ok := source.(*S3)
+	if !ok || src.svc.Endpoint != s.svc.Endpoint {
+		return ErrCopyNotSupported
+	}
+
+	err := s.copyObject(src.bucket, sourceName, destName)
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		// the credentials cannot read the source bucket or the object is too large for a single copy
+		case "AccessDenied", "InvalidRequest":
+			return ErrCopyNotSupported
+		}
+	}
+	if core.IsErr(err, "cannot copy %s/%s to %s/%s: %v", src, sourceName, s, destName) {
+		return err
+	}
+	return nil
+}
+
+func (s *S3) Rename(old, new string) error {
+	err := s.copyObject(s.bucket, old, new)
+	if core.IsErr(err, "cannot rename %s/%s: %v", s, old) {
+		return err
+	}
+
+	_, err = s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(old),
 	})
 	return err
 }
@@ -3,10 +3,10 @@ package transport
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"net/url"
 	"time"
 
 	"os"
@@ -28,13 +28,16 @@ type SFTPConfig struct {
 
 type SFTP struct {
 	c     *sftp.Client
+	ssh   *ssh.Client
+	addr  string
+	user  string
 	base  string
 	url   string
 	touch map[string]time.Time
 }
 
 func ParseSFTPUrl(s string) (SFTPConfig, error) {
-	u, err := url.Parse(s)
+	u, err := parseUrl(s)
 	if err != nil {
 		return SFTPConfig{}, err
 	}
@@ -48,13 +51,28 @@ func ParseSFTPUrl(s string) (SFTPConfig, error) {
 	}, nil
 }
 
+func validateSFTPUrl(s string) error {
+	u, err := parseUrl(s)
+	if err != nil {
+		return err
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("missing host in sftp url")
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword && u.Query().Get("key") == "" {
+		return fmt.Errorf("no auth method provided for sftp url")
+	}
+	return nil
+}
+
 func ToUrl(config SFTPConfig) string {
 	return fmt.Sprintf("sftp://%s@%s/%s", config.Username, config.Addr, config.Base)
 }
 
 // NewSFTP create a new Exchanger. The url is in the format sftp://
 func NewSFTP(connectionUrl string) (Exchanger, error) {
-	u, err := url.Parse(connectionUrl)
+	u, err := parseUrl(connectionUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +130,7 @@ func NewSFTP(connectionUrl string) (Exchanger, error) {
 	if base == "" {
 		base = "/"
 	}
-	return &SFTP{c, base, repr, map[string]time.Time{}}, nil
+	return &SFTP{c, client, addr, u.User.Username(), base, repr, map[string]time.Time{}}, nil
 }
 
 func (s *SFTP) Touched(name string) bool {
@@ -167,29 +185,179 @@ func (s *SFTP) Read(name string, rang *Range, dest io.Writer) error {
 
 func (s *SFTP) Write(name string, source io.Reader) error {
 	name = path.Join(s.base, name)
+	tmp := tempName(name)
 
-	f, err := s.c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	f, err := s.c.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL)
 	if os.IsNotExist(err) {
 		dir := path.Dir(name)
 		s.c.MkdirAll(dir)
-		f, err = s.c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+		f, err = s.c.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL)
 	}
 	if core.IsErr(err, "cannot create SFTP file '%s': %v", name) {
 		return err
 	}
 
 	_, err = io.Copy(f, source)
-	core.IsErr(err, "cannot write SFTP file '%s': %v", name)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.replace(tmp, name)
+	}
+	if core.IsErr(err, "cannot write SFTP file '%s': %v", name) {
+		s.c.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *SFTP) createExclusive(name string, source io.Reader) error {
+	name = path.Join(s.base, name)
+
+	f, err := s.c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if os.IsNotExist(err) {
+		s.c.MkdirAll(path.Dir(name))
+		f, err = s.c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	}
+	if err != nil {
+		// SFTP v3 has no specific status for an existing file
+		if _, serr := s.c.Stat(name); serr == nil {
+			return fs.ErrExist
+		}
+		return err
+	}
+
+	_, err = io.Copy(f, source)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.c.Remove(name)
+	}
+	return err
+}
+
+func (s *SFTP) ETag(name string) (string, error) {
+	return contentTag(s, name)
+}
+
+func (s *SFTP) WriteIfAbsent(name string, source io.Reader) error {
+	err := s.createExclusive(name, source)
+	if errors.Is(err, fs.ErrExist) {
+		return core.ErrPreconditionFailed
+	}
+	core.IsErr(err, "cannot create SFTP file '%s': %v", name)
+	return err
+}
+
+func (s *SFTP) WriteIfMatch(name string, etag string, source io.Reader) error {
+	return writeIfMatch(s, name, etag, source)
+}
+
+func (s *SFTP) WriteResumable(name string, source io.Reader) error {
+	return writePartial(s, name, source, func(tmp string) (partialFile, error) {
+		tmp = path.Join(s.base, tmp)
+		f, err := s.c.OpenFile(tmp, os.O_WRONLY|os.O_CREATE)
+		if os.IsNotExist(err) {
+			s.c.MkdirAll(path.Dir(tmp))
+			f, err = s.c.OpenFile(tmp, os.O_WRONLY|os.O_CREATE)
+		}
+		return f, err
+	}, func(tmp, name string) error {
+		return s.replace(path.Join(s.base, tmp), path.Join(s.base, name))
+	})
+}
+
+func (s *SFTP) AbortWrite(name string) error {
+	err := s.c.Remove(path.Join(s.base, uploadTempName(name)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return sqlDelUpload(s.String(), name)
+}
+
+// Capabilities depends on the extensions supported by the server
+func (s *SFTP) Capabilities() Capability {
+	c := RangeRead
+	if _, ok := s.c.HasExtension("posix-rename@openssh.com"); ok {
+		c |= AtomicRename
+	}
+	if _, ok := s.c.HasExtension(copyDataExtension); ok {
+		c |= ServerSideCopy
+	}
+	return c
+}
+
+// CopyFrom asks the server to copy the file with the copy-data extension when both exchangers are on the same
+// server with the same user. Without the extension, or when the copy fails, ErrCopyNotSupported lets CopyFile
+// stream the file through the client
+func (s *SFTP) CopyFrom(destName string, source Exchanger, sourceName string) error {
+	src, ok := source.(*SFTP)
+	if !ok || src.addr != s.addr || src.user != s.user {
+		return ErrCopyNotSupported
+	}
+	if _, ok := s.c.HasExtension(copyDataExtension); !ok {
+		return ErrCopyNotSupported
+	}
+
+	srcName := path.Join(src.base, sourceName)
+	if _, err := s.c.Stat(srcName); err != nil {
+		return err
+	}
+
+	ch, closeCh, err := openSftpChannel(s.ssh)
+	if core.IsErr(err, "cannot open sftp channel for copy on %s: %v", s.addr) {
+		return ErrCopyNotSupported
+	}
+	defer closeCh()
+
+	name := path.Join(s.base, destName)
+	tmp := tempName(name)
+	s.c.MkdirAll(path.Dir(name))
+	err = ch.copyData(srcName, tmp)
+	if core.IsErr(err, "cannot copy SFTP file '%s' on the server: %v", name) {
+		s.c.Remove(tmp)
+		return ErrCopyNotSupported
+	}
+
+	err = s.replace(tmp, name)
+	if core.IsErr(err, "cannot copy SFTP file '%s': %v", name) {
+		s.c.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// replace renames old to new overwriting new if present. The posix-rename extension does it atomically;
+// on servers without the extension the destination is removed first
+func (s *SFTP) replace(old, new string) error {
+	if _, ok := s.c.HasExtension("posix-rename@openssh.com"); ok {
+		return s.c.PosixRename(old, new)
+	}
+
+	err := s.c.Rename(old, new)
+	if err != nil {
+		if _, serr := s.c.Stat(new); serr == nil {
+			s.c.Remove(new)
+			err = s.c.Rename(old, new)
+		}
+	}
 	return err
 }
 
 func (s *SFTP) ReadDir(dir string, opts ListOption) ([]fs.FileInfo, error) {
 	dir = path.Join(s.base, dir)
-	infos, err := s.c.ReadDir(dir)
+	ls, err := s.c.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
 
+	var infos []fs.FileInfo
+	for _, info := range ls {
+		if !hideFile(info.Name(), opts) {
+			infos = append(infos, info)
+		}
+	}
 	return infos, nil
 }
 
@@ -198,7 +366,7 @@ func (s *SFTP) Stat(name string) (os.FileInfo, error) {
 }
 
 func (s *SFTP) Rename(old, new string) error {
-	return s.c.Rename(path.Join(s.base, old), path.Join(s.base, new))
+	return s.replace(path.Join(s.base, old), path.Join(s.base, new))
 }
 
 func (s *SFTP) Delete(name string) error {
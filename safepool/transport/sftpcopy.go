@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The sftp library does not expose the copy-data extension, so the server side copy opens a second sftp channel on
+// the same ssh connection and sends the few requests it needs one at a time
+
+const copyDataExtension = "copy-data"
+
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpExtended = 200
+
+	sshFxfRead  = 0x01
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+
+	sftpProtocolVersion = 3
+	sftpMaxPacket       = 256 * 1024
+)
+
+var errInvalidSftpPacket = errors.New("invalid sftp packet")
+
+// sftpChannel is a minimal sftp client that supports only the requests needed by copy-data
+type sftpChannel struct {
+	r  io.Reader
+	w  io.Writer
+	id uint32
+}
+
+// openSftpChannel starts the sftp subsystem on a new session of client. The returned function closes the session
+func openSftpChannel(client *ssh.Client) (*sftpChannel, func() error, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	err = session.RequestSubsystem("sftp")
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	c := &sftpChannel{r: r, w: w}
+	err = c.init()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	return c, session.Close, nil
+}
+
+func (c *sftpChannel) init() error {
+	err := c.send(sshFxpInit, uint32(sftpProtocolVersion))
+	if err != nil {
+		return err
+	}
+	kind, _, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if kind != sshFxpVersion {
+		return errInvalidSftpPacket
+	}
+	return nil
+}
+
+// send writes a packet with the provided fields, which can be uint32, uint64, string or []byte
+func (c *sftpChannel) send(kind byte, fields ...any) error {
+	var b bytes.Buffer
+	b.Write([]byte{0, 0, 0, 0, kind})
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			b.Write(binary.BigEndian.AppendUint32(nil, v))
+		case uint64:
+			b.Write(binary.BigEndian.AppendUint64(nil, v))
+		case string:
+			b.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+			b.WriteString(v)
+		case []byte:
+			b.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+			b.Write(v)
+		default:
+			return fmt.Errorf("unsupported sftp field %T", f)
+		}
+	}
+	data := b.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	_, err := c.w.Write(data)
+	return err
+}
+
+// recv reads a packet and returns its type and payload
+func (c *sftpChannel) recv() (byte, []byte, error) {
+	var l [4]byte
+	_, err := io.ReadFull(c.r, l[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 || n > sftpMaxPacket {
+		return 0, nil, errInvalidSftpPacket
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(c.r, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return data[0], data[1:], nil
+}
+
+// request sends a request with a new id and returns the response without the id
+func (c *sftpChannel) request(kind byte, fields ...any) (byte, []byte, error) {
+	c.id++
+	err := c.send(kind, append([]any{c.id}, fields...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	kind, data, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != c.id {
+		return 0, nil, errInvalidSftpPacket
+	}
+	return kind, data[4:], nil
+}
+
+// sftpString reads a string field from data and returns it with the rest of data
+func sftpString(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errInvalidSftpPacket
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint32(len(data)-4) < n {
+		return nil, nil, errInvalidSftpPacket
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+// sftpStatus returns the error in a status response, or nil when the request succeeded
+func sftpStatus(kind byte, data []byte) error {
+	if kind != sshFxpStatus || len(data) < 4 {
+		return errInvalidSftpPacket
+	}
+	code := binary.BigEndian.Uint32(data)
+	if code == 0 {
+		return nil
+	}
+	msg, _, _ := sftpString(data[4:])
+	return fmt.Errorf("sftp error %d: %s", code, msg)
+}
+
+func (c *sftpChannel) open(name string, flags uint32) ([]byte, error) {
+	kind, data, err := c.request(sshFxpOpen, name, flags, uint32(0))
+	if err != nil {
+		return nil, err
+	}
+	if kind != sshFxpHandle {
+		err = sftpStatus(kind, data)
+		if err == nil {
+			err = errInvalidSftpPacket
+		}
+		return nil, err
+	}
+	handle, _, err := sftpString(data)
+	return handle, err
+}
+
+func (c *sftpChannel) close(handle []byte) error {
+	kind, data, err := c.request(sshFxpClose, handle)
+	if err != nil {
+		return err
+	}
+	return sftpStatus(kind, data)
+}
+
+// copyData copies the whole file src to dst, which is created or truncated, without the data leaving the server
+func (c *sftpChannel) copyData(src, dst string) error {
+	r, err := c.open(src, sshFxfRead)
+	if err != nil {
+		return err
+	}
+	defer c.close(r)
+
+	w, err := c.open(dst, sshFxfWrite|sshFxfCreat|sshFxfTrunc)
+	if err != nil {
+		return err
+	}
+	// a read length of 0 copies until the end of the source
+	kind, data, err := c.request(sshFxpExtended, copyDataExtension, r, uint64(0), uint64(0), w, uint64(0))
+	if err == nil {
+		err = sftpStatus(kind, data)
+	}
+	cerr := c.close(w)
+	if err != nil {
+		return err
+	}
+	return cerr
+}
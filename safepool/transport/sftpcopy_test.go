@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// copyDataServer answers the requests of sftpChannel on files kept in memory
+func copyDataServer(t *testing.T, c *sftpChannel, files map[string][]byte) {
+	kind, _, err := c.recv()
+	if err != nil || kind != sshFxpInit {
+		return
+	}
+	c.send(sshFxpVersion, uint32(sftpProtocolVersion), copyDataExtension, "1")
+
+	handles := map[string]string{}
+	status := func(id uint32, code uint32) {
+		c.send(sshFxpStatus, id, code, "", "")
+	}
+	for {
+		kind, data, err := c.recv()
+		if err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		switch kind {
+		case sshFxpOpen:
+			name, rest, _ := sftpString(data)
+			flags := binary.BigEndian.Uint32(rest)
+			if _, ok := files[string(name)]; !ok && flags&sshFxfCreat == 0 {
+				status(id, 2)
+				continue
+			}
+			if flags&sshFxfTrunc != 0 {
+				files[string(name)] = nil
+			}
+			handle := string(name)
+			handles[handle] = string(name)
+			c.send(sshFxpHandle, id, handle)
+		case sshFxpClose:
+			handle, _, _ := sftpString(data)
+			delete(handles, string(handle))
+			status(id, 0)
+		case sshFxpExtended:
+			ext, rest, _ := sftpString(data)
+			assert.Equal(t, copyDataExtension, string(ext))
+			r, rest, _ := sftpString(rest)
+			assert.Equal(t, uint64(0), binary.BigEndian.Uint64(rest[8:]))
+			w, _, _ := sftpString(rest[16:])
+			files[handles[string(w)]] = append([]byte{}, files[handles[string(r)]]...)
+			status(id, 0)
+		default:
+			status(id, 8)
+		}
+	}
+}
+
+func TestSftpCopyData(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	defer cw.Close()
+	defer sw.Close()
+
+	files := map[string][]byte{"/pool/1.body": []byte("just a simple test")}
+	done := make(chan struct{})
+	go func() {
+		copyDataServer(t, &sftpChannel{r: sr, w: sw}, files)
+		close(done)
+	}()
+
+	c := &sftpChannel{r: cr, w: cw}
+	assert.NoError(t, c.init())
+	assert.NoError(t, c.copyData("/pool/1.body", "/copy/1.body"))
+	assert.Error(t, c.copyData("/pool/2.body", "/copy/2.body"))
+
+	cw.Close()
+	<-done
+	assert.Equal(t, []byte("just a simple test"), files["/copy/1.body"])
+	assert.NotContains(t, files, "/copy/2.body")
+}
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/code-to-go/safe/safepool/core"
+	"github.com/code-to-go/safe/safepool/sql"
+)
+
+// Resumable is implemented by exchangers that can continue an interrupted write. The progress of a write is
+// stored in the local DB, so the write can be resumed after a restart
+type Resumable interface {
+	// WriteResumable writes a file like Write. When a previous write of the same file was interrupted, it
+	// continues from the last confirmed offset. source must provide the same content on every call
+	WriteResumable(name string, source io.Reader) error
+
+	// AbortWrite discards an interrupted write and the data already uploaded
+	AbortWrite(name string) error
+}
+
+type uploadState struct {
+	UploadId string
+	Offset   int64
+	Parts    []byte
+	ModTime  time.Time
+}
+
+// uploadCheckpoint is the amount of data written between two updates of the progress in the DB
+var uploadCheckpoint int64 = 4 << 20
+
+// WriteResumable writes a file and records the progress, so that an interrupted write continues from the last
+// confirmed offset. Exchangers that cannot resume write the full file
+func WriteResumable(e Exchanger, name string, source io.Reader) error {
+	if r, ok := e.(Resumable); ok {
+		return r.WriteResumable(name, source)
+	}
+	return e.Write(name, source)
+}
+
+// AbortWrite discards an interrupted resumable write
+func AbortWrite(e Exchanger, name string) error {
+	if r, ok := e.(Resumable); ok {
+		return r.AbortWrite(name)
+	}
+	return nil
+}
+
+// UploadProgress returns the bytes of an interrupted write confirmed by the server
+func UploadProgress(e Exchanger, name string) int64 {
+	s, err := sqlGetUpload(e.String(), name)
+	if err != nil {
+		return 0
+	}
+	return s.Offset
+}
+
+// skipUploaded discards from source the bytes already uploaded in a previous attempt
+func skipUploaded(source io.Reader, offset int64) error {
+	n, err := io.CopyN(io.Discard, source, offset)
+	if err == io.EOF {
+		return fmt.Errorf("source is shorter (%d bytes) than the data already uploaded (%d bytes)", n, offset)
+	}
+	return err
+}
+
+// partialFile is a file on the storage that can be extended by a resumed write
+type partialFile interface {
+	io.WriteSeeker
+	io.Closer
+	Truncate(size int64) error
+}
+
+func uploadTempName(name string) string {
+	dir, base := path.Split(name)
+	return path.Join(dir, tempPrefix+base+".upload"+tempSuffix)
+}
+
+// writePartial writes source to a temporary file, which is extended from the last checkpoint when a previous
+// write was interrupted, and commits the file to its name when complete. The write starts again when the temporary
+// file is shorter than the checkpoint, e.g. because it was removed from the storage
+func writePartial(e Exchanger, name string, source io.Reader, open func(string) (partialFile, error),
+	commit func(tmp, name string) error) error {
+
+	tmp := uploadTempName(name)
+	s, err := sqlGetUpload(e.String(), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		s = uploadState{UploadId: tmp}
+	} else if core.IsErr(err, "cannot read upload state for %s/%s: %v", e, name) {
+		return err
+	}
+
+	f, err := open(tmp)
+	if core.IsErr(err, "cannot open %s/%s: %v", e, tmp) {
+		return err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil && size < s.Offset {
+		core.Info("partial upload of %s/%s is shorter than the checkpoint: restarting", e, name)
+		s.Offset = 0
+	}
+	if err == nil {
+		err = f.Truncate(s.Offset)
+	}
+	if err == nil {
+		_, err = f.Seek(s.Offset, io.SeekStart)
+	}
+	if err == nil {
+		err = skipUploaded(source, s.Offset)
+	}
+	if core.IsErr(err, "cannot resume write of %s/%s: %v", e, name) {
+		return err
+	}
+
+	for {
+		n, err := io.CopyN(f, source, uploadCheckpoint)
+		if n > 0 {
+			s.Offset += n
+			if err := sqlSetUpload(e.String(), name, s); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if core.IsErr(err, "cannot write %s/%s: %v", e, name) {
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err == nil {
+		err = commit(tmp, name)
+	}
+	if core.IsErr(err, "cannot complete write of %s/%s: %v", e, name) {
+		return err
+	}
+	return sqlDelUpload(e.String(), name)
+}
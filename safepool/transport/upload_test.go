@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/code-to-go/safe/safepool/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteResumable(t *testing.T) {
+	sql.LoadSQLFromFile("../sqlite.sql")
+	assert.NoError(t, sql.OpenDB(filepath.Join(t.TempDir(), "test.db")))
+	defer sql.CloseDB()
+	uploadCheckpoint = 16
+
+	dir := t.TempDir()
+	l, _ := NewExchanger("file://" + dir)
+	data := []byte("a content long enough to be written in a few checkpoints")
+
+	err := WriteResumable(l, "pool/feeds/1.body", &failingReader{data: data[0:40]})
+	assert.Error(t, err)
+	assert.Equal(t, int64(40), UploadProgress(l, "pool/feeds/1.body"))
+	_, err = l.Stat("pool/feeds/1.body")
+	assert.Error(t, err, "an interrupted write must not create the file")
+
+	assert.NoError(t, WriteResumable(l, "pool/feeds/1.body", bytes.NewReader(data)))
+	b, err := ReadFile(l, "pool/feeds/1.body")
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+	assert.Zero(t, UploadProgress(l, "pool/feeds/1.body"))
+
+	// a partial file shorter than the checkpoint is written again
+	assert.Error(t, WriteResumable(l, "pool/feeds/3.body", &failingReader{data: data[0:40]}))
+	tmp := filepath.Join(dir, uploadTempName("pool/feeds/3.body"))
+	assert.NoError(t, os.Truncate(tmp, 10))
+	assert.NoError(t, WriteResumable(l, "pool/feeds/3.body", bytes.NewReader(data)))
+	b, err = ReadFile(l, "pool/feeds/3.body")
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	assert.Error(t, WriteResumable(l, "pool/feeds/2.body", &failingReader{data: data[0:20]}))
+	assert.NoError(t, AbortWrite(l, "pool/feeds/2.body"))
+	assert.Zero(t, UploadProgress(l, "pool/feeds/2.body"))
+	ls, err := l.ReadDir("pool/feeds", IncludeHiddenFiles)
+	assert.NoError(t, err)
+	assert.Len(t, ls, 2)
+}
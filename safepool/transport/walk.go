@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// WalkFunc is called by Walk for every file. name is the full path of the file. When WalkFunc returns an error,
+// the walk stops and Walk returns the error
+type WalkFunc func(name string, info fs.FileInfo) error
+
+// Walker is implemented by exchangers that can list a folder tree more efficiently than one folder at a time. The
+// files must be reported in lexical order of the names
+type Walker interface {
+	Walk(prefix string, fn WalkFunc) error
+}
+
+// Walk calls fn for every file under prefix, including the files in sub-folders, in lexical order of the names,
+// i.e. the order of an S3 listing. Hidden files and folders are skipped. Folders are listed one at a time, so a
+// large tree is never loaded in memory at once
+func Walk(e Exchanger, prefix string, fn WalkFunc) error {
+	if w, ok := e.(Walker); ok {
+		return w.Walk(prefix, fn)
+	}
+	return walkDir(e, prefix, fn)
+}
+
+func walkDir(e Exchanger, dir string, fn WalkFunc) error {
+	ls, err := e.ReadDir(dir, 0)
+	if err != nil {
+		return err
+	}
+	// a folder sorts as its name followed by a slash, so that the full names are in lexical order
+	sortName := func(l fs.FileInfo) string {
+		if l.IsDir() {
+			return l.Name() + "/"
+		}
+		return l.Name()
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		return sortName(ls[i]) < sortName(ls[j])
+	})
+
+	for _, l := range ls {
+		name := path.Join(dir, l.Name())
+		if l.IsDir() {
+			err = walkDir(e, name, fn)
+		} else {
+			err = fn(name, l)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hiddenPath returns true when any element of the relative path is hidden
+func hiddenPath(name string) bool {
+	for _, p := range strings.Split(name, "/") {
+		if hideFile(p, 0) {
+			return true
+		}
+	}
+	return false
+}
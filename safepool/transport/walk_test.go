@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalk(t *testing.T) {
+	url := "mem://test.walk"
+	defer DeleteMemory(url)
+
+	for _, url := range []string{url, "file://" + t.TempDir()} {
+		e, _ := NewExchanger(url)
+		for _, n := range []string{"pool/.access", "pool/feeds/20230101/1.head", "pool/feeds/20230101/1.body",
+			"pool/feeds/20230102/2.head", "pool/identities/a", "pool/.hidden/b", "pool/feeds.txt"} {
+			assert.NoError(t, WriteFile(e, n, []byte(n)))
+		}
+
+		ls, err := e.ReadDir("pool/feeds", 0)
+		assert.NoError(t, err)
+		assert.Len(t, ls, 2)
+		assert.True(t, ls[0].IsDir(), "sub-folders must be reported as folders")
+
+		var names []string
+		err = Walk(e, "pool", func(name string, info fs.FileInfo) error {
+			names = append(names, name)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"pool/feeds.txt", "pool/feeds/20230101/1.body", "pool/feeds/20230101/1.head",
+			"pool/feeds/20230102/2.head", "pool/identities/a"}, names, "names are in lexical order")
+
+		errStop := errors.New("stop")
+		var count int
+		err = Walk(e, "pool", func(name string, info fs.FileInfo) error {
+			count++
+			return errStop
+		})
+		assert.ErrorIs(t, err, errStop)
+		assert.Equal(t, 1, count)
+	}
+}
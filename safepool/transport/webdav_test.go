@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// conditionalHandler checks the conditional headers on PUT, which the webdav handler of x/net ignores
+type conditionalHandler struct {
+	h     http.Handler
+	mutex sync.Mutex
+}
+
+func (c *conditionalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		c.h.ServeHTTP(w, r)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	head := httptest.NewRecorder()
+	c.h.ServeHTTP(head, httptest.NewRequest(http.MethodHead, r.URL.Path, nil))
+	exists := head.Code == http.StatusOK
+	ifMatch := r.Header.Get("If-Match")
+	if r.Header.Get("If-None-Match") == "*" && exists ||
+		ifMatch != "" && (!exists || ifMatch != head.Header().Get("ETag")) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	c.h.ServeHTTP(w, r)
+}
+
+func TestWebDAV(t *testing.T) {
+	server := httptest.NewServer(&conditionalHandler{h: &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}})
+	defer server.Close()
+
+	url := "webdav://" + strings.TrimPrefix(server.URL, "http://")
+	w, err := NewExchanger(url)
+	assert.NoErrorf(t, err, "cannot create webdav exchanger: %v", err)
+	defer w.Close()
+	testCreateFile(t, w)
+	testConditionalWrite(t, w)
+
+	data := []byte("just a simple test")
+	assert.NoError(t, WriteFile(w, "pool/feeds/1.body", data))
+	assert.NoError(t, WriteFile(w, "pool/.access", data))
+
+	var b bytes.Buffer
+	assert.NoError(t, w.Read("pool/feeds/1.body", &Range{From: 7, To: 13}, &b))
+	assert.Equal(t, "simple", b.String())
+
+	stat, err := w.Stat("pool/feeds/1.body")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), stat.Size())
+	assert.Equal(t, "1.body", stat.Name())
+
+	ls, err := w.ReadDir("pool", 0)
+	assert.NoError(t, err)
+	assert.Len(t, ls, 1)
+	assert.Equal(t, "feeds", ls[0].Name())
+	assert.True(t, ls[0].IsDir())
+
+	ls, err = w.ReadDir("pool", IncludeHiddenFiles)
+	assert.NoError(t, err)
+	assert.Len(t, ls, 2)
+
+	assert.True(t, w.Touched("pool/feeds"))
+	assert.False(t, w.Touched("pool/feeds"))
+	assert.NoError(t, WriteFile(w, "pool/feeds/2.body", data))
+	assert.True(t, w.Touched("pool/feeds"))
+
+	assert.NoError(t, w.Rename("pool/feeds/2.body", "pool/feeds/3.body"))
+	_, err = w.Stat("pool/feeds/2.body")
+	assert.Error(t, err)
+	b2, err := ReadFile(w, "pool/feeds/3.body")
+	assert.NoError(t, err)
+	assert.Equal(t, data, b2)
+
+	assert.NoError(t, w.Delete("pool"))
+	_, err = w.Stat("pool/feeds/1.body")
+	assert.Error(t, err)
+}